@@ -0,0 +1,105 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cache provides an on-disk cache for responses of read-only cloud
+// provider queries.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/UKHomeOffice/keto/pkg/cloudprovider"
+)
+
+// DiskCache is a cache that stores JSON encoded values as files in a
+// directory. Values expire TTL after they have been set.
+type DiskCache struct {
+	Dir string
+	TTL time.Duration
+}
+
+// Compile-time check whether DiskCache type value implements
+// cloudprovider.Cache interface.
+var _ cloudprovider.Cache = (*DiskCache)(nil)
+
+// New returns a new DiskCache given a dir directory and a ttl.
+func New(dir string, ttl time.Duration) *DiskCache {
+	return &DiskCache{Dir: dir, TTL: ttl}
+}
+
+// Get decodes a cached value of key into v. Returns false if the key does not
+// exist or has expired.
+func (d DiskCache) Get(key string, v interface{}) (bool, error) {
+	f := d.path(key)
+	fi, err := os.Stat(f)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if time.Since(fi.ModTime()) > d.TTL {
+		return false, nil
+	}
+
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Set stores v under key. The value is written to a temporary file first,
+// so that concurrent keto invocations never read a partially written value.
+func (d DiskCache) Set(key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.Dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(d.Dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), d.path(key))
+}
+
+// path returns a file path of a given key.
+func (d DiskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.Dir, hex.EncodeToString(sum[:])+".json")
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keto-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Use a directory that does not exist yet to make sure it gets created.
+	c := New(filepath.Join(dir, "cache"), time.Hour)
+
+	var got string
+	found, err := c.Get("foo", &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Errorf("got a value %q for a key that has not been set", got)
+	}
+
+	if err := c.Set("foo", "ami123"); err != nil {
+		t.Fatal(err)
+	}
+	found, err = c.Get("foo", &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || got != "ami123" {
+		t.Errorf("got %q, found %v; want %q", got, found, "ami123")
+	}
+
+	// Make the value expire.
+	past := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(c.path("foo"), past, past); err != nil {
+		t.Fatal(err)
+	}
+	found, err = c.Get("foo", &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("got an expired value")
+	}
+}
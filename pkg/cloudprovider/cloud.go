@@ -35,6 +35,49 @@ type Interface interface {
 	// Node returns a node interface. Also returns true if the interface is
 	// supported, false otherwise.
 	Node() (Node, bool)
+	// Events returns an events interface. Also returns true if the interface
+	// is supported, false otherwise.
+	Events() (Events, bool)
+	// Drift returns a drift interface. Also returns true if the interface is
+	// supported, false otherwise.
+	Drift() (Drift, bool)
+	// Capabilities returns optional features the cloud provider supports.
+	Capabilities() Capabilities
+}
+
+// Capabilities describes optional features of a cloud provider, so that
+// unsupported options are rejected before any cloud resources are created.
+type Capabilities struct {
+	// SpotInstances is true if compute pools can run on spot instances.
+	SpotInstances bool
+	// InternalLoadBalancer is true if the kube API of internal clusters can
+	// be served by an internal load balancer.
+	InternalLoadBalancer bool
+	// MaxUserDataSize is the maximum size of node user data in bytes, zero
+	// means there is no limit.
+	MaxUserDataSize int
+	// VolumeTypes lists supported node boot disk types, the first one is the
+	// default. None are supported if it is empty.
+	VolumeTypes []string
+	// NodePoolFields lists node pool spec fields, by their manifest names,
+	// that GetMasterPools and GetComputePools report. Fields that are not
+	// reported can't be compared when a manifest is applied.
+	NodePoolFields []string
+}
+
+// AllNodePoolFields lists all node pool spec fields by their manifest names.
+var AllNodePoolFields = []string{
+	"kube_version",
+	"coreos_version",
+	"machine_type",
+	"disk_size",
+	"size",
+	"ssh_key",
+	"volume_type",
+	"spot_price",
+	"networks",
+	"labels",
+	"extra_args",
 }
 
 // Clusters is an abstract interface for clusters.
@@ -46,9 +89,9 @@ type Clusters interface {
 	// DescribeCluster describes a given cluster.
 	// TODO
 	DescribeCluster(name string) error
-	// DeleteCluster deletes a cluster.
-	// TODO
-	DeleteCluster(name string) error
+	// DeleteCluster deletes a cluster. Resources of kinds listed in retain,
+	// see constants.Retain*, are preserved and returned.
+	DeleteCluster(name string, retain []string) ([]*model.Resource, error)
 	// GetMasterPersistentIPs returns a map of master persistent IP label
 	// values to IPs for a given clusterName.
 	GetMasterPersistentIPs(clusterName string) (map[string]string, error)
@@ -66,6 +109,10 @@ type NodePooler interface {
 	GetMasterPools(clusterName, name string) ([]*model.MasterPool, error)
 	// GetComputePools returns a list of compute pools in the cloud.
 	GetComputePools(clusterName, name string) ([]*model.ComputePool, error)
+	// ValidateNodePool checks that cloud resources a new node pool refers
+	// to, e.g. its image, machine type and networks, exist. Nothing is
+	// created or changed.
+	ValidateNodePool(pool model.NodePool) error
 	// DescribeNodePool describes a given node pool.
 	// TODO
 	DescribeNodePool() error
@@ -86,3 +133,21 @@ type Node interface {
 	// GetNodeData returns node data.
 	GetNodeData() (model.NodeData, error)
 }
+
+// Events is an abstract interface for cloud provider native activity.
+type Events interface {
+	// GetEvents returns a list of cloud provider events related to a given
+	// clusterName. Events are not guaranteed to be in any particular order.
+	GetEvents(clusterName string) ([]*model.Event, error)
+}
+
+// Drift is an abstract interface for out-of-band changes to cloud resources,
+// e.g. an autoscaling group that was resized manually.
+type Drift interface {
+	// GetComputePoolDrift returns a list of out-of-band changes that make
+	// cloud resources of a given compute pool differ from its spec.
+	GetComputePoolDrift(pool model.ComputePool) ([]string, error)
+	// CorrectComputePoolDrift reverts out-of-band changes to cloud resources
+	// of a given compute pool back to its spec.
+	CorrectComputePoolDrift(pool model.ComputePool) error
+}
@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"log"
 	"sync"
+	"time"
 )
 
 var (
@@ -29,13 +30,71 @@ var (
 )
 
 // Factory is a function that returns a cloudprovider.Interface.
-type Factory func(l Logger) (Interface, error)
+type Factory func(l Logger, cfg Config) (Interface, error)
 
 // Logger is generic logger interface for debug logging.
 type Logger interface {
 	Printf(string, ...interface{})
 }
 
+// Cache is a generic interface for caching responses of read-only cloud
+// provider queries.
+type Cache interface {
+	// Get decodes a cached value of key into v. Returns false if there is no
+	// such key or the value has expired.
+	Get(key string, v interface{}) (bool, error)
+	// Set stores v under key.
+	Set(key string, v interface{}) error
+}
+
+// Config represents an optional cloud provider configuration.
+type Config struct {
+	// Cache is used for caching read-only queries, caching is disabled if
+	// not set.
+	Cache Cache
+	// RequestTimeout limits how long a single cloud API call may take,
+	// including retries. Zero means no limit.
+	RequestTimeout time.Duration
+	// OperationTimeout limits how long to wait for a long running cloud
+	// operation, e.g. a stack creation, to complete. Zero means no limit.
+	OperationTimeout time.Duration
+}
+
+// nopCache is a Cache that never caches anything.
+type nopCache struct{}
+
+func (nopCache) Get(string, interface{}) (bool, error) { return false, nil }
+func (nopCache) Set(string, interface{}) error         { return nil }
+
+// GetCached decodes a cached value of key into v and returns true if found.
+// Cache errors are logged and treated as a cache miss. Nothing is cached if c
+// is nil.
+func GetCached(c Cache, l Logger, key string, v interface{}) bool {
+	if c == nil {
+		return false
+	}
+	found, err := c.Get(key, v)
+	if err != nil {
+		l.Printf("failed to read %q from cache: %v", key, err)
+		return false
+	}
+	if found {
+		l.Printf("using cached value of %q", key)
+	}
+	return found
+}
+
+// SetCached caches v under key. Cache errors are logged and otherwise
+// ignored.
+func SetCached(c Cache, l Logger, key string, v interface{}) {
+	if c == nil {
+		return
+	}
+	if err := c.Set(key, v); err != nil {
+		l.Printf("failed to write %q to cache: %v", key, err)
+	}
+}
+
 // Register registers a cloudprovider.Interface by name. This
 // is expected to be called during main startup.
 func Register(name string, cloud Factory) {
@@ -51,12 +110,16 @@ func Register(name string, cloud Factory) {
 }
 
 // InitCloudProvider creates an instance of the named cloud provider. Logger l
-// need to be passed in at initialization time.
-func InitCloudProvider(name string, l Logger) (Interface, error) {
+// and cloud provider config cfg need to be passed in at initialization time.
+func InitCloudProvider(name string, l Logger, cfg Config) (Interface, error) {
 	// Fallback to /dev/null logger if not provided.
 	if l == nil {
 		l = log.New(ioutil.Discard, "", 0)
 	}
+	// Fallback to no caching if cache is not provided.
+	if cfg.Cache == nil {
+		cfg.Cache = nopCache{}
+	}
 	providersMutex.Lock()
 	defer providersMutex.Unlock()
 	f, found := providers[name]
@@ -64,7 +127,7 @@ func InitCloudProvider(name string, l Logger) (Interface, error) {
 		return nil, fmt.Errorf("unknown cloud provider: %q", name)
 	}
 	// return a cloud-specific Factory result
-	return f(l)
+	return f(l, cfg)
 }
 
 // IsRegistered returns a bool whether a given cloud provider is registered.
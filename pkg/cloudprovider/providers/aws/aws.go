@@ -18,19 +18,30 @@ package aws
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/UKHomeOffice/keto/pkg/cloudprovider"
+	"github.com/UKHomeOffice/keto/pkg/constants"
+	"github.com/UKHomeOffice/keto/pkg/kubeargs"
 	"github.com/UKHomeOffice/keto/pkg/model"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/cloudformation"
 	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -62,8 +73,19 @@ const (
 	etcdCAKeyObjectName  = "etcd_ca.key"
 	kubeCACertObjectName = "kube_ca.crt"
 	kubeCAKeyObjectName  = "kube_ca.key"
+
+	// maxUserDataSize is the EC2 limit of instance user data, in raw form
+	// before it is base64 encoded.
+	maxUserDataSize = 16384
+
+	// computePoolMaxSize is the maximum size of compute pool autoscaling
+	// groups.
+	computePoolMaxSize = 100
 )
 
+// volumeTypes are EBS volume types that can be used as node boot disks.
+var volumeTypes = []string{"gp2", "standard"}
+
 var (
 	// ErrNotImplemented defines an error for not implemented features.
 	ErrNotImplemented = errors.New("not implemented")
@@ -72,11 +94,17 @@ var (
 // Cloud is an implementation of cloudprovider.Interface.
 type Cloud struct {
 	Logger cloudprovider.Logger
+	cache  cloudprovider.Cache
+	region string
+	as     autoscalingiface.AutoScalingAPI
 	cf     cloudformationiface.CloudFormationAPI
 	ec2    ec2iface.EC2API
 	elb    elbiface.ELBAPI
 	s3     s3iface.S3API
 	r53    route53iface.Route53API
+
+	// operationTimeout limits how long to wait for stack operations.
+	operationTimeout time.Duration
 }
 
 // Compile-time check whether Cloud type value implements
@@ -88,6 +116,22 @@ func (c *Cloud) ProviderName() string {
 	return ProviderName
 }
 
+// Capabilities returns optional features supported by AWS Cloud.
+func (c *Cloud) Capabilities() cloudprovider.Capabilities {
+	return cloudprovider.Capabilities{
+		SpotInstances:        true,
+		InternalLoadBalancer: true,
+		MaxUserDataSize:      maxUserDataSize,
+		VolumeTypes:          volumeTypes,
+		// Node pool stack outputs, sizes, SSH keys and networks are not
+		// reported.
+		NodePoolFields: []string{
+			"kube_version", "coreos_version", "machine_type", "disk_size",
+			"volume_type", "spot_price", "labels", "extra_args",
+		},
+	}
+}
+
 // Clusters returns an implementation of Clusters interface for AWS Cloud.
 func (c *Cloud) Clusters() (cloudprovider.Clusters, bool) {
 	return c, true
@@ -152,15 +196,56 @@ outer:
 				}
 				c.Name = *o.OutputValue
 			}
+			if *o.OutputKey == driftPolicyOutputKey {
+				c.DriftPolicy = *o.OutputValue
+			}
+			if *o.OutputKey == dnsConfigOutputKey && o.OutputValue != nil {
+				dns, err := decodeDNSConfig(*o.OutputValue)
+				if err != nil {
+					return clusters, fmt.Errorf("failed to decode stack %q DNS config: %v", *s.StackName, err)
+				}
+				c.DNS = dns
+			}
 		}
 
 		c.Internal = clusterInternal(s.Outputs)
 		c.Labels = getStackLabels(s)
 		clusters = append(clusters, c)
 	}
+
+	if len(clusters) == 0 {
+		return clusters, nil
+	}
+	elbStacks, err := c.getStacksByType(elbStackType)
+	if err != nil {
+		return clusters, err
+	}
+	for _, cl := range clusters {
+		for _, s := range elbStacks {
+			if *s.StackName != makeELBStackName(cl.Name) {
+				continue
+			}
+			for _, o := range s.Outputs {
+				if *o.OutputKey == elbDNSOutputKey && o.OutputValue != nil {
+					cl.KubeAPIURL = formatKubeAPIURL(*o.OutputValue)
+				}
+			}
+		}
+	}
 	return clusters, nil
 }
 
+// decodeDNSConfig decodes a base64 encoded JSON DNS config stack output.
+func decodeDNSConfig(v string) (model.DNSConfig, error) {
+	dns := model.DNSConfig{}
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return dns, err
+	}
+	err = json.Unmarshal(b, &dns)
+	return dns, err
+}
+
 // clusterInternal checks whether a given list of stack Outputs contains a
 // internalClusterOutputKey and returns its value as a bool.
 func clusterInternal(outputs []*cloudformation.Output) bool {
@@ -216,21 +301,38 @@ func (c Cloud) getELBName(clusterName string) (string, error) {
 	return "", nil
 }
 
-// DeleteCluster deletes a cluster.
-func (c *Cloud) DeleteCluster(name string) error {
+// DeleteCluster deletes a cluster. Resources of kinds listed in retain are
+// marked to be retained by their stacks before the stacks are deleted.
+func (c *Cloud) DeleteCluster(name string, retain []string) ([]*model.Resource, error) {
+	retained := []*model.Resource{}
+
+	// Mark resources to be retained before deleting anything, so that an
+	// error does not leave a half deleted cluster behind.
+	infraTypes, elbTypes := retainResourceTypes(retain)
+	res, err := c.retainStackResources(makeClusterInfraStackName(name), infraTypes)
+	if err != nil {
+		return retained, err
+	}
+	retained = append(retained, res...)
+	res, err = c.retainStackResources(makeELBStackName(name), elbTypes)
+	if err != nil {
+		return retained, err
+	}
+	retained = append(retained, res...)
+
 	c.Logger.Printf("deleting compute pools that belong to cluster %q", name)
 	if err := c.DeleteComputePool(name, ""); err != nil {
-		return err
+		return retained, err
 	}
 
 	c.Logger.Printf("deleting master pool that belongs to cluster %q", name)
 	if err := c.DeleteMasterPool(name); err != nil {
-		return err
+		return retained, err
 	}
 
 	c.Logger.Printf("deleting ELB stack that belongs to cluster %q", name)
 	if err := c.deleteStack(makeELBStackName(name)); err != nil {
-		return err
+		return retained, err
 	}
 
 	assets := []string{
@@ -242,16 +344,33 @@ func (c *Cloud) DeleteCluster(name string) error {
 
 	bucketName, err := c.getAssetsBucketName(name)
 	if err != nil {
-		return err
+		return retained, err
 	}
 	if err := c.deleteS3Objects(bucketName, assets); err != nil {
-		return err
+		return retained, err
 	}
 
 	if err := c.deleteStack(makeClusterInfraStackName(name)); err != nil {
-		return err
+		return retained, err
 	}
-	return nil
+	return retained, nil
+}
+
+// retainResourceTypes maps kinds of resources to retain to cloudformation
+// resource types of the cluster infra and ELB stacks respectively.
+func retainResourceTypes(retain []string) (infra []string, elb []string) {
+	for _, r := range retain {
+		switch r {
+		case constants.RetainVolumes:
+			infra = append(infra, "AWS::EC2::Volume")
+		case constants.RetainDNS:
+			elb = append(elb, "AWS::Route53::RecordSetGroup")
+		case constants.RetainLB:
+			// The ELB security group cannot be deleted while the ELB exists.
+			elb = append(elb, "AWS::ElasticLoadBalancing::LoadBalancer", "AWS::EC2::SecurityGroup")
+		}
+	}
+	return infra, elb
 }
 
 func (c Cloud) deleteS3Objects(b string, keys []string) error {
@@ -284,6 +403,7 @@ func (c Cloud) getS3Object(bucket, objectName string) ([]byte, error) {
 	if err != nil {
 		return []byte{}, err
 	}
+	defer resp.Body.Close()
 
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -536,9 +656,13 @@ outer:
 				}
 				p.DiskSize = i
 			}
+			if *o.OutputKey == volumeTypeOutputKey {
+				p.VolumeType = *o.OutputValue
+			}
 		}
 
 		p.Labels = getStackLabels(s)
+		p.ExtraArgs = kubeargs.FromKubeArgs(getStackKubeArgs(s.Outputs))
 		pools = append(pools, p)
 	}
 	return pools, nil
@@ -587,9 +711,16 @@ outer:
 				}
 				p.DiskSize = i
 			}
+			if *o.OutputKey == volumeTypeOutputKey {
+				p.VolumeType = *o.OutputValue
+			}
+			if *o.OutputKey == spotPriceOutputKey {
+				p.SpotPrice = *o.OutputValue
+			}
 		}
 
 		p.Labels = getStackLabels(s)
+		p.ExtraArgs = kubeargs.FromKubeArgs(getStackKubeArgs(s.Outputs))
 		pools = append(pools, p)
 	}
 	return pools, nil
@@ -694,8 +825,29 @@ func (c Cloud) getClusterVpcID(name string) (string, error) {
 	return "", nil
 }
 
+// ValidateNodePool checks that the node pool AMI and subnets exist. EC2 has
+// no API to look up instance types, so machine types are not checked.
+func (c *Cloud) ValidateNodePool(p model.NodePool) error {
+	if _, err := c.getAMIByName(p.CoreOSVersion); err != nil {
+		return err
+	}
+	if len(p.Networks) == 0 {
+		return nil
+	}
+	_, err := c.describeSubnets(p.Networks)
+	return err
+}
+
 // describeSubnets returns a slice of subnet structs as well as an error value.
+// Subnet lookups are cached as subnets never move to another VPC or
+// availability zone.
 func (c *Cloud) describeSubnets(subnetIDs []string) ([]*ec2.Subnet, error) {
+	subnets := []*ec2.Subnet{}
+	key := fmt.Sprintf("%s/%s/subnets/%s", ProviderName, c.region, strings.Join(subnetIDs, ","))
+	if cloudprovider.GetCached(c.cache, c.Logger, key, &subnets) {
+		return subnets, nil
+	}
+
 	// AWS expects pointers instead of string values, got to convert each value.
 	sp := []*string{}
 	for _, s := range subnetIDs {
@@ -703,7 +855,6 @@ func (c *Cloud) describeSubnets(subnetIDs []string) ([]*ec2.Subnet, error) {
 	}
 
 	c.Logger.Printf("describing a list of subnets %v", subnetIDs)
-	subnets := []*ec2.Subnet{}
 	resp, err := c.ec2.DescribeSubnets(&ec2.DescribeSubnetsInput{SubnetIds: sp})
 	if err != nil {
 		return subnets, err
@@ -711,12 +862,20 @@ func (c *Cloud) describeSubnets(subnetIDs []string) ([]*ec2.Subnet, error) {
 
 	subnets = append(subnets, resp.Subnets...)
 	c.Logger.Printf("received subnets description: %+v", subnets)
+	cloudprovider.SetCached(c.cache, c.Logger, key, subnets)
 
 	return subnets, nil
 }
 
-// getAMIByName returns AMI ID for a given AMI name.
+// getAMIByName returns AMI ID for a given AMI name. Image lookups are cached
+// as images are immutable once published.
 func (c *Cloud) getAMIByName(name string) (string, error) {
+	key := fmt.Sprintf("%s/%s/images/%s", ProviderName, c.region, name)
+	var amiID string
+	if cloudprovider.GetCached(c.cache, c.Logger, key, &amiID) {
+		return amiID, nil
+	}
+
 	params := &ec2.DescribeImagesInput{
 		Owners: []*string{aws.String(coreOSAWSAccountID)},
 		Filters: []*ec2.Filter{
@@ -730,7 +889,9 @@ func (c *Cloud) getAMIByName(name string) (string, error) {
 		return "", err
 	}
 	if len(resp.Images) > 0 {
-		return *resp.Images[0].ImageId, nil
+		amiID = *resp.Images[0].ImageId
+		cloudprovider.SetCached(c.cache, c.Logger, key, amiID)
+		return amiID, nil
 	}
 	return "", fmt.Errorf("image %q not found", name)
 }
@@ -771,7 +932,7 @@ func (c Cloud) getResourceTagValue(resourceID, key string) (string, error) {
 // init registers AWS cloud with the cloudprovider.
 func init() {
 	// f knows how to initialize the cloud
-	f := func(l cloudprovider.Logger) (cloudprovider.Interface, error) {
+	f := func(l cloudprovider.Logger, cfg cloudprovider.Config) (cloudprovider.Interface, error) {
 		sess := session.Must(session.NewSessionWithOptions(session.Options{
 			SharedConfigState:       session.SharedConfigEnable,
 			AssumeRoleTokenProvider: stscreds.StdinTokenProvider,
@@ -789,20 +950,85 @@ func init() {
 			sess.Config.Region = &r
 		}
 
-		return newCloud(sess, l)
+		return newCloud(sess, l, cfg)
 	}
 	cloudprovider.Register(ProviderName, f)
 }
 
 // newCloud creates a new instance of AWS Cloud given sess session.
-func newCloud(sess *session.Session, l cloudprovider.Logger) (*Cloud, error) {
+func newCloud(sess *session.Session, l cloudprovider.Logger, cfg cloudprovider.Config) (*Cloud, error) {
+	// Service clients copy session handlers, so the handler must be added
+	// before any client is created.
+	if cfg.RequestTimeout > 0 {
+		sess = sess.Copy()
+		sess.Handlers.Validate.PushFront(requestTimeoutHandler(cfg.RequestTimeout))
+	}
+
 	c := &Cloud{
-		Logger: l,
-		cf:     cloudformation.New(sess),
-		ec2:    ec2.New(sess),
-		elb:    elb.New(sess),
-		s3:     s3.New(sess),
-		r53:    route53.New(sess),
+		Logger:           l,
+		cache:            cfg.Cache,
+		region:           *sess.Config.Region,
+		operationTimeout: cfg.OperationTimeout,
+		as:               autoscaling.New(sess),
+		cf:               cloudformation.New(sess),
+		ec2:              ec2.New(sess),
+		elb:              elb.New(sess),
+		s3:               s3.New(sess),
+		r53:              route53.New(sess),
 	}
 	return c, nil
 }
+
+// requestTimeoutHandler returns a request handler that sets a deadline of
+// timeout on each AWS API request, so that hung API calls fail instead of
+// blocking forever. Streaming response bodies, e.g. of S3 objects, are read
+// after the request completes, so their deadline is canceled once they are
+// closed instead.
+func requestTimeoutHandler(timeout time.Duration) func(*request.Request) {
+	return func(r *request.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		r.SetContext(ctx)
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			if r.Error == nil && cancelOnClose(r.Data, cancel) {
+				return
+			}
+			cancel()
+		})
+	}
+}
+
+// readCloserType is the type of streaming API output payloads.
+var readCloserType = reflect.TypeOf((*io.ReadCloser)(nil)).Elem()
+
+// cancelOnClose makes streaming bodies of an API output call cancel once
+// they are closed. It returns false if the output has no streaming body.
+func cancelOnClose(output interface{}, cancel context.CancelFunc) bool {
+	v := reflect.ValueOf(output)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return false
+	}
+	streaming := false
+	v = v.Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if f.Type() != readCloserType || f.IsNil() || !f.CanSet() {
+			continue
+		}
+		body := &cancelingBody{ReadCloser: f.Interface().(io.ReadCloser), cancel: cancel}
+		f.Set(reflect.ValueOf(body))
+		streaming = true
+	}
+	return streaming
+}
+
+// cancelingBody is a response body that cancels its request context once it
+// is closed.
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
@@ -14,6 +14,7 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
+//go:generate mockery -dir $GOPATH/src/github.com/UKHomeOffice/keto/vendor/github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface -name=AutoScalingAPI
 //go:generate mockery -dir $GOPATH/src/github.com/UKHomeOffice/keto/vendor/github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface -name=CloudFormationAPI
 //go:generate mockery -dir $GOPATH/src/github.com/UKHomeOffice/keto/vendor/github.com/aws/aws-sdk-go/service/ec2/ec2iface -name=EC2API
 //go:generate mockery -dir $GOPATH/src/github.com/UKHomeOffice/keto/vendor/github.com/aws/aws-sdk-go/service/elb/elbiface -name=ELBAPI
@@ -22,20 +23,29 @@ limitations under the License.
 package aws
 
 import (
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/UKHomeOffice/keto/pkg/cache"
 	"github.com/UKHomeOffice/keto/pkg/cloudprovider/providers/aws/mocks"
 	"github.com/UKHomeOffice/keto/pkg/model"
 	"github.com/UKHomeOffice/keto/testutil"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudformation"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/s3"
 
 	"github.com/stretchr/testify/mock"
 )
@@ -208,6 +218,25 @@ func TestGetClusters(t *testing.T) {
 				},
 			},
 		},
+		{
+			StackName: aws.String("keto-foo-elb"),
+			Tags: []*cloudformation.Tag{
+				{
+					Key:   aws.String(managedByKetoTagKey),
+					Value: aws.String(managedByKetoTagValue),
+				},
+			},
+			Outputs: []*cloudformation.Output{
+				{
+					OutputKey:   aws.String(stackTypeOutputKey),
+					OutputValue: aws.String(elbStackType),
+				},
+				{
+					OutputKey:   aws.String(elbDNSOutputKey),
+					OutputValue: aws.String("Kube-Foo.example.com"),
+				},
+			},
+		},
 	}
 
 	mockCF.On("DescribeStacks", &cloudformation.DescribeStacksInput{}).Return(
@@ -226,6 +255,70 @@ func TestGetClusters(t *testing.T) {
 	if !res[0].Internal {
 		t.Errorf("failed to read cluster Internal flag, got %v; want %v", res[0].Internal, true)
 	}
+	if want := "https://kube-foo.example.com"; res[0].KubeAPIURL != want {
+		t.Errorf("got kube API URL %q; want %q", res[0].KubeAPIURL, want)
+	}
+
+	mockCF.AssertExpectations(t)
+}
+
+func TestGetComputePools(t *testing.T) {
+	mockCF := &mocks.CloudFormationAPI{}
+	c := &Cloud{
+		Logger: makeLogger(),
+		cf:     mockCF,
+	}
+
+	stacks := []*cloudformation.Stack{
+		{
+			StackName: aws.String("keto-foo-compute"),
+			Tags: []*cloudformation.Tag{
+				{
+					Key:   aws.String(managedByKetoTagKey),
+					Value: aws.String(managedByKetoTagValue),
+				},
+			},
+			Outputs: []*cloudformation.Output{
+				{
+					OutputKey:   aws.String(stackTypeOutputKey),
+					OutputValue: aws.String(computePoolStackType),
+				},
+				{
+					OutputKey:   aws.String(clusterNameOutputKey),
+					OutputValue: aws.String("foo"),
+				},
+				{
+					OutputKey:   aws.String(poolNameOutputKey),
+					OutputValue: aws.String("compute"),
+				},
+				{
+					OutputKey:   aws.String(volumeTypeOutputKey),
+					OutputValue: aws.String("standard"),
+				},
+				{
+					OutputKey:   aws.String(spotPriceOutputKey),
+					OutputValue: aws.String("0.05"),
+				},
+			},
+		},
+	}
+
+	mockCF.On("DescribeStacks", &cloudformation.DescribeStacksInput{}).Return(
+		&cloudformation.DescribeStacksOutput{Stacks: stacks}, nil)
+
+	res, err := c.GetComputePools("foo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 {
+		t.Fatalf("should have received one result, but got %d instead", len(res))
+	}
+	if res[0].VolumeType != "standard" {
+		t.Errorf("got volume type %q; want %q", res[0].VolumeType, "standard")
+	}
+	if res[0].SpotPrice != "0.05" {
+		t.Errorf("got spot price %q; want %q", res[0].SpotPrice, "0.05")
+	}
 
 	mockCF.AssertExpectations(t)
 }
@@ -418,6 +511,42 @@ func TestCreateMasterPool(t *testing.T) {
 	mockEC2.AssertExpectations(t)
 }
 
+func TestValidateNodePoolCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keto-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mockEC2 := &mocks.EC2API{}
+	c := &Cloud{
+		Logger: makeLogger(),
+		ec2:    mockEC2,
+		cache:  cache.New(dir, time.Hour),
+		region: "eu-west-1",
+	}
+
+	p := testutil.MakeNodePool("foo", "compute")
+	p.Networks = []string{"subnet0"}
+
+	mockEC2.On("DescribeImages", mock.AnythingOfType("*ec2.DescribeImagesInput")).Return(&ec2.DescribeImagesOutput{
+		Images: []*ec2.Image{{ImageId: aws.String("ami123")}},
+	}, nil).Once()
+	mockEC2.On("DescribeSubnets", &ec2.DescribeSubnetsInput{
+		SubnetIds: []*string{aws.String("subnet0")},
+	}).Return(&ec2.DescribeSubnetsOutput{
+		Subnets: []*ec2.Subnet{{SubnetId: aws.String("subnet0"), VpcId: aws.String("vpc0")}},
+	}, nil).Once()
+
+	// The second validation is served from the cache.
+	for i := 0; i < 2; i++ {
+		if err := c.ValidateNodePool(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mockEC2.AssertExpectations(t)
+}
+
 func TestGetKubeAPIURL(t *testing.T) {
 	mockCF := &mocks.CloudFormationAPI{}
 	c := &Cloud{
@@ -455,3 +584,62 @@ func TestGetKubeAPIURL(t *testing.T) {
 
 	mockCF.AssertExpectations(t)
 }
+
+func TestRequestTimeoutHandler(t *testing.T) {
+	r := &request.Request{HTTPRequest: &http.Request{}}
+	requestTimeoutHandler(time.Minute)(r)
+
+	deadline, ok := r.Context().Deadline()
+	if !ok {
+		t.Fatal("request context has no deadline")
+	}
+	if d := time.Until(deadline); d <= 0 || d > time.Minute {
+		t.Errorf("got deadline in %s; want within %s", d, time.Minute)
+	}
+
+	r.Handlers.Complete.Run(r)
+	if r.Context().Err() == nil {
+		t.Error("request context is not canceled on completion")
+	}
+}
+
+func TestRequestTimeoutHandlerStreaming(t *testing.T) {
+	// The rest of the body is only sent once the request has completed.
+	completed := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("foo"))
+		w.(http.Flusher).Flush()
+		<-completed
+		w.Write([]byte("bar"))
+	}))
+	defer srv.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		Endpoint:         aws.String(srv.URL),
+		Region:           aws.String("eu-west-2"),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+	sess.Handlers.Validate.PushFront(requestTimeoutHandler(time.Minute))
+
+	req, resp := s3.New(sess).GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String("foo"), Key: aws.String("bar")})
+	if err := req.Send(); err != nil {
+		close(completed)
+		t.Fatal(err)
+	}
+	close(completed)
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read the response body: %v", err)
+	}
+	if string(b) != "foobar" {
+		t.Errorf("got response body %q; want %q", b, "foobar")
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Error(err)
+	}
+	if req.Context().Err() == nil {
+		t.Error("request context is not canceled once the response body is closed")
+	}
+}
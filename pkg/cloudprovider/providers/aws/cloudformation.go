@@ -18,6 +18,7 @@ package aws
 
 import (
 	"fmt"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
@@ -44,10 +45,19 @@ const (
 	kubeAPIURLOutputKey       = "KubeAPIURL"
 	machineTypeOutputKey      = "MachineType"
 	diskSizeOutputKey         = "DiskSize"
+	volumeTypeOutputKey       = "VolumeType"
+	spotPriceOutputKey        = "SpotPrice"
 	assetsBucketNameOutputKey = "AssetsBucketName"
 	internalClusterOutputKey  = "InternalCluster"
+	driftPolicyOutputKey      = "DriftPolicy"
 	labelsOutputKey           = "Labels"
 	elbDNSOutputKey           = "ELBDNS"
+	dnsConfigOutputKey        = "DNSConfig"
+
+	kubeletExtraArgsOutputKey           = "KubeletExtraArgs"
+	apiServerExtraArgsOutputKey         = "APIServerExtraArgs"
+	controllerManagerExtraArgsOutputKey = "ControllerManagerExtraArgs"
+	schedulerExtraArgsOutputKey         = "SchedulerExtraArgs"
 
 	clusterInfraStackType = "infra"
 	elbStackType          = "elb"
@@ -58,6 +68,19 @@ const (
 	stackStatusInProgressSuffix = "IN_PROGRESS"
 	stackStatusFailedSuffix     = "FAILED"
 	stackStatusRollback         = "ROLLBACK"
+
+	retainDeletionPolicy = "    DeletionPolicy: Retain"
+)
+
+var (
+	// stackPollInterval is how often stack status is checked while waiting
+	// for a stack operation to complete.
+	stackPollInterval = 5 * time.Second
+
+	// Regexps matching a resource logical ID and its type in stack templates
+	// rendered by keto.
+	templateResourceRegexp = regexp.MustCompile(`^  (\w+):\s*$`)
+	templateTypeRegexp     = regexp.MustCompile(`^    Type: "?([\w:]+)"?\s*$`)
 )
 
 // stackExists returns true if a given stack name exists and is managed by keto.
@@ -93,6 +116,34 @@ func getStackLabels(s *cloudformation.Stack) model.Labels {
 	return labels
 }
 
+// kubeArgsOutputKeys holds stack output key names of Kubernetes components
+// extra args.
+var kubeArgsOutputKeys = model.KubeArgs{
+	KubeletExtraArgs:           kubeletExtraArgsOutputKey,
+	APIServerExtraArgs:         apiServerExtraArgsOutputKey,
+	ControllerManagerExtraArgs: controllerManagerExtraArgsOutputKey,
+	SchedulerExtraArgs:         schedulerExtraArgsOutputKey,
+}
+
+// getStackKubeArgs returns a model.KubeArgs given cloudformation stack
+// outputs. Outputs are only set for components that have extra args.
+func getStackKubeArgs(outputs []*cloudformation.Output) model.KubeArgs {
+	var a model.KubeArgs
+	for _, o := range outputs {
+		switch *o.OutputKey {
+		case kubeletExtraArgsOutputKey:
+			a.KubeletExtraArgs = *o.OutputValue
+		case apiServerExtraArgsOutputKey:
+			a.APIServerExtraArgs = *o.OutputValue
+		case controllerManagerExtraArgsOutputKey:
+			a.ControllerManagerExtraArgs = *o.OutputValue
+		case schedulerExtraArgsOutputKey:
+			a.SchedulerExtraArgs = *o.OutputValue
+		}
+	}
+	return a
+}
+
 // getStacksByType returns a list of stacks by type, also checks if they are
 // managed by keto. An error is returned as well, if any.
 func (c *Cloud) getStacksByType(t string) ([]*cloudformation.Stack, error) {
@@ -371,6 +422,97 @@ func makeStackTags(m map[string]string) []*cloudformation.Tag {
 	return tags
 }
 
+// retainStackResources updates a given stack name, so that its resources of
+// given resource types are retained when the stack is deleted. Retained
+// resources are returned.
+func (c *Cloud) retainStackResources(name string, resourceTypes []string) ([]*model.Resource, error) {
+	retained := []*model.Resource{}
+	if len(resourceTypes) == 0 {
+		return retained, nil
+	}
+
+	resp, err := c.cf.GetTemplate(&cloudformation.GetTemplateInput{StackName: aws.String(name)})
+	if err != nil {
+		return retained, err
+	}
+
+	templateBody, logicalIDs := markResourcesRetained(aws.StringValue(resp.TemplateBody), resourceTypes)
+	if len(logicalIDs) == 0 {
+		c.Logger.Printf("no resources of types %v to retain in stack %q", resourceTypes, name)
+		return retained, nil
+	}
+
+	// Resources are already marked if a previous deletion failed, and
+	// cloudformation rejects an update that does not change the template.
+	if templateBody == aws.StringValue(resp.TemplateBody) {
+		c.Logger.Printf("resources %v of stack %q are already retained", logicalIDs, name)
+	} else {
+		c.Logger.Printf("marking resources %v of stack %q to be retained", logicalIDs, name)
+		if err := c.updateStack(&cloudformation.UpdateStackInput{
+			StackName:    aws.String(name),
+			TemplateBody: aws.String(templateBody),
+		}); err != nil {
+			return retained, err
+		}
+	}
+
+	res, err := c.getStackResources(name)
+	if err != nil {
+		return retained, err
+	}
+	for _, r := range res {
+		if stringInSlice(*r.LogicalResourceId, logicalIDs) {
+			retained = append(retained, &model.Resource{
+				Type: *r.ResourceType,
+				ID:   aws.StringValue(r.PhysicalResourceId),
+			})
+		}
+	}
+	return retained, nil
+}
+
+// markResourcesRetained adds a Retain deletion policy to resources of given
+// resource types in a stack template rendered by keto. A metadata change is
+// added as well, because cloudformation does not treat a deletion policy
+// change on its own as an update. Returns the updated template and logical
+// IDs of marked resources.
+func markResourcesRetained(templateBody string, resourceTypes []string) (string, []string) {
+	logicalIDs := []string{}
+	lines := strings.Split(templateBody, "\n")
+	out := []string{}
+
+	resource := ""
+	for i, l := range lines {
+		out = append(out, l)
+		if m := templateResourceRegexp.FindStringSubmatch(l); m != nil {
+			resource = m[1]
+			continue
+		}
+		m := templateTypeRegexp.FindStringSubmatch(l)
+		if m == nil || resource == "" || !stringInSlice(m[1], resourceTypes) {
+			continue
+		}
+		logicalIDs = append(logicalIDs, resource)
+		resource = ""
+		// Resource may have been marked by a previous failed deletion.
+		if i+1 < len(lines) && lines[i+1] == retainDeletionPolicy {
+			continue
+		}
+		out = append(out, retainDeletionPolicy, "    Metadata:", "      RetainedBy: keto")
+	}
+	return strings.Join(out, "\n"), logicalIDs
+}
+
+// stringInSlice returns true if s is in list.
+func stringInSlice(s string, list []string) bool {
+	for _, i := range list {
+		if s == i {
+			return true
+		}
+	}
+	return false
+}
+
 // createStack creates a new stack and waits for completion. If stack creation
 // fails, an error is returned.
 func (c *Cloud) createStack(in *cloudformation.CreateStackInput) error {
@@ -390,6 +532,24 @@ func (c *Cloud) createStack(in *cloudformation.CreateStackInput) error {
 	return c.waitForStackOperationCompletion(*resp.StackId)
 }
 
+// updateStack updates a stack and waits for completion. If stack update
+// fails, an error is returned.
+func (c *Cloud) updateStack(in *cloudformation.UpdateStackInput) error {
+	if err := c.validateStackTemplate(in.TemplateBody); err != nil {
+		return err
+	}
+
+	resp, err := c.cf.UpdateStack(in)
+	if err != nil {
+		return err
+	}
+	if resp.StackId == nil {
+		return fmt.Errorf("failed to update %q stack, stack id is nil in response", *in.StackName)
+	}
+
+	return c.waitForStackOperationCompletion(*resp.StackId)
+}
+
 func (c *Cloud) validateStackTemplate(tpl *string) error {
 	params := &cloudformation.ValidateTemplateInput{
 		TemplateBody: tpl,
@@ -410,10 +570,19 @@ func (c Cloud) deleteStack(name string) error {
 }
 
 // waitForStackOperationCompletion returns an error if a stack
-// create/update/delete operation fails. Rollback status also returns an error
-// to indicate a failure. Otherwise an error returned is nil.
+// create/update/delete operation fails or does not complete within the
+// operation timeout. Rollback status also returns an error to indicate a
+// failure. Otherwise an error returned is nil.
 func (c *Cloud) waitForStackOperationCompletion(id string) error {
+	var deadline time.Time
+	if c.operationTimeout > 0 {
+		deadline = time.Now().Add(c.operationTimeout)
+	}
+
 	for {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for stack %q operation to complete", c.operationTimeout, id)
+		}
 		s, err := c.getStack(id)
 		if s.StackId == nil {
 			return nil
@@ -434,6 +603,6 @@ func (c *Cloud) waitForStackOperationCompletion(id string) error {
 		case strings.HasSuffix(*s.StackStatus, stackStatusCompleteSuffix):
 			return nil
 		}
-		time.Sleep(5 * time.Second)
+		time.Sleep(stackPollInterval)
 	}
 }
@@ -19,11 +19,13 @@ package aws
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"sort"
 	"strings"
 	"text/template"
 
 	"github.com/UKHomeOffice/keto/pkg/keto/util"
+	"github.com/UKHomeOffice/keto/pkg/kubeargs"
 	"github.com/UKHomeOffice/keto/pkg/model"
 )
 
@@ -192,6 +194,14 @@ Outputs:
   {{ .InternalClusterOutputKey }}:
     Value: "{{ .Cluster.Internal }}"
 
+  {{ .DriftPolicyOutputKey }}:
+    Value: "{{ .Cluster.DriftPolicy }}"
+{{- with .DNSConfig }}
+
+  {{ $.DNSConfigOutputKey }}:
+    Value: "{{ . }}"
+{{- end }}
+
   {{ .StackTypeOutputKey }}:
     Value: {{ .StackType }}
 `
@@ -207,6 +217,9 @@ Outputs:
 		StackTypeOutputKey        string
 		StackType                 string
 		InternalClusterOutputKey  string
+		DriftPolicyOutputKey      string
+		DNSConfigOutputKey        string
+		DNSConfig                 string
 		AssetsBucketNameOutputKey string
 	}{
 		Cluster:                   c,
@@ -218,9 +231,20 @@ Outputs:
 		StackTypeOutputKey:        stackTypeOutputKey,
 		StackType:                 clusterInfraStackType,
 		InternalClusterOutputKey:  internalClusterOutputKey,
+		DriftPolicyOutputKey:      driftPolicyOutputKey,
+		DNSConfigOutputKey:        dnsConfigOutputKey,
 		AssetsBucketNameOutputKey: assetsBucketNameOutputKey,
 	}
 
+	// DNS config is stored as a base64 encoded JSON, as it is not flat.
+	dns, err := json.Marshal(c.DNS)
+	if err != nil {
+		return "", err
+	}
+	if string(dns) != "{}" {
+		data.DNSConfig = base64.StdEncoding.EncodeToString(dns)
+	}
+
 	t := template.Must(template.New("cluster-infra-stack").Parse(clusterInfraStackTemplate))
 	var b bytes.Buffer
 	if err := t.Execute(&b, data); err != nil {
@@ -487,7 +511,7 @@ Resources:
           Ebs:
             VolumeSize: "{{ $masterPool.DiskSize }}"
             DeleteOnTermination: true
-            VolumeType: "gp2"
+            VolumeType: "{{ $masterPool.VolumeType }}"
       UserData: {{ $userData }}
 {{ end -}}
 
@@ -516,8 +540,31 @@ Outputs:
   {{ .DiskSizeOutputKey }}:
     Value: "{{ .MasterPool.DiskSize }}"
 
+  {{ .VolumeTypeOutputKey }}:
+    Value: "{{ .MasterPool.VolumeType }}"
+
   {{ .LabelsOutputKey }}:
     Value: "{{ .Labels }}"
+{{- with .KubeArgs.KubeletExtraArgs }}
+
+  {{ $.KubeArgsOutputKeys.KubeletExtraArgs }}:
+    Value: "{{ . }}"
+{{- end }}
+{{- with .KubeArgs.APIServerExtraArgs }}
+
+  {{ $.KubeArgsOutputKeys.APIServerExtraArgs }}:
+    Value: "{{ . }}"
+{{- end }}
+{{- with .KubeArgs.ControllerManagerExtraArgs }}
+
+  {{ $.KubeArgsOutputKeys.ControllerManagerExtraArgs }}:
+    Value: "{{ . }}"
+{{- end }}
+{{- with .KubeArgs.SchedulerExtraArgs }}
+
+  {{ $.KubeArgsOutputKeys.SchedulerExtraArgs }}:
+    Value: "{{ . }}"
+{{- end }}
 
   {{ .InternalClusterOutputKey }}:
     Value: "{{ .MasterPool.Internal }}"
@@ -529,6 +576,9 @@ Outputs:
 
 	// Make sure networks are always in the same order.
 	sort.Strings(p.Networks)
+	if p.VolumeType == "" {
+		p.VolumeType = volumeTypes[0]
+	}
 
 	data := struct {
 		MasterPool                model.MasterPool
@@ -541,6 +591,8 @@ Outputs:
 		KubeAPIURL                string
 		LabelsOutputKey           string
 		Labels                    string
+		KubeArgsOutputKeys        model.KubeArgs
+		KubeArgs                  model.KubeArgs
 		ClusterNameOutputKey      string
 		PoolNameOutputKey         string
 		CoreOSVersionOutputKey    string
@@ -553,6 +605,7 @@ Outputs:
 		MachineTypeOutputKey      string
 		KubeVersionOutputKey      string
 		DiskSizeOutputKey         string
+		VolumeTypeOutputKey       string
 	}{
 		MasterPool:                p,
 		ClusterInfraStackName:     makeClusterInfraStackName(p.ClusterName),
@@ -564,6 +617,8 @@ Outputs:
 		KubeAPIURL:                kubeAPIURL,
 		LabelsOutputKey:           labelsOutputKey,
 		Labels:                    util.LabelsToKVs(p.Labels),
+		KubeArgsOutputKeys:        kubeArgsOutputKeys,
+		KubeArgs:                  kubeargs.ToKubeArgs(p.ExtraArgs),
 		ClusterNameOutputKey:      clusterNameOutputKey,
 		CoreOSVersionOutputKey:    coreOSVersionOutputKey,
 		PoolNameOutputKey:         poolNameOutputKey,
@@ -576,6 +631,7 @@ Outputs:
 		MachineTypeOutputKey:      machineTypeOutputKey,
 		KubeVersionOutputKey:      kubeVersionOutputKey,
 		DiskSizeOutputKey:         diskSizeOutputKey,
+		VolumeTypeOutputKey:       volumeTypeOutputKey,
 	}
 
 	funcMap := template.FuncMap{
@@ -657,7 +713,7 @@ Resources:
       TerminationPolicies:
         - 'OldestInstance'
         - 'Default'
-      MaxSize: 100
+      MaxSize: {{ .MaxSize }}
       MinSize: {{ .ComputePool.Size }}
       Tags:
         - Key: Name
@@ -675,6 +731,9 @@ Resources:
       InstanceMonitoring: false
       InstanceType: "{{ .ComputePool.MachineType }}"
       KeyName: "{{ .ComputePool.SSHKey }}"
+{{- with .ComputePool.SpotPrice }}
+      SpotPrice: "{{ . }}"
+{{- end }}
       SecurityGroups:
         - !ImportValue "{{ .ClusterInfraStackName }}-ComputePoolSG"
       BlockDeviceMappings:
@@ -682,7 +741,7 @@ Resources:
           Ebs:
             VolumeSize: "{{ .ComputePool.DiskSize }}"
             DeleteOnTermination: true
-            VolumeType: "gp2"
+            VolumeType: "{{ .ComputePool.VolumeType }}"
       UserData: {{ .UserData }}
 
 Outputs:
@@ -707,8 +766,21 @@ Outputs:
   {{ .DiskSizeOutputKey }}:
     Value: "{{ .ComputePool.DiskSize }}"
 
+  {{ .VolumeTypeOutputKey }}:
+    Value: "{{ .ComputePool.VolumeType }}"
+{{- with .ComputePool.SpotPrice }}
+
+  {{ $.SpotPriceOutputKey }}:
+    Value: "{{ . }}"
+{{- end }}
+
   {{ .LabelsOutputKey }}:
     Value: "{{ .Labels }}"
+{{- with .KubeArgs.KubeletExtraArgs }}
+
+  {{ $.KubeArgsOutputKeys.KubeletExtraArgs }}:
+    Value: "{{ . }}"
+{{- end }}
 
   {{ .InternalClusterOutputKey }}:
     Value: "{{ .ComputePool.Internal }}"
@@ -720,6 +792,9 @@ Outputs:
 
 	// Make sure networks are always in the same order.
 	sort.Strings(p.Networks)
+	if p.VolumeType == "" {
+		p.VolumeType = volumeTypes[0]
+	}
 
 	data := struct {
 		ComputePool              model.ComputePool
@@ -730,6 +805,8 @@ Outputs:
 		KubeAPIURL               string
 		LabelsOutputKey          string
 		Labels                   string
+		KubeArgsOutputKeys       model.KubeArgs
+		KubeArgs                 model.KubeArgs
 		ClusterNameOutputKey     string
 		PoolNameOutputKey        string
 		CoreOSVersionOutputKey   string
@@ -740,6 +817,9 @@ Outputs:
 		MachineTypeOutputKey     string
 		KubeVersionOutputKey     string
 		DiskSizeOutputKey        string
+		VolumeTypeOutputKey      string
+		SpotPriceOutputKey       string
+		MaxSize                  int
 	}{
 		ComputePool:              p,
 		ClusterInfraStackName:    makeClusterInfraStackName(p.ClusterName),
@@ -749,6 +829,8 @@ Outputs:
 		KubeAPIURL:               kubeAPIURL,
 		LabelsOutputKey:          labelsOutputKey,
 		Labels:                   util.LabelsToKVs(p.Labels),
+		KubeArgsOutputKeys:       kubeArgsOutputKeys,
+		KubeArgs:                 kubeargs.ToKubeArgs(p.ExtraArgs),
 		ClusterNameOutputKey:     clusterNameOutputKey,
 		CoreOSVersionOutputKey:   coreOSVersionOutputKey,
 		PoolNameOutputKey:        poolNameOutputKey,
@@ -759,6 +841,9 @@ Outputs:
 		MachineTypeOutputKey:     machineTypeOutputKey,
 		KubeVersionOutputKey:     kubeVersionOutputKey,
 		DiskSizeOutputKey:        diskSizeOutputKey,
+		VolumeTypeOutputKey:      volumeTypeOutputKey,
+		SpotPriceOutputKey:       spotPriceOutputKey,
+		MaxSize:                  computePoolMaxSize,
 	}
 
 	t := template.Must(template.New("compute-stack").Parse(computeStackTemplate))
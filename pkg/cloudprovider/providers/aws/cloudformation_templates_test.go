@@ -18,6 +18,8 @@ package aws
 
 import (
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/UKHomeOffice/keto/pkg/model"
@@ -50,6 +52,8 @@ func TestRenderClusterInfraStackTemplate(t *testing.T) {
 			Name:     "foo",
 			Internal: false,
 		},
+		DriftPolicy: "correct",
+		DNS:         model.DNSConfig{Provider: "kube-dns", UpstreamNameservers: []string{"8.8.8.8"}},
 	}
 
 	s, err := renderClusterInfraStackTemplate(cluster, vpc, networks)
@@ -57,6 +61,22 @@ func TestRenderClusterInfraStackTemplate(t *testing.T) {
 		t.Error(err)
 	}
 	testutil.CheckTemplate(t, s, vpc)
+	testutil.CheckTemplate(t, s, `Value: "correct"`)
+
+	// DNS config can be read back from the stack output.
+	prefix := "  " + dnsConfigOutputKey + ":\n    Value: \""
+	i := strings.Index(s, prefix)
+	if i == -1 {
+		t.Fatalf("%s output not found", dnsConfigOutputKey)
+	}
+	v := s[i+len(prefix):]
+	dns, err := decodeDNSConfig(v[:strings.Index(v, "\"")])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dns, cluster.DNS) {
+		t.Errorf("got DNS config %+v; want %+v", dns, cluster.DNS)
+	}
 }
 
 func TestRenderELBStackTemplate(t *testing.T) {
@@ -95,13 +115,16 @@ func TestRenderMasterStackTemplate(t *testing.T) {
 		t.Error(err)
 	}
 	testutil.CheckTemplate(t, s, ami)
+	if want := "  " + volumeTypeOutputKey + ":\n    Value: \"gp2\""; !strings.Contains(s, want) {
+		t.Errorf("master stack template does not contain %q", want)
+	}
 }
 
 func TestRenderComputeStackTemplate(t *testing.T) {
 	pool := model.ComputePool{
 		NodePool: model.NodePool{
 			ResourceMeta: model.ResourceMeta{ClusterName: "foo"},
-			NodePoolSpec: model.NodePoolSpec{Networks: []string{"network0", "network1"}},
+			NodePoolSpec: model.NodePoolSpec{Networks: []string{"network0", "network1"}, SpotPrice: "0.05"},
 		},
 	}
 
@@ -110,6 +133,16 @@ func TestRenderComputeStackTemplate(t *testing.T) {
 		t.Error(err)
 	}
 	testutil.CheckTemplate(t, s, ami)
+	for _, want := range []string{
+		`SpotPrice: "0.05"`,
+		`VolumeType: "gp2"`,
+		"  " + spotPriceOutputKey + ":\n    Value: \"0.05\"",
+		"  " + volumeTypeOutputKey + ":\n    Value: \"gp2\"",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("compute stack template does not contain %q", want)
+		}
+	}
 }
 
 func TestGetNodesDistribution(t *testing.T) {
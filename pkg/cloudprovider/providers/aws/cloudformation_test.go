@@ -2,14 +2,19 @@ package aws
 
 import (
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/UKHomeOffice/keto/pkg/cloudprovider/providers/aws/mocks"
 	"github.com/UKHomeOffice/keto/pkg/model"
+	"github.com/UKHomeOffice/keto/testutil"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/cloudformation"
+
+	"github.com/stretchr/testify/mock"
 )
 
 func TestDescribeStacks(t *testing.T) {
@@ -131,3 +136,115 @@ func TestGetStackLabels(t *testing.T) {
 		})
 	}
 }
+
+func TestMarkResourcesRetained(t *testing.T) {
+	const tpl = `---
+Resources:
+  ELBSG:
+    Type: "AWS::EC2::SecurityGroup"
+    Properties:
+      VpcId: vpc0
+
+  ELB:
+    Type: AWS::ElasticLoadBalancing::LoadBalancer
+    Properties:
+      CrossZone: true
+
+  ELBDNS:
+    Type: AWS::Route53::RecordSetGroup
+    Properties:
+      RecordSets:
+        - Name: kube-foo.local
+          Type: A
+
+Outputs:
+  ELB:
+    Value: !Ref ELB
+`
+
+	got, ids := markResourcesRetained(tpl, []string{"AWS::Route53::RecordSetGroup", "AWS::EC2::SecurityGroup"})
+	if !reflect.DeepEqual(ids, []string{"ELBSG", "ELBDNS"}) {
+		t.Errorf("got marked resources %v; want %v", ids, []string{"ELBSG", "ELBDNS"})
+	}
+	if n := strings.Count(got, retainDeletionPolicy); n != 2 {
+		t.Errorf("got %d deletion policies; want %d", n, 2)
+	}
+	testutil.CheckTemplate(t, got, "Type: AWS::Route53::RecordSetGroup\n"+retainDeletionPolicy)
+
+	// Marking resources again must not add duplicate deletion policies.
+	again, _ := markResourcesRetained(got, []string{"AWS::Route53::RecordSetGroup", "AWS::EC2::SecurityGroup"})
+	if again != got {
+		t.Errorf("template changed after marking resources twice:\n%s", again)
+	}
+}
+
+func TestRetainStackResourcesRetry(t *testing.T) {
+	mockCF := &mocks.CloudFormationAPI{}
+	c := &Cloud{
+		Logger: makeLogger(),
+		cf:     mockCF,
+	}
+
+	// A template marked by a previous, failed deletion.
+	tpl, _ := markResourcesRetained(`---
+Resources:
+  ELBDNS:
+    Type: AWS::Route53::RecordSetGroup
+    Properties:
+      RecordSets:
+        - Name: kube-foo.local
+          Type: A
+`, []string{"AWS::Route53::RecordSetGroup"})
+
+	mockCF.On("GetTemplate", &cloudformation.GetTemplateInput{StackName: aws.String("foo")}).Return(
+		&cloudformation.GetTemplateOutput{TemplateBody: aws.String(tpl)}, nil)
+	mockCF.On("DescribeStackResources", &cloudformation.DescribeStackResourcesInput{StackName: aws.String("foo")}).Return(
+		&cloudformation.DescribeStackResourcesOutput{
+			StackResources: []*cloudformation.StackResource{
+				{
+					LogicalResourceId:  aws.String("ELBDNS"),
+					PhysicalResourceId: aws.String("kube-foo.local"),
+					ResourceType:       aws.String("AWS::Route53::RecordSetGroup"),
+				},
+			},
+		}, nil)
+
+	retained, err := c.retainStackResources("foo", []string{"AWS::Route53::RecordSetGroup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*model.Resource{{Type: "AWS::Route53::RecordSetGroup", ID: "kube-foo.local"}}
+	if !reflect.DeepEqual(retained, want) {
+		t.Errorf("got retained resources %v; want %v", retained, want)
+	}
+
+	// An unchanged template must not be sent as a stack update.
+	mockCF.AssertNotCalled(t, "UpdateStack", mock.Anything)
+	mockCF.AssertExpectations(t)
+}
+
+func TestWaitForStackOperationCompletionTimeout(t *testing.T) {
+	mockCF := &mocks.CloudFormationAPI{}
+	c := &Cloud{
+		Logger:           makeLogger(),
+		cf:               mockCF,
+		operationTimeout: 10 * time.Millisecond,
+	}
+
+	defer func(d time.Duration) { stackPollInterval = d }(stackPollInterval)
+	stackPollInterval = time.Millisecond
+
+	mockCF.On("DescribeStacks", &cloudformation.DescribeStacksInput{StackName: aws.String("foo-id")}).Return(
+		&cloudformation.DescribeStacksOutput{
+			Stacks: []*cloudformation.Stack{
+				{
+					StackId:     aws.String("foo-id"),
+					StackStatus: aws.String(cloudformation.StackStatusCreateInProgress),
+				},
+			},
+		}, nil)
+
+	if err := c.waitForStackOperationCompletion("foo-id"); err == nil {
+		t.Error("expected a timeout error, got nil")
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"fmt"
+
+	"github.com/UKHomeOffice/keto/pkg/cloudprovider"
+	"github.com/UKHomeOffice/keto/pkg/model"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// Drift returns an implementation of Drift interface for AWS Cloud.
+func (c *Cloud) Drift() (cloudprovider.Drift, bool) {
+	return c, true
+}
+
+// GetComputePoolDrift returns size changes of a given compute pool
+// autoscaling group that were not made by keto.
+func (c *Cloud) GetComputePoolDrift(p model.ComputePool) ([]string, error) {
+	drift := []string{}
+
+	groups, err := c.getComputePoolASGs(p.ClusterName, p.Name)
+	if err != nil {
+		return drift, err
+	}
+	for _, g := range groups {
+		name := aws.StringValue(g.AutoScalingGroupName)
+		if n := aws.Int64Value(g.MinSize); n != int64(p.Size) {
+			drift = append(drift, fmt.Sprintf("autoscaling group %q min size is %d, want %d", name, n, p.Size))
+		}
+		if n := aws.Int64Value(g.MaxSize); n != computePoolMaxSize {
+			drift = append(drift, fmt.Sprintf("autoscaling group %q max size is %d, want %d", name, n, computePoolMaxSize))
+		}
+		if n := aws.Int64Value(g.DesiredCapacity); n != int64(p.Size) {
+			drift = append(drift, fmt.Sprintf("autoscaling group %q desired capacity is %d, want %d", name, n, p.Size))
+		}
+	}
+	return drift, nil
+}
+
+// CorrectComputePoolDrift resizes a given compute pool autoscaling group back
+// to the pool size.
+func (c *Cloud) CorrectComputePoolDrift(p model.ComputePool) error {
+	groups, err := c.getComputePoolASGs(p.ClusterName, p.Name)
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		c.Logger.Printf("resizing autoscaling group %q to %d", aws.StringValue(g.AutoScalingGroupName), p.Size)
+		if _, err := c.as.UpdateAutoScalingGroup(&autoscaling.UpdateAutoScalingGroupInput{
+			AutoScalingGroupName: g.AutoScalingGroupName,
+			MinSize:              aws.Int64(int64(p.Size)),
+			MaxSize:              aws.Int64(computePoolMaxSize),
+			DesiredCapacity:      aws.Int64(int64(p.Size)),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getComputePoolASGs returns autoscaling groups of a given compute pool stack.
+func (c *Cloud) getComputePoolASGs(clusterName, name string) ([]*autoscaling.Group, error) {
+	groups := []*autoscaling.Group{}
+
+	res, err := c.getStackResources(makeComputePoolStackName(clusterName, name, ""))
+	if err != nil {
+		return groups, err
+	}
+	names := []*string{}
+	for _, r := range res {
+		if *r.ResourceType == asgResourceType && r.PhysicalResourceId != nil {
+			names = append(names, r.PhysicalResourceId)
+		}
+	}
+	if len(names) == 0 {
+		return groups, nil
+	}
+
+	err = c.as.DescribeAutoScalingGroupsPages(&autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: names,
+	}, func(page *autoscaling.DescribeAutoScalingGroupsOutput, lastPage bool) bool {
+		groups = append(groups, page.AutoScalingGroups...)
+		return true
+	})
+	return groups, err
+}
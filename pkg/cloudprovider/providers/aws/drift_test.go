@@ -0,0 +1,101 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/UKHomeOffice/keto/pkg/cloudprovider/providers/aws/mocks"
+	"github.com/UKHomeOffice/keto/pkg/model"
+	"github.com/UKHomeOffice/keto/testutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+
+	"github.com/stretchr/testify/mock"
+)
+
+func TestComputePoolDrift(t *testing.T) {
+	mockAS := &mocks.AutoScalingAPI{}
+	mockCF := &mocks.CloudFormationAPI{}
+	c := &Cloud{
+		Logger: makeLogger(),
+		as:     mockAS,
+		cf:     mockCF,
+	}
+
+	p := model.ComputePool{NodePool: testutil.MakeNodePool("foo", "compute")}
+	p.Size = 3
+	stackName := makeComputePoolStackName(p.ClusterName, p.Name, "")
+
+	mockCF.On("DescribeStackResources", &cloudformation.DescribeStackResourcesInput{StackName: aws.String(stackName)}).Return(
+		&cloudformation.DescribeStackResourcesOutput{
+			StackResources: []*cloudformation.StackResource{
+				{
+					ResourceType:       aws.String("AWS::AutoScaling::LaunchConfiguration"),
+					PhysicalResourceId: aws.String("lc-physical-id"),
+				},
+				{
+					ResourceType:       aws.String(asgResourceType),
+					PhysicalResourceId: aws.String("asg-physical-id"),
+				},
+			},
+		}, nil)
+
+	// The autoscaling group was resized manually.
+	mockAS.On("DescribeAutoScalingGroupsPages", &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: aws.StringSlice([]string{"asg-physical-id"}),
+	}, mock.AnythingOfType("func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool")).Run(func(args mock.Arguments) {
+		fn := args.Get(1).(func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool)
+		fn(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []*autoscaling.Group{
+				{
+					AutoScalingGroupName: aws.String("asg-physical-id"),
+					MinSize:              aws.Int64(1),
+					MaxSize:              aws.Int64(computePoolMaxSize),
+					DesiredCapacity:      aws.Int64(1),
+				},
+			},
+		}, true)
+	}).Return(nil)
+
+	drift, err := c.GetComputePoolDrift(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`autoscaling group "asg-physical-id" min size is 1, want 3`,
+		`autoscaling group "asg-physical-id" desired capacity is 1, want 3`,
+	}
+	if !reflect.DeepEqual(drift, want) {
+		t.Errorf("got drift %q; want %q", drift, want)
+	}
+
+	mockAS.On("UpdateAutoScalingGroup", &autoscaling.UpdateAutoScalingGroupInput{
+		AutoScalingGroupName: aws.String("asg-physical-id"),
+		MinSize:              aws.Int64(3),
+		MaxSize:              aws.Int64(computePoolMaxSize),
+		DesiredCapacity:      aws.Int64(3),
+	}).Return(&autoscaling.UpdateAutoScalingGroupOutput{}, nil)
+
+	if err := c.CorrectComputePoolDrift(p); err != nil {
+		t.Fatal(err)
+	}
+	mockAS.AssertExpectations(t)
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/UKHomeOffice/keto/pkg/cloudprovider"
+	"github.com/UKHomeOffice/keto/pkg/model"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+	// Event sources.
+	cloudFormationEventSource = "cloudformation"
+	autoScalingEventSource    = "autoscaling"
+	ec2EventSource            = "ec2"
+
+	asgResourceType      = "AWS::AutoScaling::AutoScalingGroup"
+	instanceResourceType = "AWS::EC2::Instance"
+
+	stateTransitionTimeLayout = "2006-01-02 15:04:05 MST"
+)
+
+var stateTransitionTimeRegexp = regexp.MustCompile(`\((\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2} [A-Z]+)\)`)
+
+// Events returns an implementation of Events interface for AWS Cloud.
+func (c *Cloud) Events() (cloudprovider.Events, bool) {
+	return c, true
+}
+
+// GetEvents returns stack events, scaling activities and instance state
+// changes of a given cluster.
+func (c *Cloud) GetEvents(clusterName string) ([]*model.Event, error) {
+	events := []*model.Event{}
+
+	stacks, err := c.getClusterStacks(clusterName)
+	if err != nil {
+		return events, err
+	}
+
+	for _, s := range stacks {
+		e, err := c.getStackEvents(*s.StackName)
+		if err != nil {
+			return events, err
+		}
+		events = append(events, e...)
+
+		res, err := c.getStackResources(*s.StackName)
+		if err != nil {
+			return events, err
+		}
+		for _, r := range res {
+			if *r.ResourceType != asgResourceType || r.PhysicalResourceId == nil {
+				continue
+			}
+			e, err := c.getScalingActivities(*r.PhysicalResourceId)
+			if err != nil {
+				return events, err
+			}
+			events = append(events, e...)
+		}
+	}
+
+	e, err := c.getInstanceEvents(clusterName)
+	if err != nil {
+		return events, err
+	}
+	events = append(events, e...)
+
+	return events, nil
+}
+
+// getClusterStacks returns a list of keto managed stacks of any type that
+// belong to a given clusterName.
+func (c *Cloud) getClusterStacks(clusterName string) ([]*cloudformation.Stack, error) {
+	allStacks, err := c.describeStacks("")
+	stacks := []*cloudformation.Stack{}
+	if err != nil {
+		return stacks, err
+	}
+
+	for _, s := range allStacks {
+		if !isStackManaged(s) {
+			continue
+		}
+		for _, tag := range s.Tags {
+			if *tag.Key == clusterNameTagKey && *tag.Value == clusterName {
+				stacks = append(stacks, s)
+			}
+		}
+	}
+	return stacks, nil
+}
+
+// getStackEvents returns a list of events of a given stack name.
+func (c *Cloud) getStackEvents(name string) ([]*model.Event, error) {
+	events := []*model.Event{}
+
+	c.Logger.Printf("getting stack %q events", name)
+	err := c.cf.DescribeStackEventsPages(&cloudformation.DescribeStackEventsInput{
+		StackName: aws.String(name),
+	}, func(page *cloudformation.DescribeStackEventsOutput, lastPage bool) bool {
+		for _, e := range page.StackEvents {
+			events = append(events, &model.Event{
+				Time:         unixTime(e.Timestamp),
+				Source:       cloudFormationEventSource,
+				ResourceType: aws.StringValue(e.ResourceType),
+				ResourceID:   aws.StringValue(e.LogicalResourceId),
+				Status:       aws.StringValue(e.ResourceStatus),
+				Message:      aws.StringValue(e.ResourceStatusReason),
+			})
+		}
+		return true
+	})
+	return events, err
+}
+
+// getScalingActivities returns a list of scaling activities of a given
+// autoscaling group name.
+func (c *Cloud) getScalingActivities(asgName string) ([]*model.Event, error) {
+	events := []*model.Event{}
+
+	c.Logger.Printf("getting autoscaling group %q scaling activities", asgName)
+	err := c.as.DescribeScalingActivitiesPages(&autoscaling.DescribeScalingActivitiesInput{
+		AutoScalingGroupName: aws.String(asgName),
+	}, func(page *autoscaling.DescribeScalingActivitiesOutput, lastPage bool) bool {
+		for _, a := range page.Activities {
+			events = append(events, &model.Event{
+				Time:         unixTime(a.StartTime),
+				Source:       autoScalingEventSource,
+				ResourceType: asgResourceType,
+				ResourceID:   asgName,
+				Status:       aws.StringValue(a.StatusCode),
+				Message:      aws.StringValue(a.Description),
+			})
+		}
+		return true
+	})
+	return events, err
+}
+
+// getInstanceEvents returns instance state changes of a given cluster. EC2
+// only keeps the most recent state transition of an instance, so at most a
+// launch and a state transition event is returned per instance.
+func (c *Cloud) getInstanceEvents(clusterName string) ([]*model.Event, error) {
+	events := []*model.Event{}
+
+	params := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:KubernetesCluster"),
+				Values: []*string{aws.String(clusterName)},
+			},
+		},
+	}
+
+	c.Logger.Printf("describing instances of cluster %q", clusterName)
+	resp, err := c.ec2.DescribeInstances(params)
+	if err != nil {
+		return events, err
+	}
+
+	for _, r := range resp.Reservations {
+		for _, i := range r.Instances {
+			events = append(events, &model.Event{
+				Time:         unixTime(i.LaunchTime),
+				Source:       ec2EventSource,
+				ResourceType: instanceResourceType,
+				ResourceID:   aws.StringValue(i.InstanceId),
+				Status:       ec2.InstanceStateNamePending,
+				Message:      "instance launched",
+			})
+
+			if i.State == nil || aws.StringValue(i.State.Name) == ec2.InstanceStateNameRunning {
+				continue
+			}
+			e := &model.Event{
+				Source:       ec2EventSource,
+				ResourceType: instanceResourceType,
+				ResourceID:   aws.StringValue(i.InstanceId),
+				Status:       aws.StringValue(i.State.Name),
+				Message:      aws.StringValue(i.StateTransitionReason),
+			}
+			if i.StateReason != nil {
+				e.Message = aws.StringValue(i.StateReason.Message)
+			}
+			// EC2 only reports when the transition happened as part of the
+			// reason string, fall back to the launch time if it is missing.
+			e.Time = parseStateTransitionTime(aws.StringValue(i.StateTransitionReason))
+			if e.Time == 0 {
+				e.Time = unixTime(i.LaunchTime)
+			}
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+// parseStateTransitionTime extracts a time from an EC2 state transition
+// reason, e.g. "User initiated (2017-06-01 10:00:00 GMT)" and returns it as
+// unix time. Zero is returned if a time cannot be found.
+func parseStateTransitionTime(reason string) int64 {
+	m := stateTransitionTimeRegexp.FindStringSubmatch(reason)
+	if len(m) != 2 {
+		return 0
+	}
+	t, err := time.Parse(stateTransitionTimeLayout, m[1])
+	if err != nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+// unixTime returns t as unix time or 0 if t is nil.
+func unixTime(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/UKHomeOffice/keto/pkg/cloudprovider/providers/aws/mocks"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseStateTransitionTime(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		want  int64
+	}{
+		{
+			"empty reason",
+			"",
+			0,
+		},
+		{
+			"reason without time",
+			"Server.SpotInstanceTermination",
+			0,
+		},
+		{
+			"user initiated",
+			"User initiated (2017-06-01 10:00:00 GMT)",
+			time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC).Unix(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := parseStateTransitionTime(tc.input); got != tc.want {
+				t.Errorf("got %d; want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetEvents(t *testing.T) {
+	mockAS := &mocks.AutoScalingAPI{}
+	mockCF := &mocks.CloudFormationAPI{}
+	mockEC2 := &mocks.EC2API{}
+	c := &Cloud{
+		Logger: makeLogger(),
+		as:     mockAS,
+		cf:     mockCF,
+		ec2:    mockEC2,
+	}
+
+	clusterName := "foo"
+	stackName := makeComputePoolStackName(clusterName, "compute", "")
+	now := time.Now()
+
+	mockCF.On("DescribeStacks", &cloudformation.DescribeStacksInput{}).Return(
+		&cloudformation.DescribeStacksOutput{
+			Stacks: []*cloudformation.Stack{
+				{
+					StackName: aws.String(stackName),
+					Tags: []*cloudformation.Tag{
+						{Key: aws.String(managedByKetoTagKey), Value: aws.String(managedByKetoTagValue)},
+						{Key: aws.String(clusterNameTagKey), Value: aws.String(clusterName)},
+					},
+				},
+				{
+					StackName: aws.String("keto-bar-infra"),
+					Tags: []*cloudformation.Tag{
+						{Key: aws.String(managedByKetoTagKey), Value: aws.String(managedByKetoTagValue)},
+						{Key: aws.String(clusterNameTagKey), Value: aws.String("bar")},
+					},
+				},
+			},
+		}, nil)
+
+	// Events of long-lived stacks span several pages.
+	mockCF.On("DescribeStackEventsPages", &cloudformation.DescribeStackEventsInput{StackName: aws.String(stackName)},
+		mock.AnythingOfType("func(*cloudformation.DescribeStackEventsOutput, bool) bool")).Run(func(args mock.Arguments) {
+		fn := args.Get(1).(func(*cloudformation.DescribeStackEventsOutput, bool) bool)
+		for i, status := range []string{cloudformation.ResourceStatusCreateInProgress, cloudformation.ResourceStatusCreateComplete} {
+			fn(&cloudformation.DescribeStackEventsOutput{
+				StackEvents: []*cloudformation.StackEvent{
+					{
+						Timestamp:         aws.Time(now.Add(time.Duration(i-4) * time.Second)),
+						LogicalResourceId: aws.String("ASG"),
+						ResourceStatus:    aws.String(status),
+					},
+				},
+			}, i == 1)
+		}
+	}).Return(nil)
+
+	mockCF.On("DescribeStackResources", &cloudformation.DescribeStackResourcesInput{StackName: aws.String(stackName)}).Return(
+		&cloudformation.DescribeStackResourcesOutput{
+			StackResources: []*cloudformation.StackResource{
+				{
+					ResourceType:       aws.String(asgResourceType),
+					PhysicalResourceId: aws.String("asg-physical-id"),
+				},
+			},
+		}, nil)
+
+	mockAS.On("DescribeScalingActivitiesPages", &autoscaling.DescribeScalingActivitiesInput{
+		AutoScalingGroupName: aws.String("asg-physical-id"),
+	}, mock.AnythingOfType("func(*autoscaling.DescribeScalingActivitiesOutput, bool) bool")).Run(func(args mock.Arguments) {
+		fn := args.Get(1).(func(*autoscaling.DescribeScalingActivitiesOutput, bool) bool)
+		for i := 0; i < 2; i++ {
+			fn(&autoscaling.DescribeScalingActivitiesOutput{
+				Activities: []*autoscaling.Activity{
+					{
+						StartTime:   aws.Time(now.Add(time.Duration(i-2) * time.Second)),
+						StatusCode:  aws.String(autoscaling.ScalingActivityStatusCodeSuccessful),
+						Description: aws.String("Launching a new EC2 instance"),
+					},
+				},
+			}, i == 1)
+		}
+	}).Return(nil)
+
+	mockEC2.On("DescribeInstances", &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:KubernetesCluster"),
+				Values: []*string{aws.String(clusterName)},
+			},
+		},
+	}).Return(&ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{
+			{
+				Instances: []*ec2.Instance{
+					{
+						InstanceId: aws.String("i-123"),
+						LaunchTime: aws.Time(now),
+						State:      &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)},
+					},
+				},
+			},
+		},
+	}, nil)
+
+	events, err := c.GetEvents(clusterName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{cloudFormationEventSource, cloudFormationEventSource, autoScalingEventSource, autoScalingEventSource, ec2EventSource}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events; want %d", len(events), len(want))
+	}
+	for i, e := range events {
+		if e.Source != want[i] {
+			t.Errorf("got event source %q; want %q", e.Source, want[i])
+		}
+	}
+
+	mockAS.AssertExpectations(t)
+	mockCF.AssertExpectations(t)
+	mockEC2.AssertExpectations(t)
+}
@@ -44,6 +44,7 @@ func (c Cloud) GetNodeData() (model.NodeData, error) {
 			data.Labels = util.KVsToLabels(strings.Split(*o.OutputValue, "="))
 		}
 	}
+	data.KubeArgs = getStackKubeArgs(outputs)
 
 	return data, nil
 }
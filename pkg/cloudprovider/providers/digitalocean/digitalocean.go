@@ -0,0 +1,549 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package digitalocean
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UKHomeOffice/keto/pkg/cloudprovider"
+	"github.com/UKHomeOffice/keto/pkg/constants"
+	"github.com/UKHomeOffice/keto/pkg/model"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/digitalocean/godo"
+)
+
+const (
+	// ProviderName is the name of this provider.
+	ProviderName = "digitalocean"
+
+	// Environment variables used to configure the provider.
+	tokenEnv           = "DIGITALOCEAN_ACCESS_TOKEN"
+	regionEnv          = "DIGITALOCEAN_REGION"
+	spacesKeyIDEnv     = "SPACES_ACCESS_KEY_ID"
+	spacesSecretKeyEnv = "SPACES_SECRET_ACCESS_KEY"
+	spacesRegionEnv    = "SPACES_REGION"
+	spacesBucketEnv    = "SPACES_BUCKET"
+
+	// managedByKetoTag is applied to every droplet managed by keto.
+	managedByKetoTag = "keto"
+
+	// masterCount is the number of master droplets and their persistent
+	// floating IPs.
+	masterCount = 3
+
+	kubeAPIPort = 443
+
+	etcdCACertObjectName = "etcd_ca.crt"
+	etcdCAKeyObjectName  = "etcd_ca.key"
+	kubeCACertObjectName = "kube_ca.crt"
+	kubeCAKeyObjectName  = "kube_ca.key"
+
+	loadBalancerStatusActive  = "active"
+	loadBalancerStatusErrored = "errored"
+	dropletStatusActive       = "active"
+
+	// maxUserDataSize is the droplet user data limit.
+	maxUserDataSize = 64 * 1024
+)
+
+var (
+	// ErrNotImplemented defines an error for not implemented features.
+	ErrNotImplemented = errors.New("not implemented")
+	// ErrNoBucket defines an error when a Spaces bucket is not configured.
+	ErrNoBucket = fmt.Errorf("spaces bucket is not configured, %s must be set", spacesBucketEnv)
+	// ErrRetainNotSupported defines an error when resources of a kind that
+	// droplets do not have are requested to be retained.
+	ErrRetainNotSupported = errors.New("only dns and lb resources can be retained by digitalocean")
+
+	// pollInterval is how often long running operations are polled.
+	pollInterval = 5 * time.Second
+	// assetURLExpiry is how long presigned asset URLs in master user data
+	// are valid for, masters save the assets on first boot.
+	assetURLExpiry = 30 * time.Minute
+)
+
+// config represents DigitalOcean provider configuration.
+type config struct {
+	Token           string
+	Region          string
+	SpacesKeyID     string
+	SpacesSecretKey string
+	SpacesRegion    string
+	SpacesBucket    string
+}
+
+// configFromEnv returns a config populated from environment variables.
+func configFromEnv() config {
+	cfg := config{
+		Token:           os.Getenv(tokenEnv),
+		Region:          os.Getenv(regionEnv),
+		SpacesKeyID:     os.Getenv(spacesKeyIDEnv),
+		SpacesSecretKey: os.Getenv(spacesSecretKeyEnv),
+		SpacesRegion:    os.Getenv(spacesRegionEnv),
+		SpacesBucket:    os.Getenv(spacesBucketEnv),
+	}
+	// Spaces are only available in some regions.
+	if cfg.SpacesRegion == "" {
+		cfg.SpacesRegion = cfg.Region
+	}
+	return cfg
+}
+
+// clusterSpec is a cluster spec stored in Spaces.
+type clusterSpec struct {
+	model.Cluster
+	MasterIPs      []string `json:"master_ips,omitempty"`
+	LoadBalancerID string   `json:"load_balancer_id,omitempty"`
+	DNSRecordID    int      `json:"dns_record_id,omitempty"`
+}
+
+// Cloud is an implementation of cloudprovider.Interface.
+type Cloud struct {
+	Logger     cloudprovider.Logger
+	config     config
+	droplets   godo.DropletsService
+	lbs        godo.LoadBalancersService
+	fips       godo.FloatingIPsService
+	fipActions godo.FloatingIPActionsService
+	tags       godo.TagsService
+	domains    godo.DomainsService
+	keys       godo.KeysService
+	images     godo.ImagesService
+	sizes      godo.SizesService
+	s3         s3iface.S3API
+	cache      cloudprovider.Cache
+
+	// operationTimeout limits how long to wait for droplets and load
+	// balancers to become active.
+	operationTimeout time.Duration
+}
+
+// Compile-time check whether Cloud type value implements
+// cloudprovider.Interface interface.
+var _ cloudprovider.Interface = (*Cloud)(nil)
+
+// ProviderName returns the cloud provider ID.
+func (c *Cloud) ProviderName() string {
+	return ProviderName
+}
+
+// Clusters returns an implementation of Clusters interface for DigitalOcean
+// Cloud.
+func (c *Cloud) Clusters() (cloudprovider.Clusters, bool) {
+	return c, true
+}
+
+// Events returns an implementation of Events interface for DigitalOcean
+// Cloud. Events are not supported yet.
+func (c *Cloud) Events() (cloudprovider.Events, bool) {
+	return nil, false
+}
+
+// Drift returns an implementation of Drift interface for DigitalOcean Cloud.
+// Drift is not supported.
+func (c *Cloud) Drift() (cloudprovider.Drift, bool) {
+	return nil, false
+}
+
+// Capabilities returns optional features supported by DigitalOcean Cloud.
+// Load balancers are always public and droplets have a single disk type.
+func (c *Cloud) Capabilities() cloudprovider.Capabilities {
+	return cloudprovider.Capabilities{
+		MaxUserDataSize: maxUserDataSize,
+		NodePoolFields:  cloudprovider.AllNodePoolFields,
+	}
+}
+
+// CreateClusterInfra creates master floating IPs, a master tag, a load
+// balancer that targets it and optionally a DNS record of the load balancer.
+func (c *Cloud) CreateClusterInfra(cluster model.Cluster) error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	if c.config.SpacesBucket == "" {
+		return ErrNoBucket
+	}
+	if cluster.DNSZone != "" {
+		if _, _, err := c.domains.Get(ctx, cluster.DNSZone); err != nil {
+			return fmt.Errorf("dns zone %q does not exist: %v", cluster.DNSZone, err)
+		}
+	}
+
+	spec := clusterSpec{Cluster: cluster}
+	// Node pools are stored separately.
+	spec.MasterPool = model.MasterPool{}
+	spec.ComputePools = nil
+
+	for i := 0; i < masterCount; i++ {
+		c.Logger.Printf("reserving floating IP for master %d", i)
+		ip, _, err := c.fips.Create(ctx, &godo.FloatingIPCreateRequest{Region: c.config.Region})
+		if err != nil {
+			return err
+		}
+		spec.MasterIPs = append(spec.MasterIPs, ip.IP)
+	}
+	// Store the spec early, so that a failure below does not leak floating
+	// IPs that DeleteCluster would not know about.
+	if err := c.putClusterSpec(spec); err != nil {
+		return err
+	}
+
+	c.Logger.Printf("creating tag %q", makeMasterTag(cluster.Name))
+	if _, _, err := c.tags.Create(ctx, &godo.TagCreateRequest{Name: makeMasterTag(cluster.Name)}); err != nil {
+		return err
+	}
+
+	lb, err := c.createLoadBalancer(ctx, cluster.Name)
+	if err != nil {
+		return err
+	}
+	spec.LoadBalancerID = lb.ID
+	if err := c.putClusterSpec(spec); err != nil {
+		return err
+	}
+
+	if cluster.DNSZone != "" {
+		c.Logger.Printf("creating dns record %q in zone %q", makeDNSRecordName(cluster.Name), cluster.DNSZone)
+		r, _, err := c.domains.CreateRecord(ctx, cluster.DNSZone, &godo.DomainRecordEditRequest{
+			Type: "A",
+			Name: makeDNSRecordName(cluster.Name),
+			Data: lb.IP,
+		})
+		if err != nil {
+			return err
+		}
+		spec.DNSRecordID = r.ID
+	}
+	return c.putClusterSpec(spec)
+}
+
+// createLoadBalancer creates a kube API load balancer targeting master
+// droplets and waits for it to become active.
+func (c *Cloud) createLoadBalancer(ctx context.Context, clusterName string) (*godo.LoadBalancer, error) {
+	c.Logger.Printf("creating load balancer %q", makeLoadBalancerName(clusterName))
+	lb, _, err := c.lbs.Create(ctx, &godo.LoadBalancerRequest{
+		Name:   makeLoadBalancerName(clusterName),
+		Region: c.config.Region,
+		ForwardingRules: []godo.ForwardingRule{
+			{
+				EntryProtocol:  "tcp",
+				EntryPort:      kubeAPIPort,
+				TargetProtocol: "tcp",
+				TargetPort:     kubeAPIPort,
+			},
+		},
+		HealthCheck: &godo.HealthCheck{
+			Protocol: "tcp",
+			Port:     kubeAPIPort,
+		},
+		Tag: makeMasterTag(clusterName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The load balancer IP is only known once it is active.
+	for lb.Status != loadBalancerStatusActive {
+		if lb.Status == loadBalancerStatusErrored {
+			return nil, fmt.Errorf("load balancer %q failed to be created", lb.Name)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for load balancer %q: %v", lb.Name, ctx.Err())
+		case <-time.After(pollInterval):
+		}
+		if lb, _, err = c.lbs.Get(ctx, lb.ID); err != nil {
+			return nil, err
+		}
+	}
+	return lb, nil
+}
+
+// GetClusters returns a cluster by name or all clusters in the bucket.
+func (c *Cloud) GetClusters(name string) ([]*model.Cluster, error) {
+	clusters := []*model.Cluster{}
+
+	names, err := c.getClusterNames()
+	if err != nil {
+		return clusters, err
+	}
+	for _, n := range names {
+		if name != "" && n != name {
+			continue
+		}
+		spec, err := c.getClusterSpec(n)
+		if err != nil {
+			return clusters, err
+		}
+		cl := spec.Cluster
+		cl.KubeAPIURL, err = c.getKubeAPIURL(spec)
+		if err != nil {
+			return clusters, err
+		}
+		clusters = append(clusters, &cl)
+	}
+	return clusters, nil
+}
+
+// getKubeAPIURL returns a Kubernetes API URL of a cluster. The DNS record is
+// preferred over the load balancer IP if the cluster has a DNS zone.
+func (c *Cloud) getKubeAPIURL(spec clusterSpec) (string, error) {
+	if spec.DNSZone != "" {
+		return formatKubeAPIURL(makeDNSRecordName(spec.Name) + "." + spec.DNSZone), nil
+	}
+	if spec.LoadBalancerID == "" {
+		return "", nil
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	lb, _, err := c.lbs.Get(ctx, spec.LoadBalancerID)
+	if err != nil {
+		return "", err
+	}
+	return formatKubeAPIURL(lb.IP), nil
+}
+
+func formatKubeAPIURL(host string) string {
+	return "https://" + strings.ToLower(host)
+}
+
+// DescribeCluster describes a given cluster.
+func (c *Cloud) DescribeCluster(name string) error {
+	return ErrNotImplemented
+}
+
+// DeleteCluster deletes all node pools of a cluster and its infra. The DNS
+// record and the load balancer are preserved if retained. Masters have no
+// persistent volumes, so they cannot be retained.
+func (c *Cloud) DeleteCluster(name string, retain []string) ([]*model.Resource, error) {
+	retained := []*model.Resource{}
+	for _, r := range retain {
+		if r != constants.RetainDNS && r != constants.RetainLB {
+			return retained, ErrRetainNotSupported
+		}
+	}
+
+	spec, err := c.getClusterSpec(name)
+	if err != nil {
+		return retained, err
+	}
+
+	c.Logger.Printf("deleting compute pools that belong to cluster %q", name)
+	if err := c.DeleteComputePool(name, ""); err != nil {
+		return retained, err
+	}
+	c.Logger.Printf("deleting master pool that belongs to cluster %q", name)
+	if err := c.DeleteMasterPool(name); err != nil {
+		return retained, err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	if spec.DNSRecordID != 0 {
+		if isRetained(constants.RetainDNS, retain) {
+			retained = append(retained, &model.Resource{Type: "dns-record", ID: strconv.Itoa(spec.DNSRecordID)})
+		} else {
+			c.Logger.Printf("deleting dns record %d in zone %q", spec.DNSRecordID, spec.DNSZone)
+			if _, err := c.domains.DeleteRecord(ctx, spec.DNSZone, spec.DNSRecordID); err != nil {
+				return retained, err
+			}
+		}
+	}
+
+	if spec.LoadBalancerID != "" {
+		if isRetained(constants.RetainLB, retain) {
+			retained = append(retained, &model.Resource{Type: "load-balancer", ID: spec.LoadBalancerID})
+		} else {
+			c.Logger.Printf("deleting load balancer %q", spec.LoadBalancerID)
+			if _, err := c.lbs.Delete(ctx, spec.LoadBalancerID); err != nil {
+				return retained, err
+			}
+		}
+	}
+
+	// A retained load balancer keeps referring to the tag. The tag may not
+	// exist if the cluster was only partially created.
+	if spec.LoadBalancerID == "" || !isRetained(constants.RetainLB, retain) {
+		c.Logger.Printf("deleting tag %q", makeMasterTag(name))
+		if resp, err := c.tags.Delete(ctx, makeMasterTag(name)); err != nil && !isNotFound(resp) {
+			return retained, err
+		}
+	}
+
+	for _, ip := range spec.MasterIPs {
+		c.Logger.Printf("releasing floating IP %q", ip)
+		if _, err := c.fips.Delete(ctx, ip); err != nil {
+			return retained, err
+		}
+	}
+
+	return retained, c.deleteClusterObjects(name)
+}
+
+// isNotFound returns true if an API response is a not found error.
+func isNotFound(resp *godo.Response) bool {
+	return resp != nil && resp.Response != nil && resp.StatusCode == http.StatusNotFound
+}
+
+// isRetained returns true if kind is listed in retain.
+func isRetained(kind string, retain []string) bool {
+	for _, r := range retain {
+		if r == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// GetMasterPersistentIPs returns a map of master node IDs to floating IPs
+// reserved for masters of clusterName.
+func (c *Cloud) GetMasterPersistentIPs(clusterName string) (map[string]string, error) {
+	m := make(map[string]string)
+
+	spec, err := c.getClusterSpec(clusterName)
+	if err != nil {
+		return m, err
+	}
+	for i, ip := range spec.MasterIPs {
+		m[strconv.Itoa(i)] = ip
+	}
+	return m, nil
+}
+
+// PushAssets pushes assets to the Spaces bucket.
+func (c *Cloud) PushAssets(clusterName string, a model.Assets) error {
+	// We only need the assets for the initial bootstrap.
+	if err := c.putObject(makeAssetKey(clusterName, etcdCACertObjectName), a.EtcdCACert); err != nil {
+		return err
+	}
+	if err := c.putObject(makeAssetKey(clusterName, etcdCAKeyObjectName), a.EtcdCAKey); err != nil {
+		return err
+	}
+	if err := c.putObject(makeAssetKey(clusterName, kubeCACertObjectName), a.KubeCACert); err != nil {
+		return err
+	}
+	return c.putObject(makeAssetKey(clusterName, kubeCAKeyObjectName), a.KubeCAKey)
+}
+
+// context returns a context for a single provider operation, it is cancelled
+// once operationTimeout passes.
+func (c *Cloud) context() (context.Context, context.CancelFunc) {
+	if c.operationTimeout > 0 {
+		return context.WithTimeout(context.Background(), c.operationTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// makeMasterTag returns a tag of master droplets of a cluster, which the
+// load balancer targets.
+func makeMasterTag(clusterName string) string {
+	return "keto:" + clusterName + ":masters"
+}
+
+// makePoolTag returns a tag of droplets of a node pool.
+func makePoolTag(clusterName, poolName string) string {
+	return "keto:" + clusterName + ":pool:" + poolName
+}
+
+// makeLoadBalancerName returns a load balancer name of a cluster.
+func makeLoadBalancerName(clusterName string) string {
+	return "keto-" + clusterName
+}
+
+// makeDNSRecordName returns a kube API DNS record name of a cluster.
+func makeDNSRecordName(clusterName string) string {
+	return "kube-" + clusterName
+}
+
+// tokenTransport authenticates DigitalOcean API requests.
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+// RoundTrip adds an authorization header to a copy of req.
+func (t tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(r)
+}
+
+// init registers DigitalOcean cloud with the cloudprovider.
+func init() {
+	// f knows how to initialize the cloud
+	f := func(l cloudprovider.Logger, cfg cloudprovider.Config) (cloudprovider.Interface, error) {
+		return newCloud(configFromEnv(), l, cfg)
+	}
+	cloudprovider.Register(ProviderName, f)
+}
+
+// newCloud creates a new instance of DigitalOcean Cloud given a provider
+// config.
+func newCloud(pc config, l cloudprovider.Logger, cfg cloudprovider.Config) (*Cloud, error) {
+	client := godo.NewClient(&http.Client{
+		Timeout:   cfg.RequestTimeout,
+		Transport: tokenTransport{token: pc.Token, base: http.DefaultTransport},
+	})
+
+	// Spaces are S3 compatible.
+	sess, err := session.NewSession(&aws.Config{
+		Credentials: credentials.NewStaticCredentials(pc.SpacesKeyID, pc.SpacesSecretKey, ""),
+		Endpoint:    aws.String(fmt.Sprintf("https://%s.digitaloceanspaces.com", pc.SpacesRegion)),
+		// Region is ignored by Spaces, but required by the SDK.
+		Region:     aws.String("us-east-1"),
+		HTTPClient: &http.Client{Timeout: cfg.RequestTimeout},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cloud{
+		Logger:           l,
+		config:           pc,
+		droplets:         client.Droplets,
+		lbs:              client.LoadBalancers,
+		fips:             client.FloatingIPs,
+		fipActions:       client.FloatingIPActions,
+		tags:             client.Tags,
+		domains:          client.Domains,
+		keys:             client.Keys,
+		images:           client.Images,
+		sizes:            client.Sizes,
+		s3:               s3.New(sess),
+		cache:            cfg.Cache,
+		operationTimeout: cfg.OperationTimeout,
+	}, nil
+}
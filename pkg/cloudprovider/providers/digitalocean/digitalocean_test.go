@@ -0,0 +1,508 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package digitalocean
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/UKHomeOffice/keto/pkg/cache"
+	"github.com/UKHomeOffice/keto/pkg/constants"
+	"github.com/UKHomeOffice/keto/pkg/model"
+	"github.com/UKHomeOffice/keto/pkg/userdata"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/digitalocean/godo"
+	"github.com/digitalocean/godo/context"
+)
+
+func TestGetNodeData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keto-do")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p string) { nodeDataPath = p }(nodeDataPath)
+	nodeDataPath = filepath.Join(dir, "node-data.json")
+
+	p := model.NodePool{}
+	p.ClusterName = "foo"
+	p.KubeVersion = "v1.6.4"
+	p.Labels = model.Labels{"env": "dev"}
+	f, err := makeNodeDataFile(p, "https://kube-foo.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(nodeDataPath, f.Content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := Cloud{}.GetNodeData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := model.NodeData{
+		KubeAPIURL:  "https://kube-foo.example.com",
+		ClusterName: "foo",
+		KubeVersion: "v1.6.4",
+		Labels:      model.Labels{"env": "dev"},
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("got %+v; want %+v", data, want)
+	}
+}
+
+// fakeS3 is an in-memory bucket.
+type fakeS3 struct {
+	s3iface.S3API
+	objects map[string][]byte
+}
+
+func (f *fakeS3) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	b := f.objects[*in.Key]
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(b))}, nil
+}
+
+// GetObjectRequest returns a request of a real client, presigning it does not
+// send it.
+func (f *fakeS3) GetObjectRequest(in *s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput) {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		Endpoint:    aws.String("https://lon1.digitaloceanspaces.com"),
+		Region:      aws.String("us-east-1"),
+	}))
+	return s3.New(sess).GetObjectRequest(in)
+}
+
+func (f *fakeS3) ListObjectsPages(in *s3.ListObjectsInput, fn func(*s3.ListObjectsOutput, bool) bool) error {
+	out := &s3.ListObjectsOutput{}
+	prefixes := make(map[string]bool)
+	for k := range f.objects {
+		if !strings.HasPrefix(k, aws.StringValue(in.Prefix)) {
+			continue
+		}
+		if d := aws.StringValue(in.Delimiter); d != "" && strings.Contains(k, d) {
+			p := k[:strings.Index(k, d)+len(d)]
+			if !prefixes[p] {
+				prefixes[p] = true
+				out.CommonPrefixes = append(out.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(p)})
+			}
+			continue
+		}
+		out.Contents = append(out.Contents, &s3.Object{Key: aws.String(k)})
+	}
+	fn(out, true)
+	return nil
+}
+
+func (f *fakeS3) PutObject(in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	b, err := ioutil.ReadAll(in.Body)
+	f.objects[*in.Key] = b
+	return &s3.PutObjectOutput{}, err
+}
+
+func (f *fakeS3) DeleteObjects(in *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	for _, o := range in.Delete.Objects {
+		delete(f.objects, *o.Key)
+	}
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+type fakeDomains struct {
+	godo.DomainsService
+	deleted []int
+}
+
+func (f *fakeDomains) DeleteRecord(_ context.Context, _ string, id int) (*godo.Response, error) {
+	f.deleted = append(f.deleted, id)
+	return nil, nil
+}
+
+type fakeLoadBalancers struct {
+	godo.LoadBalancersService
+	deleted []string
+}
+
+func (f *fakeLoadBalancers) Delete(_ context.Context, id string) (*godo.Response, error) {
+	f.deleted = append(f.deleted, id)
+	return nil, nil
+}
+
+type fakeFloatingIPs struct {
+	godo.FloatingIPsService
+	deleted []string
+}
+
+func (f *fakeFloatingIPs) Delete(_ context.Context, ip string) (*godo.Response, error) {
+	f.deleted = append(f.deleted, ip)
+	return nil, nil
+}
+
+type fakeDroplets struct {
+	godo.DropletsService
+	created []*godo.DropletMultiCreateRequest
+}
+
+func (f *fakeDroplets) CreateMultiple(_ context.Context, r *godo.DropletMultiCreateRequest) ([]godo.Droplet, *godo.Response, error) {
+	f.created = append(f.created, r)
+	droplets := []godo.Droplet{}
+	for _, name := range r.Names {
+		droplets = append(droplets, godo.Droplet{ID: len(f.created)*100 + len(droplets), Name: name})
+	}
+	return droplets, nil, nil
+}
+
+func (f *fakeDroplets) Get(_ context.Context, id int) (*godo.Droplet, *godo.Response, error) {
+	return &godo.Droplet{ID: id, Status: dropletStatusActive}, nil, nil
+}
+
+type fakeFloatingIPActions struct {
+	godo.FloatingIPActionsService
+	assigned map[string]int
+}
+
+func (f *fakeFloatingIPActions) Assign(_ context.Context, ip string, id int) (*godo.Action, *godo.Response, error) {
+	f.assigned[ip] = id
+	return nil, nil, nil
+}
+
+type fakeTags struct {
+	godo.TagsService
+	deleted []string
+	// notFound makes deletes fail as if tags did not exist.
+	notFound bool
+}
+
+func (f *fakeTags) Delete(_ context.Context, name string) (*godo.Response, error) {
+	f.deleted = append(f.deleted, name)
+	if f.notFound {
+		resp := &godo.Response{Response: &http.Response{StatusCode: http.StatusNotFound}}
+		return resp, &godo.ErrorResponse{Response: resp.Response, Message: "not found"}
+	}
+	return nil, nil
+}
+
+type fakeImages struct {
+	godo.ImagesService
+	calls int
+}
+
+func (f *fakeImages) GetBySlug(_ context.Context, slug string) (*godo.Image, *godo.Response, error) {
+	f.calls++
+	return &godo.Image{Slug: slug, Regions: []string{"lon1"}}, nil, nil
+}
+
+type fakeSizes struct {
+	godo.SizesService
+	calls int
+}
+
+func (f *fakeSizes) List(_ context.Context, _ *godo.ListOptions) ([]godo.Size, *godo.Response, error) {
+	f.calls++
+	return []godo.Size{{Slug: "2gb", Available: true, Regions: []string{"lon1"}}}, &godo.Response{}, nil
+}
+
+func TestDeleteClusterRetain(t *testing.T) {
+	spec := clusterSpec{
+		MasterIPs:      []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"},
+		LoadBalancerID: "lb-1",
+		DNSRecordID:    42,
+	}
+	spec.Name = "foo"
+	spec.DNSZone = "example.com"
+	b, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := &fakeS3{objects: map[string][]byte{
+		makeClusterSpecKey("foo"):                 b,
+		makeAssetKey("foo", etcdCACertObjectName): []byte("cert"),
+		makeAssetKey("bar", etcdCACertObjectName): []byte("cert"),
+	}}
+	domains := &fakeDomains{}
+	lbs := &fakeLoadBalancers{}
+	fips := &fakeFloatingIPs{}
+	c := &Cloud{
+		Logger:  log.New(ioutil.Discard, "", 0),
+		config:  config{SpacesBucket: "keto"},
+		s3:      bucket,
+		domains: domains,
+		lbs:     lbs,
+		fips:    fips,
+		tags:    &fakeTags{},
+	}
+
+	retained, err := c.DeleteCluster("foo", []string{constants.RetainDNS})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*model.Resource{{Type: "dns-record", ID: "42"}}
+	if !reflect.DeepEqual(retained, want) {
+		t.Errorf("got retained %v; want %v", retained, want)
+	}
+	if len(domains.deleted) != 0 {
+		t.Errorf("retained dns record has been deleted")
+	}
+	if !reflect.DeepEqual(lbs.deleted, []string{"lb-1"}) {
+		t.Errorf("got deleted load balancers %v; want [lb-1]", lbs.deleted)
+	}
+	if !reflect.DeepEqual(fips.deleted, spec.MasterIPs) {
+		t.Errorf("got released floating IPs %v; want %v", fips.deleted, spec.MasterIPs)
+	}
+	if len(bucket.objects) != 1 {
+		t.Errorf("cluster objects have not been deleted, got %v", bucket.objects)
+	}
+}
+
+func TestDeleteClusterTag(t *testing.T) {
+	tests := []struct {
+		spec     clusterSpec
+		retain   []string
+		notFound bool
+		deleted  bool
+	}{
+		// Partially created cluster without a load balancer nor a tag.
+		{spec: clusterSpec{}, notFound: true, deleted: true},
+		{spec: clusterSpec{}, retain: []string{constants.RetainLB}, deleted: true},
+		{spec: clusterSpec{LoadBalancerID: "lb-1"}, deleted: true},
+		{spec: clusterSpec{LoadBalancerID: "lb-1"}, retain: []string{constants.RetainLB}},
+	}
+	for i, tc := range tests {
+		tc.spec.Name = "foo"
+		b, err := json.Marshal(tc.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags := &fakeTags{notFound: tc.notFound}
+		c := &Cloud{
+			Logger: log.New(ioutil.Discard, "", 0),
+			config: config{SpacesBucket: "keto"},
+			s3:     &fakeS3{objects: map[string][]byte{makeClusterSpecKey("foo"): b}},
+			lbs:    &fakeLoadBalancers{},
+			tags:   tags,
+		}
+
+		if _, err := c.DeleteCluster("foo", tc.retain); err != nil {
+			t.Errorf("test %d: %v", i, err)
+			continue
+		}
+		if deleted := reflect.DeepEqual(tags.deleted, []string{makeMasterTag("foo")}); deleted != tc.deleted {
+			t.Errorf("test %d: got deleted tags %v; want tag deleted %t", i, tags.deleted, tc.deleted)
+		}
+	}
+}
+
+func TestDeleteClusterRetainVolumes(t *testing.T) {
+	bucket := &fakeS3{objects: map[string][]byte{
+		makeClusterSpecKey("foo"): []byte("{}"),
+	}}
+	c := &Cloud{
+		Logger: log.New(ioutil.Discard, "", 0),
+		config: config{SpacesBucket: "keto"},
+		s3:     bucket,
+	}
+
+	if _, err := c.DeleteCluster("foo", []string{constants.RetainVolumes}); err != ErrRetainNotSupported {
+		t.Errorf("got error %v; want %v", err, ErrRetainNotSupported)
+	}
+	if len(bucket.objects) != 1 {
+		t.Errorf("cluster objects have been deleted")
+	}
+}
+
+func TestCreateDropletsUserDataSize(t *testing.T) {
+	c := &Cloud{Logger: log.New(ioutil.Discard, "", 0)}
+
+	userData := bytes.Repeat([]byte("a"), maxUserDataSize+1)
+	if _, err := c.createDroplets(context.Background(), model.NodePool{}, []string{"foo-compute-0"}, userData, nil); err == nil {
+		t.Error("expected an error for user data over the droplet limit")
+	}
+}
+
+func TestValidateNodePoolCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keto-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	images := &fakeImages{}
+	sizes := &fakeSizes{}
+	c := &Cloud{
+		Logger: log.New(ioutil.Discard, "", 0),
+		config: config{Region: "lon1"},
+		images: images,
+		sizes:  sizes,
+		cache:  cache.New(dir, time.Hour),
+	}
+
+	p := model.NodePool{}
+	p.CoreOSVersion = "coreos-stable"
+	p.MachineType = "2gb"
+	// The second validation is served from the cache.
+	for i := 0; i < 2; i++ {
+		if err := c.ValidateNodePool(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if images.calls != 1 || sizes.calls != 1 {
+		t.Errorf("got %d image and %d size lookups; want 1 each", images.calls, sizes.calls)
+	}
+
+	p.MachineType = "64gb"
+	if err := c.ValidateNodePool(p); err == nil {
+		t.Errorf("expected an error for an unknown size %q", p.MachineType)
+	}
+}
+
+func TestClusterDNSConfig(t *testing.T) {
+	c := &Cloud{
+		Logger: log.New(ioutil.Discard, "", 0),
+		config: config{SpacesBucket: "keto"},
+		s3:     &fakeS3{objects: map[string][]byte{}},
+	}
+
+	spec := clusterSpec{}
+	spec.Name = "foo"
+	spec.DNSZone = "example.com"
+	spec.DNS = model.DNSConfig{Provider: "kube-dns", UpstreamNameservers: []string{"10.0.0.2"}}
+	if err := c.putClusterSpec(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	clusters, err := c.GetClusters("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 1 || !reflect.DeepEqual(clusters[0].DNS, spec.DNS) {
+		t.Errorf("got clusters %+v; want DNS config %+v", clusters, spec.DNS)
+	}
+}
+
+func TestCreateMasterPool(t *testing.T) {
+	spec := clusterSpec{MasterIPs: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}}
+	spec.Name = "foo"
+	spec.DNSZone = "example.com"
+	b, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := &fakeS3{objects: map[string][]byte{makeClusterSpecKey("foo"): b}}
+	for _, name := range []string{etcdCACertObjectName, etcdCAKeyObjectName, kubeCACertObjectName, kubeCAKeyObjectName} {
+		bucket.objects[makeAssetKey("foo", name)] = []byte("secret " + name)
+	}
+	droplets := &fakeDroplets{}
+	fipActions := &fakeFloatingIPActions{assigned: make(map[string]int)}
+	c := &Cloud{
+		Logger:     log.New(ioutil.Discard, "", 0),
+		config:     config{SpacesBucket: "keto"},
+		s3:         bucket,
+		droplets:   droplets,
+		fipActions: fipActions,
+	}
+
+	p := model.MasterPool{NodePool: model.NodePool{ResourceMeta: model.ResourceMeta{Name: "master", ClusterName: "foo"}}}
+	p.UserData = []byte("#cloud-config\nwrite_files:\n")
+	if err := c.CreateMasterPool(p); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(droplets.created) != len(spec.MasterIPs) {
+		t.Fatalf("got %d droplet create requests; want one per master", len(droplets.created))
+	}
+	for i, r := range droplets.created {
+		if want := []string{makeDropletName("foo", "master", i)}; !reflect.DeepEqual(r.Names, want) {
+			t.Errorf("got droplet names %v; want %v", r.Names, want)
+		}
+		env := userdata.MasterEnvFile(strconv.Itoa(i), spec.MasterIPs[i])
+		if !strings.Contains(r.UserData, base64.StdEncoding.EncodeToString(env.Content)) {
+			t.Errorf("master %d user data has no master environment file", i)
+		}
+		if !strings.Contains(r.UserData, "- path: "+assetURLsPath) {
+			t.Errorf("master %d user data has no asset URLs", i)
+		}
+		for _, a := range bucket.objects {
+			if strings.Contains(r.UserData, base64.StdEncoding.EncodeToString(a)) || strings.Contains(r.UserData, string(a)) {
+				t.Errorf("master %d user data has assets in it", i)
+			}
+		}
+	}
+	if len(fipActions.assigned) != len(spec.MasterIPs) {
+		t.Errorf("got assigned floating IPs %v; want %v", fipActions.assigned, spec.MasterIPs)
+	}
+}
+
+func TestGetAssets(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(path.Base(r.URL.Path)))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "keto-do")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p string) { assetURLsPath = p }(assetURLsPath)
+	assetURLsPath = filepath.Join(dir, "asset-urls.json")
+
+	urls := make(map[string]string)
+	for _, name := range []string{etcdCACertObjectName, etcdCAKeyObjectName, kubeCACertObjectName, kubeCAKeyObjectName} {
+		urls[name] = srv.URL + "/foo/assets/" + name
+	}
+	b, err := json.Marshal(urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(assetURLsPath, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := (&Cloud{}).GetAssets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := model.Assets{
+		EtcdCACert: []byte(etcdCACertObjectName),
+		EtcdCAKey:  []byte(etcdCAKeyObjectName),
+		KubeCACert: []byte(kubeCACertObjectName),
+		KubeCAKey:  []byte(kubeCAKeyObjectName),
+	}
+	if !reflect.DeepEqual(a, want) {
+		t.Errorf("got assets %+v; want %+v", a, want)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package digitalocean
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/UKHomeOffice/keto/pkg/cloudprovider"
+	"github.com/UKHomeOffice/keto/pkg/model"
+)
+
+// Droplets cannot query the API without a token, so node data and, on
+// masters, presigned asset URLs are written to disk by cloud-config instead.
+// These are variables so that they can be replaced in tests.
+var (
+	nodeDataPath  = "/etc/keto/node-data.json"
+	assetURLsPath = "/etc/keto/asset-urls.json"
+)
+
+// assetDownloadTimeout limits how long downloading an asset may take.
+var assetDownloadTimeout = time.Minute
+
+// Node returns an implementation of Node interface for DigitalOcean Cloud.
+func (c *Cloud) Node() (cloudprovider.Node, bool) {
+	return c, true
+}
+
+// GetNodeData returns model.NodeData which contains information like node
+// labels, kube version, etc.
+func (c Cloud) GetNodeData() (model.NodeData, error) {
+	var data model.NodeData
+
+	b, err := ioutil.ReadFile(nodeDataPath)
+	if err != nil {
+		return data, err
+	}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return data, fmt.Errorf("failed to decode %q: %v", nodeDataPath, err)
+	}
+	return data, nil
+}
+
+// GetAssets downloads assets from Spaces with presigned URLs, which expire
+// shortly after the droplet is created. Only master nodes have assets.
+func (c *Cloud) GetAssets() (model.Assets, error) {
+	var a model.Assets
+
+	b, err := ioutil.ReadFile(assetURLsPath)
+	if err != nil {
+		return a, err
+	}
+	urls := make(map[string]string)
+	if err := json.Unmarshal(b, &urls); err != nil {
+		return a, fmt.Errorf("failed to decode %q: %v", assetURLsPath, err)
+	}
+
+	client := &http.Client{Timeout: assetDownloadTimeout}
+	files := map[string]*[]byte{
+		etcdCACertObjectName: &a.EtcdCACert,
+		etcdCAKeyObjectName:  &a.EtcdCAKey,
+		kubeCACertObjectName: &a.KubeCACert,
+		kubeCAKeyObjectName:  &a.KubeCAKey,
+	}
+	for name, b := range files {
+		u, ok := urls[name]
+		if !ok {
+			return a, fmt.Errorf("no URL to download %q", name)
+		}
+		if *b, err = downloadAsset(client, u); err != nil {
+			return a, fmt.Errorf("failed to download %q: %v", name, err)
+		}
+	}
+	return a, nil
+}
+
+// downloadAsset downloads an asset from a presigned URL.
+func downloadAsset(client *http.Client, u string) ([]byte, error) {
+	resp, err := client.Get(u)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return []byte{}, fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
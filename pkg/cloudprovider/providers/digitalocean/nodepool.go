@@ -0,0 +1,456 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package digitalocean
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UKHomeOffice/keto/pkg/cloudprovider"
+	"github.com/UKHomeOffice/keto/pkg/kubeargs"
+	"github.com/UKHomeOffice/keto/pkg/model"
+	"github.com/UKHomeOffice/keto/pkg/userdata"
+
+	"github.com/digitalocean/godo"
+)
+
+const (
+	masterPoolType  = "masterpool"
+	computePoolType = "computepool"
+)
+
+// NodePooler returns an implementation of NodePooler interface for
+// DigitalOcean Cloud.
+func (c *Cloud) NodePooler() (cloudprovider.NodePooler, bool) {
+	return c, true
+}
+
+// CreateMasterPool creates a master node pool. Master droplets get the
+// cluster assets written to disk and a persistent floating IP each.
+func (c *Cloud) CreateMasterPool(p model.MasterPool) error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	spec, err := c.getClusterSpec(p.ClusterName)
+	if err != nil {
+		return err
+	}
+	kubeAPIURL, err := c.getKubeAPIURL(spec)
+	if err != nil {
+		return err
+	}
+
+	assetURLs, err := c.makeAssetURLsFile(p.ClusterName)
+	if err != nil {
+		return err
+	}
+	nodeData, err := makeNodeDataFile(p.NodePool, kubeAPIURL)
+	if err != nil {
+		return err
+	}
+
+	// Each master gets its own user data with its node ID and floating IP.
+	tags := []string{managedByKetoTag, makeMasterTag(p.ClusterName), makePoolTag(p.ClusterName, p.Name)}
+	droplets := []godo.Droplet{}
+	for i, ip := range spec.MasterIPs {
+		files := []userdata.File{assetURLs, nodeData, userdata.MasterEnvFile(strconv.Itoa(i), ip)}
+		userData, err := userdata.AddWriteFiles(p.UserData, files)
+		if err != nil {
+			return err
+		}
+		d, err := c.createDroplets(ctx, p.NodePool, []string{makeDropletName(p.ClusterName, p.Name, i)}, userData, tags)
+		if err != nil {
+			return err
+		}
+		droplets = append(droplets, d...)
+	}
+
+	for i, d := range droplets {
+		d, err := c.waitForDroplet(ctx, d.ID)
+		if err != nil {
+			return err
+		}
+		c.Logger.Printf("assigning floating IP %q to droplet %q", spec.MasterIPs[i], d.Name)
+		if _, _, err := c.fipActions.Assign(ctx, spec.MasterIPs[i], d.ID); err != nil {
+			return err
+		}
+	}
+
+	return c.putPoolSpec(poolSpec{NodePool: p.NodePool, Type: masterPoolType})
+}
+
+// CreateComputePool creates a compute node pool.
+func (c *Cloud) CreateComputePool(p model.ComputePool) error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	spec, err := c.getClusterSpec(p.ClusterName)
+	if err != nil {
+		return err
+	}
+	kubeAPIURL, err := c.getKubeAPIURL(spec)
+	if err != nil {
+		return err
+	}
+
+	nodeData, err := makeNodeDataFile(p.NodePool, kubeAPIURL)
+	if err != nil {
+		return err
+	}
+	userData, err := userdata.AddWriteFiles(p.UserData, []userdata.File{nodeData})
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for i := 0; i < p.Size; i++ {
+		names = append(names, makeDropletName(p.ClusterName, p.Name, i))
+	}
+	tags := []string{managedByKetoTag, makePoolTag(p.ClusterName, p.Name)}
+	if _, err := c.createDroplets(ctx, p.NodePool, names, userData, tags); err != nil {
+		return err
+	}
+
+	return c.putPoolSpec(poolSpec{NodePool: p.NodePool, Type: computePoolType})
+}
+
+// createDroplets creates named droplets of a node pool. CoreOSVersion is used
+// as an image slug and MachineType as a size slug. There are no networks to
+// choose from, droplets get private networking instead.
+func (c *Cloud) createDroplets(ctx context.Context, p model.NodePool, names []string, userData []byte, tags []string) ([]godo.Droplet, error) {
+	// The controller only checks the user data it rendered, before files
+	// are added to it.
+	if len(userData) > maxUserDataSize {
+		return nil, fmt.Errorf("droplet user data is %d bytes, digitalocean supports at most %d bytes",
+			len(userData), maxUserDataSize)
+	}
+	if len(p.Networks) > 0 {
+		c.Logger.Printf("networks %v are ignored, droplets use private networking", p.Networks)
+	}
+
+	sshKeys, err := c.getSSHKeys(ctx, p.SSHKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Logger.Printf("creating droplets %v", names)
+	droplets, _, err := c.droplets.CreateMultiple(ctx, &godo.DropletMultiCreateRequest{
+		Names:             names,
+		Region:            c.config.Region,
+		Size:              p.MachineType,
+		Image:             godo.DropletCreateImage{Slug: p.CoreOSVersion},
+		SSHKeys:           sshKeys,
+		PrivateNetworking: true,
+		UserData:          string(userData),
+		Tags:              tags,
+	})
+	return droplets, err
+}
+
+// ValidateNodePool checks that the node pool image and size slugs exist and
+// are available in the region. SSH keys are not checked, as they are looked up
+// when droplets are created.
+func (c *Cloud) ValidateNodePool(p model.NodePool) error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	image, err := c.getImage(ctx, p.CoreOSVersion)
+	if err != nil {
+		return err
+	}
+	if !stringInSlice(c.config.Region, image.Regions) {
+		return fmt.Errorf("image %q is not available in region %q", p.CoreOSVersion, c.config.Region)
+	}
+
+	sizes, err := c.getSizes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range sizes {
+		if s.Slug != p.MachineType {
+			continue
+		}
+		if !s.Available || !stringInSlice(c.config.Region, s.Regions) {
+			return fmt.Errorf("size %q is not available in region %q", p.MachineType, c.config.Region)
+		}
+		return nil
+	}
+	return fmt.Errorf("size %q not found", p.MachineType)
+}
+
+// getImage returns an image given its slug. Image lookups are cached.
+func (c *Cloud) getImage(ctx context.Context, slug string) (godo.Image, error) {
+	var image godo.Image
+	key := fmt.Sprintf("%s/images/%s", ProviderName, slug)
+	if cloudprovider.GetCached(c.cache, c.Logger, key, &image) {
+		return image, nil
+	}
+
+	i, _, err := c.images.GetBySlug(ctx, slug)
+	if err != nil {
+		return image, fmt.Errorf("failed to get image %q: %v", slug, err)
+	}
+	image = *i
+	cloudprovider.SetCached(c.cache, c.Logger, key, image)
+	return image, nil
+}
+
+// getSizes returns the droplet size catalog, which is cached.
+func (c *Cloud) getSizes(ctx context.Context) ([]godo.Size, error) {
+	sizes := []godo.Size{}
+	key := fmt.Sprintf("%s/sizes", ProviderName)
+	if cloudprovider.GetCached(c.cache, c.Logger, key, &sizes) {
+		return sizes, nil
+	}
+
+	opt := &godo.ListOptions{Page: 1, PerPage: 200}
+	for {
+		s, resp, err := c.sizes.List(ctx, opt)
+		if err != nil {
+			return sizes, err
+		}
+		sizes = append(sizes, s...)
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+		opt.Page++
+	}
+	cloudprovider.SetCached(c.cache, c.Logger, key, sizes)
+	return sizes, nil
+}
+
+// getSSHKeys returns a droplet SSH key given a key fingerprint or name.
+func (c *Cloud) getSSHKeys(ctx context.Context, key string) ([]godo.DropletCreateSSHKey, error) {
+	if key == "" {
+		return nil, nil
+	}
+	if strings.Contains(key, ":") {
+		return []godo.DropletCreateSSHKey{{Fingerprint: key}}, nil
+	}
+
+	opt := &godo.ListOptions{Page: 1, PerPage: 200}
+	for {
+		keys, resp, err := c.keys.List(ctx, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			if k.Name == key {
+				return []godo.DropletCreateSSHKey{{ID: k.ID}}, nil
+			}
+		}
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			return nil, fmt.Errorf("ssh key %q not found", key)
+		}
+		opt.Page++
+	}
+}
+
+// waitForDroplet waits for a droplet to become active.
+func (c *Cloud) waitForDroplet(ctx context.Context, id int) (*godo.Droplet, error) {
+	for {
+		d, _, err := c.droplets.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if d.Status == dropletStatusActive {
+			return d, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for droplet %q: %v", d.Name, ctx.Err())
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// GetMasterPools returns a list of master pools. Pools can be filtered by
+// their name / cluster.
+func (c *Cloud) GetMasterPools(clusterName, name string) ([]*model.MasterPool, error) {
+	pools := []*model.MasterPool{}
+
+	nodePools, err := c.getNodePools(masterPoolType, clusterName, name)
+	if err != nil {
+		return pools, err
+	}
+	for _, p := range nodePools {
+		pools = append(pools, &model.MasterPool{NodePool: *p})
+	}
+	return pools, nil
+}
+
+// GetComputePools returns a list of compute pools. Pools can be filtered by
+// their name / cluster.
+func (c *Cloud) GetComputePools(clusterName, name string) ([]*model.ComputePool, error) {
+	pools := []*model.ComputePool{}
+
+	nodePools, err := c.getNodePools(computePoolType, clusterName, name)
+	if err != nil {
+		return pools, err
+	}
+	for _, p := range nodePools {
+		pools = append(pools, &model.ComputePool{NodePool: *p})
+	}
+	return pools, nil
+}
+
+// getNodePools returns stored node pools of poolType with their size set to
+// the number of droplets. Pools can be filtered by their name / cluster.
+func (c *Cloud) getNodePools(poolType, clusterName, name string) ([]*model.NodePool, error) {
+	pools := []*model.NodePool{}
+
+	clusters, err := c.getClusterNames()
+	if err != nil {
+		return pools, err
+	}
+	for _, cl := range clusters {
+		if clusterName != "" && cl != clusterName {
+			continue
+		}
+		specs, err := c.getPoolSpecs(cl)
+		if err != nil {
+			return pools, err
+		}
+		for _, s := range specs {
+			if s.Type != poolType || (name != "" && s.Name != name) {
+				continue
+			}
+			droplets, err := c.listDropletsByTag(makePoolTag(s.ClusterName, s.Name))
+			if err != nil {
+				return pools, err
+			}
+			p := s.NodePool
+			p.Size = len(droplets)
+			pools = append(pools, &p)
+		}
+	}
+	return pools, nil
+}
+
+// listDropletsByTag returns all droplets with a given tag.
+func (c *Cloud) listDropletsByTag(tag string) ([]godo.Droplet, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	droplets := []godo.Droplet{}
+	opt := &godo.ListOptions{Page: 1, PerPage: 200}
+	for {
+		d, resp, err := c.droplets.ListByTag(ctx, tag, opt)
+		if err != nil {
+			return droplets, err
+		}
+		droplets = append(droplets, d...)
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			return droplets, nil
+		}
+		opt.Page++
+	}
+}
+
+// DescribeNodePool lists nodes pools.
+func (c *Cloud) DescribeNodePool() error {
+	return ErrNotImplemented
+}
+
+// UpgradeNodePool upgrades a node pool.
+func (c *Cloud) UpgradeNodePool() error {
+	return ErrNotImplemented
+}
+
+// DeleteMasterPool deletes a master node pool. Master floating IPs are kept
+// until the cluster is deleted.
+func (c *Cloud) DeleteMasterPool(clusterName string) error {
+	return c.deletePools(masterPoolType, clusterName, "")
+}
+
+// DeleteComputePool deletes a compute node pool. All compute pools of a
+// cluster are deleted if name is empty.
+func (c *Cloud) DeleteComputePool(clusterName, name string) error {
+	return c.deletePools(computePoolType, clusterName, name)
+}
+
+// deletePools deletes droplets and specs of poolType pools.
+func (c *Cloud) deletePools(poolType, clusterName, name string) error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	specs, err := c.getPoolSpecs(clusterName)
+	if err != nil {
+		return err
+	}
+	for _, s := range specs {
+		if s.Type != poolType || (name != "" && s.Name != name) {
+			continue
+		}
+		tag := makePoolTag(s.ClusterName, s.Name)
+		c.Logger.Printf("deleting droplets tagged %q", tag)
+		if _, err := c.droplets.DeleteByTag(ctx, tag); err != nil {
+			return err
+		}
+		if err := c.deleteObjects(makePoolSpecKey(s.ClusterName, s.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeAssetURLsFile returns a file of presigned URLs that masters download
+// cluster assets with. Droplet user data can be read by anything that runs on
+// a droplet, so it never holds the assets and the URLs expire shortly.
+func (c *Cloud) makeAssetURLsFile(clusterName string) (userdata.File, error) {
+	urls := make(map[string]string)
+	for _, name := range []string{etcdCACertObjectName, etcdCAKeyObjectName, kubeCACertObjectName, kubeCAKeyObjectName} {
+		u, err := c.presignObject(makeAssetKey(clusterName, name), assetURLExpiry)
+		if err != nil {
+			return userdata.File{}, err
+		}
+		urls[name] = u
+	}
+	b, err := json.Marshal(urls)
+	return userdata.File{Path: assetURLsPath, Content: b}, err
+}
+
+// makeNodeDataFile returns a node data file of a node pool.
+func makeNodeDataFile(p model.NodePool, kubeAPIURL string) (userdata.File, error) {
+	b, err := json.Marshal(model.NodeData{
+		KubeAPIURL:  kubeAPIURL,
+		ClusterName: p.ClusterName,
+		KubeVersion: p.KubeVersion,
+		Labels:      p.Labels,
+		KubeArgs:    kubeargs.ToKubeArgs(p.ExtraArgs),
+	})
+	return userdata.File{Path: nodeDataPath, Content: b}, err
+}
+
+// makeDropletName returns a droplet name of the n-th node in a pool.
+func makeDropletName(clusterName, poolName string, n int) string {
+	return fmt.Sprintf("%s-%s-%d", clusterName, poolName, n)
+}
+
+// stringInSlice returns true if s is in list.
+func stringInSlice(s string, list []string) bool {
+	for _, i := range list {
+		if s == i {
+			return true
+		}
+	}
+	return false
+}
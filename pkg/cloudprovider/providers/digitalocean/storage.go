@@ -0,0 +1,227 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package digitalocean
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/UKHomeOffice/keto/pkg/model"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// DigitalOcean has no way of attaching arbitrary metadata to droplets or load
+// balancers, so cluster and node pool specs are stored as objects in a
+// Spaces bucket, along with cluster assets:
+//
+//	<cluster>/cluster.json
+//	<cluster>/assets/<asset>
+//	<cluster>/pools/<pool>.json
+
+// poolSpec is a node pool spec stored in Spaces.
+type poolSpec struct {
+	model.NodePool
+	Type string `json:"type,omitempty"`
+}
+
+func makeClusterSpecKey(clusterName string) string {
+	return path.Join(clusterName, "cluster.json")
+}
+
+func makeAssetKey(clusterName, name string) string {
+	return path.Join(clusterName, "assets", name)
+}
+
+func makePoolSpecKey(clusterName, poolName string) string {
+	return path.Join(clusterName, "pools", poolName+".json")
+}
+
+// putClusterSpec stores a cluster spec.
+func (c *Cloud) putClusterSpec(spec clusterSpec) error {
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	return c.putObject(makeClusterSpecKey(spec.Name), b)
+}
+
+// getClusterSpec returns a stored spec of a given cluster.
+func (c *Cloud) getClusterSpec(clusterName string) (clusterSpec, error) {
+	var spec clusterSpec
+	b, err := c.getObject(makeClusterSpecKey(clusterName))
+	if err != nil {
+		return spec, fmt.Errorf("failed to get cluster %q spec: %v", clusterName, err)
+	}
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return spec, fmt.Errorf("failed to decode cluster %q spec: %v", clusterName, err)
+	}
+	return spec, nil
+}
+
+// getClusterNames returns a list of cluster names that have a spec stored.
+func (c *Cloud) getClusterNames() ([]string, error) {
+	names := []string{}
+	if c.config.SpacesBucket == "" {
+		return names, ErrNoBucket
+	}
+
+	params := &s3.ListObjectsInput{
+		Bucket:    aws.String(c.config.SpacesBucket),
+		Delimiter: aws.String("/"),
+	}
+	c.Logger.Printf("listing clusters in bucket %q", c.config.SpacesBucket)
+	err := c.s3.ListObjectsPages(params, func(page *s3.ListObjectsOutput, last bool) bool {
+		for _, p := range page.CommonPrefixes {
+			names = append(names, strings.TrimSuffix(aws.StringValue(p.Prefix), "/"))
+		}
+		return true
+	})
+	return names, err
+}
+
+// putPoolSpec stores a node pool spec.
+func (c *Cloud) putPoolSpec(spec poolSpec) error {
+	// User data is big and only needed at creation time.
+	spec.UserData = nil
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	return c.putObject(makePoolSpecKey(spec.ClusterName, spec.Name), b)
+}
+
+// getPoolSpecs returns stored node pool specs of a given cluster.
+func (c *Cloud) getPoolSpecs(clusterName string) ([]poolSpec, error) {
+	specs := []poolSpec{}
+
+	keys, err := c.listObjects(path.Join(clusterName, "pools") + "/")
+	if err != nil {
+		return specs, err
+	}
+	for _, k := range keys {
+		b, err := c.getObject(k)
+		if err != nil {
+			return specs, err
+		}
+		var spec poolSpec
+		if err := json.Unmarshal(b, &spec); err != nil {
+			return specs, fmt.Errorf("failed to decode pool spec %q: %v", k, err)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// putObject uploads b as an object key to the bucket.
+func (c *Cloud) putObject(key string, b []byte) error {
+	if c.config.SpacesBucket == "" {
+		return ErrNoBucket
+	}
+	c.Logger.Printf("uploading %q to bucket %q", key, c.config.SpacesBucket)
+	_, err := c.s3.PutObject(&s3.PutObjectInput{
+		Body:   bytes.NewReader(b),
+		Bucket: aws.String(c.config.SpacesBucket),
+		Key:    aws.String(key),
+		ACL:    aws.String(s3.ObjectCannedACLPrivate),
+	})
+	return err
+}
+
+// getObject returns an object key from the bucket.
+func (c *Cloud) getObject(key string) ([]byte, error) {
+	if c.config.SpacesBucket == "" {
+		return []byte{}, ErrNoBucket
+	}
+	c.Logger.Printf("fetching %q from bucket %q", key, c.config.SpacesBucket)
+	resp, err := c.s3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(c.config.SpacesBucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return []byte{}, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// presignObject returns a URL to get an object key from the bucket without
+// credentials, which expires after a given time.
+func (c *Cloud) presignObject(key string, expiry time.Duration) (string, error) {
+	if c.config.SpacesBucket == "" {
+		return "", ErrNoBucket
+	}
+	req, _ := c.s3.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(c.config.SpacesBucket),
+		Key:    aws.String(key),
+	})
+	return req.Presign(expiry)
+}
+
+// listObjects returns keys of objects with a given prefix.
+func (c *Cloud) listObjects(prefix string) ([]string, error) {
+	keys := []string{}
+	if c.config.SpacesBucket == "" {
+		return keys, ErrNoBucket
+	}
+	params := &s3.ListObjectsInput{
+		Bucket: aws.String(c.config.SpacesBucket),
+		Prefix: aws.String(prefix),
+	}
+	err := c.s3.ListObjectsPages(params, func(page *s3.ListObjectsOutput, last bool) bool {
+		for _, o := range page.Contents {
+			keys = append(keys, aws.StringValue(o.Key))
+		}
+		return true
+	})
+	return keys, err
+}
+
+// deleteObjects deletes given object keys from the bucket.
+func (c *Cloud) deleteObjects(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	objects := []*s3.ObjectIdentifier{}
+	for _, k := range keys {
+		objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(k)})
+	}
+	c.Logger.Printf("deleting objects %v from bucket %q", keys, c.config.SpacesBucket)
+	_, err := c.s3.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(c.config.SpacesBucket),
+		Delete: &s3.Delete{
+			Objects: objects,
+			Quiet:   aws.Bool(true),
+		},
+	})
+	return err
+}
+
+// deleteClusterObjects deletes all objects of a given cluster.
+func (c *Cloud) deleteClusterObjects(clusterName string) error {
+	keys, err := c.listObjects(clusterName + "/")
+	if err != nil {
+		return err
+	}
+	return c.deleteObjects(keys...)
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirt
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Nodes get their cloud-config, node data and, on masters, assets from an
+// OpenStack style config drive, an ISO labeled config-2, which CoreOS mounts
+// at /media/configdrive:
+//
+//	openstack/latest/user_data
+//	openstack/latest/meta_data.json
+//	keto/node-data.json
+//	keto/assets/<asset>
+const (
+	configDriveLabel    = "config-2"
+	userDataPath        = "openstack/latest/user_data"
+	metaDataPath        = "openstack/latest/meta_data.json"
+	nodeDataPath        = "keto/node-data.json"
+	configDriveAssetDir = "keto/assets"
+)
+
+// isoTool is the command used to build config drive images, mkisofs takes
+// the same arguments.
+var isoTool = "genisoimage"
+
+// metaData is an OpenStack config drive meta data document, of which CoreOS
+// uses the hostname and public keys.
+type metaData struct {
+	UUID       string            `json:"uuid"`
+	Hostname   string            `json:"hostname"`
+	PublicKeys map[string]string `json:"public_keys,omitempty"`
+}
+
+// makeConfigDriveFiles returns config drive files keyed by their path.
+func makeConfigDriveFiles(hostname, sshKey string, userData, nodeData []byte, assets map[string][]byte) (map[string][]byte, error) {
+	md := metaData{UUID: hostname, Hostname: hostname}
+	if sshKey != "" {
+		md.PublicKeys = map[string]string{"keto": sshKey}
+	}
+	b, err := json.Marshal(md)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{
+		userDataPath: userData,
+		metaDataPath: b,
+		nodeDataPath: nodeData,
+	}
+	for name, a := range assets {
+		files[filepath.Join(configDriveAssetDir, name)] = a
+	}
+	return files, nil
+}
+
+// buildConfigDrive writes files to a temporary directory and builds a config
+// drive image of it. The returned cleanup func removes the image.
+func buildConfigDrive(ctx context.Context, files map[string][]byte) (string, func(), error) {
+	dir, err := ioutil.TempDir("", "keto-configdrive")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	root := filepath.Join(dir, "root")
+	for p, b := range files {
+		p = filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		if err := ioutil.WriteFile(p, b, 0600); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+	}
+
+	iso := filepath.Join(dir, "config.iso")
+	if _, err := runCommand(ctx, isoTool, "-output", iso, "-volid", configDriveLabel, "-joliet", "-rock", "-quiet", root); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return iso, cleanup, nil
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// metadataNamespace is the XML namespace of keto domain metadata.
+const metadataNamespace = "https://github.com/UKHomeOffice/keto"
+
+// domain is a subset of the libvirt domain XML format that keto uses, see
+// https://libvirt.org/formatdomain.html.
+type domain struct {
+	XMLName  xml.Name        `xml:"domain"`
+	Type     string          `xml:"type,attr"`
+	Name     string          `xml:"name"`
+	Memory   domainMemory    `xml:"memory"`
+	VCPU     int             `xml:"vcpu"`
+	Metadata *domainMetadata `xml:"metadata"`
+	OS       domainOS        `xml:"os"`
+	Features domainFeatures  `xml:"features"`
+	Devices  domainDevices   `xml:"devices"`
+}
+
+type domainMemory struct {
+	Unit  string `xml:"unit,attr"`
+	Value int64  `xml:",chardata"`
+}
+
+type domainMetadata struct {
+	Node *nodeMetadata
+}
+
+// nodeMetadata is keto metadata attached to every domain it creates. It
+// holds the node pool spec as JSON, as there is nowhere else to store it.
+type nodeMetadata struct {
+	XMLName     xml.Name `xml:"https://github.com/UKHomeOffice/keto node"`
+	ClusterName string   `xml:"cluster"`
+	PoolName    string   `xml:"pool"`
+	PoolType    string   `xml:"type"`
+	PoolSpec    string   `xml:"spec"`
+}
+
+type domainOS struct {
+	Type domainOSType `xml:"type"`
+}
+
+type domainOSType struct {
+	Arch  string `xml:"arch,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+type domainFeatures struct {
+	ACPI *struct{} `xml:"acpi"`
+	APIC *struct{} `xml:"apic"`
+}
+
+type domainDevices struct {
+	Disks      []domainDisk      `xml:"disk"`
+	Interfaces []domainInterface `xml:"interface"`
+	Consoles   []domainConsole   `xml:"console"`
+}
+
+type domainDisk struct {
+	Type     string           `xml:"type,attr"`
+	Device   string           `xml:"device,attr"`
+	Driver   domainDiskDriver `xml:"driver"`
+	Source   domainDiskSource `xml:"source"`
+	Target   domainDiskTarget `xml:"target"`
+	ReadOnly *struct{}        `xml:"readonly"`
+}
+
+type domainDiskDriver struct {
+	Name string `xml:"name,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type domainDiskSource struct {
+	Pool   string `xml:"pool,attr"`
+	Volume string `xml:"volume,attr"`
+}
+
+type domainDiskTarget struct {
+	Dev string `xml:"dev,attr"`
+	Bus string `xml:"bus,attr"`
+}
+
+type domainInterface struct {
+	Type   string                `xml:"type,attr"`
+	MAC    *domainInterfaceMAC   `xml:"mac"`
+	Source domainInterfaceSource `xml:"source"`
+	Model  domainInterfaceModel  `xml:"model"`
+}
+
+type domainInterfaceMAC struct {
+	Address string `xml:"address,attr"`
+}
+
+type domainInterfaceSource struct {
+	Network string `xml:"network,attr"`
+}
+
+type domainInterfaceModel struct {
+	Type string `xml:"type,attr"`
+}
+
+type domainConsole struct {
+	Type string `xml:"type,attr"`
+}
+
+// domainParams are parameters of a single node domain.
+type domainParams struct {
+	Name        string
+	Type        string
+	VCPUs       int
+	MemoryMiB   int64
+	StoragePool string
+	DiskVolume  string
+	ISOVolume   string
+	// Networks are the networks to attach the domain to. MAC, if set, is used
+	// for the first network interface.
+	Networks []string
+	MAC      string
+	Metadata nodeMetadata
+}
+
+// makeDomain returns a domain definition of a node. Nodes boot from a copy
+// on write disk of the CoreOS image and get their cloud-config from
+// a config drive.
+func makeDomain(p domainParams) domain {
+	d := domain{
+		Type:     p.Type,
+		Name:     p.Name,
+		Memory:   domainMemory{Unit: "MiB", Value: p.MemoryMiB},
+		VCPU:     p.VCPUs,
+		Metadata: &domainMetadata{Node: &p.Metadata},
+		OS:       domainOS{Type: domainOSType{Arch: "x86_64", Value: "hvm"}},
+		Features: domainFeatures{ACPI: &struct{}{}, APIC: &struct{}{}},
+		Devices: domainDevices{
+			Disks: []domainDisk{
+				{
+					Type:   "volume",
+					Device: "disk",
+					Driver: domainDiskDriver{Name: "qemu", Type: "qcow2"},
+					Source: domainDiskSource{Pool: p.StoragePool, Volume: p.DiskVolume},
+					Target: domainDiskTarget{Dev: "vda", Bus: "virtio"},
+				},
+				{
+					Type:     "volume",
+					Device:   "cdrom",
+					Driver:   domainDiskDriver{Name: "qemu", Type: "raw"},
+					Source:   domainDiskSource{Pool: p.StoragePool, Volume: p.ISOVolume},
+					Target:   domainDiskTarget{Dev: "hdc", Bus: "ide"},
+					ReadOnly: &struct{}{},
+				},
+			},
+			Consoles: []domainConsole{{Type: "pty"}},
+		},
+	}
+	for i, n := range p.Networks {
+		iface := domainInterface{
+			Type:   "network",
+			Source: domainInterfaceSource{Network: n},
+			Model:  domainInterfaceModel{Type: "virtio"},
+		}
+		if i == 0 && p.MAC != "" {
+			iface.MAC = &domainInterfaceMAC{Address: p.MAC}
+		}
+		d.Devices.Interfaces = append(d.Devices.Interfaces, iface)
+	}
+	return d
+}
+
+// parseMachineType parses a machine type in <vCPUs>x<memory GB> format and
+// returns the number of vCPUs and memory size in MiB.
+func parseMachineType(t string) (int, int64, error) {
+	s := strings.Split(strings.ToLower(t), "x")
+	if len(s) != 2 {
+		return 0, 0, fmt.Errorf("invalid machine type %q, must be in <vCPUs>x<memory GB> format", t)
+	}
+	cpus, err := strconv.Atoi(s[0])
+	if err != nil || cpus < 1 {
+		return 0, 0, fmt.Errorf("invalid number of vCPUs in machine type %q", t)
+	}
+	mem, err := strconv.Atoi(s[1])
+	if err != nil || mem < 1 {
+		return 0, 0, fmt.Errorf("invalid memory size in machine type %q", t)
+	}
+	return cpus, int64(mem) * 1024, nil
+}
+
+// makeDomainName returns a domain name of the n-th node in a pool. Domains
+// are prefixed, as a libvirt host is likely to run other domains too.
+func makeDomainName(clusterName, poolName string, n int) string {
+	return fmt.Sprintf("keto-%s-%s-%d", clusterName, poolName, n)
+}
+
+// makeDiskVolumeName returns a boot disk volume name of a domain.
+func makeDiskVolumeName(domainName string) string {
+	return domainName + ".qcow2"
+}
+
+// makeISOVolumeName returns a config drive volume name of a domain.
+func makeISOVolumeName(domainName string) string {
+	return domainName + "-config.iso"
+}
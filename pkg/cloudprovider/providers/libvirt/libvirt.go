@@ -0,0 +1,522 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UKHomeOffice/keto/pkg/cloudprovider"
+	"github.com/UKHomeOffice/keto/pkg/model"
+)
+
+const (
+	// ProviderName is the name of this provider.
+	ProviderName = "libvirt"
+
+	// Environment variables used to configure the provider.
+	uriEnv         = "LIBVIRT_URI"
+	domainTypeEnv  = "LIBVIRT_DOMAIN_TYPE"
+	poolEnv        = "LIBVIRT_POOL"
+	networkEnv     = "LIBVIRT_NETWORK"
+	masterIPsEnv   = "LIBVIRT_MASTER_IPS"
+	kubeAPIHostEnv = "LIBVIRT_KUBE_API_HOST"
+	stateDirEnv    = "LIBVIRT_STATE_DIR"
+
+	defaultURI        = "qemu:///system"
+	defaultDomainType = "kvm"
+	defaultPool       = "default"
+	defaultNetwork    = "default"
+
+	clusterSpecFileName = "cluster.json"
+	assetsDirName       = "assets"
+
+	etcdCACertFileName = "etcd_ca.crt"
+	etcdCAKeyFileName  = "etcd_ca.key"
+	kubeCACertFileName = "kube_ca.crt"
+	kubeCAKeyFileName  = "kube_ca.key"
+)
+
+var (
+	// ErrNotImplemented defines an error for not implemented features.
+	ErrNotImplemented = errors.New("not implemented")
+	// ErrRetainNotSupported defines an error when resources are requested to
+	// be retained on cluster deletion. There are no separate volume, DNS or
+	// load balancer resources in libvirt to retain.
+	ErrRetainNotSupported = errors.New("retaining resources is not supported by libvirt")
+
+	// defaultMasterIPs are within the DHCP range of the default libvirt
+	// network, so that a cluster can be created without any configuration.
+	defaultMasterIPs = []string{"192.168.122.11", "192.168.122.12", "192.168.122.13"}
+)
+
+// config represents libvirt provider configuration.
+type config struct {
+	URI         string
+	DomainType  string
+	Pool        string
+	Network     string
+	MasterIPs   []string
+	KubeAPIHost string
+	StateDir    string
+}
+
+// configFromEnv returns a config populated from environment variables, with
+// defaults that work with a stock local libvirt install.
+func configFromEnv() config {
+	cfg := config{
+		URI:         os.Getenv(uriEnv),
+		DomainType:  os.Getenv(domainTypeEnv),
+		Pool:        os.Getenv(poolEnv),
+		Network:     os.Getenv(networkEnv),
+		KubeAPIHost: os.Getenv(kubeAPIHostEnv),
+		StateDir:    os.Getenv(stateDirEnv),
+	}
+	if cfg.URI == "" {
+		cfg.URI = defaultURI
+	}
+	if cfg.DomainType == "" {
+		cfg.DomainType = defaultDomainType
+	}
+	if cfg.Pool == "" {
+		cfg.Pool = defaultPool
+	}
+	if cfg.Network == "" {
+		cfg.Network = defaultNetwork
+	}
+	for _, ip := range strings.Split(os.Getenv(masterIPsEnv), ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			cfg.MasterIPs = append(cfg.MasterIPs, ip)
+		}
+	}
+	if len(cfg.MasterIPs) == 0 {
+		cfg.MasterIPs = defaultMasterIPs
+	}
+	if cfg.StateDir == "" && os.Getenv("HOME") != "" {
+		cfg.StateDir = filepath.Join(os.Getenv("HOME"), ".keto", "libvirt")
+	}
+	return cfg
+}
+
+// clusterSpec is a cluster spec stored in the state directory. Master IPs
+// and the network are stored, so that a cluster keeps working if the
+// configuration changes afterwards.
+type clusterSpec struct {
+	model.Cluster
+	MasterIPs []string `json:"master_ips,omitempty"`
+	Network   string   `json:"network,omitempty"`
+}
+
+// runCommand runs a command and returns its output. It is a variable so that
+// it can be replaced in tests.
+var runCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// Cloud is an implementation of cloudprovider.Interface.
+type Cloud struct {
+	Logger cloudprovider.Logger
+	config config
+	cache  cloudprovider.Cache
+
+	// requestTimeout limits how long a single virsh call may take.
+	requestTimeout time.Duration
+	// operationTimeout limits how long to wait for a provider operation.
+	operationTimeout time.Duration
+}
+
+// Compile-time check whether Cloud type value implements
+// cloudprovider.Interface interface.
+var _ cloudprovider.Interface = (*Cloud)(nil)
+
+// ProviderName returns the cloud provider ID.
+func (c *Cloud) ProviderName() string {
+	return ProviderName
+}
+
+// Clusters returns an implementation of Clusters interface for libvirt Cloud.
+func (c *Cloud) Clusters() (cloudprovider.Clusters, bool) {
+	return c, true
+}
+
+// Events returns an implementation of Events interface for libvirt Cloud.
+// Events are not supported.
+func (c *Cloud) Events() (cloudprovider.Events, bool) {
+	return nil, false
+}
+
+// Drift returns an implementation of Drift interface for libvirt Cloud. Drift
+// is not supported.
+func (c *Cloud) Drift() (cloudprovider.Drift, bool) {
+	return nil, false
+}
+
+// Capabilities returns optional features supported by libvirt Cloud. The kube
+// API is served by master IPs, there is no load balancer.
+func (c *Cloud) Capabilities() cloudprovider.Capabilities {
+	return cloudprovider.Capabilities{
+		NodePoolFields: cloudprovider.AllNodePoolFields,
+	}
+}
+
+// CreateClusterInfra reserves master IPs in the libvirt network and stores
+// the cluster spec in the state directory. The spec is only stored once all
+// IPs are reserved, reservations are released if that fails.
+func (c *Cloud) CreateClusterInfra(cluster model.Cluster) error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	if _, err := os.Stat(c.clusterDir(cluster.Name)); err == nil {
+		return fmt.Errorf("cluster %q already exists in %q", cluster.Name, c.config.StateDir)
+	}
+	if err := c.checkMasterIPs(c.config.Network, c.config.MasterIPs); err != nil {
+		return err
+	}
+
+	// Node pools are stored separately, as domain metadata.
+	cluster.MasterPool = model.MasterPool{}
+	cluster.ComputePools = nil
+	spec := clusterSpec{
+		Cluster:   cluster,
+		MasterIPs: c.config.MasterIPs,
+		Network:   c.config.Network,
+	}
+
+	for i, ip := range spec.MasterIPs {
+		host := makeDHCPHost(cluster.Name, i, ip)
+		c.Logger.Printf("reserving IP %q in network %q", ip, spec.Network)
+		if _, err := c.virsh(ctx, "net-update", spec.Network, "add-last", "ip-dhcp-host", host, "--live", "--config"); err != nil {
+			c.releaseMasterIPs(ctx, cluster.Name, spec.Network, spec.MasterIPs[:i])
+			return err
+		}
+	}
+	if err := c.putClusterSpec(spec); err != nil {
+		c.releaseMasterIPs(ctx, cluster.Name, spec.Network, spec.MasterIPs)
+		os.RemoveAll(c.clusterDir(cluster.Name))
+		return err
+	}
+	return nil
+}
+
+// checkMasterIPs returns an error if any of the master IPs is reserved by
+// another cluster in the same network.
+func (c *Cloud) checkMasterIPs(network string, ips []string) error {
+	names, err := c.getClusterNames()
+	if err != nil {
+		return err
+	}
+	used := make(map[string]string)
+	for _, n := range names {
+		spec, err := c.getClusterSpec(n)
+		if err != nil {
+			return err
+		}
+		if spec.Network != network {
+			continue
+		}
+		for _, ip := range spec.MasterIPs {
+			used[ip] = n
+		}
+	}
+	for _, ip := range ips {
+		if name, ok := used[ip]; ok {
+			return fmt.Errorf("IP %q is already reserved by cluster %q, %s must be set to free IPs", ip, name, masterIPsEnv)
+		}
+	}
+	return nil
+}
+
+// releaseMasterIPs releases master IPs of a cluster that failed to be created,
+// failures are only logged, as the creation error is what gets returned.
+func (c *Cloud) releaseMasterIPs(ctx context.Context, clusterName, network string, ips []string) {
+	for i, ip := range ips {
+		host := makeDHCPHost(clusterName, i, ip)
+		c.Logger.Printf("releasing IP %q in network %q", ip, network)
+		if _, err := c.virsh(ctx, "net-update", network, "delete", "ip-dhcp-host", host, "--live", "--config"); err != nil {
+			c.Logger.Printf("failed to release IP %q: %v", ip, err)
+		}
+	}
+}
+
+// GetClusters returns a cluster by name or all clusters in the state
+// directory.
+func (c *Cloud) GetClusters(name string) ([]*model.Cluster, error) {
+	clusters := []*model.Cluster{}
+
+	names, err := c.getClusterNames()
+	if err != nil {
+		return clusters, err
+	}
+	for _, n := range names {
+		if name != "" && n != name {
+			continue
+		}
+		spec, err := c.getClusterSpec(n)
+		if err != nil {
+			return clusters, err
+		}
+		cluster := spec.Cluster
+		cluster.KubeAPIURL = c.kubeAPIURL(spec)
+		clusters = append(clusters, &cluster)
+	}
+	return clusters, nil
+}
+
+// getClusterNames returns names of clusters that have a spec stored.
+func (c *Cloud) getClusterNames() ([]string, error) {
+	names := []string{}
+
+	files, err := ioutil.ReadDir(c.config.StateDir)
+	if os.IsNotExist(err) {
+		return names, nil
+	}
+	if err != nil {
+		return names, err
+	}
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(c.config.StateDir, f.Name(), clusterSpecFileName)); err == nil {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// DescribeCluster describes a given cluster.
+func (c *Cloud) DescribeCluster(name string) error {
+	return ErrNotImplemented
+}
+
+// DeleteCluster deletes a cluster's node pools, IP reservations and its
+// state directory.
+func (c *Cloud) DeleteCluster(name string, retain []string) ([]*model.Resource, error) {
+	retained := []*model.Resource{}
+	if len(retain) > 0 {
+		return retained, ErrRetainNotSupported
+	}
+
+	spec, err := c.getClusterSpec(name)
+	if err != nil {
+		return retained, err
+	}
+
+	c.Logger.Printf("deleting compute pools that belong to cluster %q", name)
+	if err := c.DeleteComputePool(name, ""); err != nil {
+		return retained, err
+	}
+	c.Logger.Printf("deleting master pool that belongs to cluster %q", name)
+	if err := c.DeleteMasterPool(name); err != nil {
+		return retained, err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	for i, ip := range spec.MasterIPs {
+		host := makeDHCPHost(name, i, ip)
+		c.Logger.Printf("releasing IP %q in network %q", ip, spec.Network)
+		if _, err := c.virsh(ctx, "net-update", spec.Network, "delete", "ip-dhcp-host", host, "--live", "--config"); err != nil {
+			return retained, err
+		}
+	}
+
+	c.Logger.Printf("deleting state directory %q", c.clusterDir(name))
+	return retained, os.RemoveAll(c.clusterDir(name))
+}
+
+// GetMasterPersistentIPs returns a map of master node IDs to their reserved
+// IPs.
+func (c *Cloud) GetMasterPersistentIPs(clusterName string) (map[string]string, error) {
+	m := make(map[string]string)
+	spec, err := c.getClusterSpec(clusterName)
+	if err != nil {
+		return m, err
+	}
+	for i, ip := range spec.MasterIPs {
+		m[strconv.Itoa(i)] = ip
+	}
+	return m, nil
+}
+
+// PushAssets stores assets in the cluster state directory. They are written
+// to master config drives when masters are created.
+func (c *Cloud) PushAssets(clusterName string, a model.Assets) error {
+	dir := filepath.Join(c.clusterDir(clusterName), assetsDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for name, b := range map[string][]byte{
+		etcdCACertFileName: a.EtcdCACert,
+		etcdCAKeyFileName:  a.EtcdCAKey,
+		kubeCACertFileName: a.KubeCACert,
+		kubeCAKeyFileName:  a.KubeCAKey,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getAssetFiles returns stored assets of a given cluster keyed by file name.
+func (c *Cloud) getAssetFiles(clusterName string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	dir := filepath.Join(c.clusterDir(clusterName), assetsDirName)
+	for _, name := range []string{etcdCACertFileName, etcdCAKeyFileName, kubeCACertFileName, kubeCAKeyFileName} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return files, err
+		}
+		files[name] = b
+	}
+	return files, nil
+}
+
+// putClusterSpec stores a cluster spec in the state directory.
+func (c *Cloud) putClusterSpec(spec clusterSpec) error {
+	if c.config.StateDir == "" {
+		return fmt.Errorf("state directory is unknown, %s must be set", stateDirEnv)
+	}
+	if err := os.MkdirAll(c.clusterDir(spec.Name), 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(c.clusterDir(spec.Name), clusterSpecFileName), b, 0600)
+}
+
+// getClusterSpec returns a stored spec of a given cluster.
+func (c *Cloud) getClusterSpec(clusterName string) (clusterSpec, error) {
+	var spec clusterSpec
+	b, err := ioutil.ReadFile(filepath.Join(c.clusterDir(clusterName), clusterSpecFileName))
+	if err != nil {
+		return spec, fmt.Errorf("failed to get cluster %q spec: %v", clusterName, err)
+	}
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return spec, fmt.Errorf("failed to decode cluster %q spec: %v", clusterName, err)
+	}
+	return spec, nil
+}
+
+// clusterDir returns a state directory of a given cluster.
+func (c *Cloud) clusterDir(clusterName string) string {
+	return filepath.Join(c.config.StateDir, clusterName)
+}
+
+// kubeAPIURL returns a Kubernetes API URL. There is no load balancer, so
+// unless an API host is configured, the first master is used.
+func (c *Cloud) kubeAPIURL(spec clusterSpec) string {
+	host := c.config.KubeAPIHost
+	if host == "" && len(spec.MasterIPs) > 0 {
+		host = spec.MasterIPs[0]
+	}
+	if host == "" {
+		return ""
+	}
+	return "https://" + strings.ToLower(host)
+}
+
+// virsh runs a virsh command against the configured libvirt URI. Each call
+// is limited by requestTimeout.
+func (c *Cloud) virsh(ctx context.Context, args ...string) ([]byte, error) {
+	if c.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.requestTimeout)
+		defer cancel()
+	}
+	return runCommand(ctx, "virsh", append([]string{"--connect", c.config.URI}, args...)...)
+}
+
+// virshCached runs a read-only virsh command, whose output is cached under a
+// key made of the connection URI and args.
+func (c *Cloud) virshCached(ctx context.Context, args ...string) ([]byte, error) {
+	var out []byte
+	key := fmt.Sprintf("%s/%s/%s", ProviderName, c.config.URI, strings.Join(args, "/"))
+	if cloudprovider.GetCached(c.cache, c.Logger, key, &out) {
+		return out, nil
+	}
+
+	out, err := c.virsh(ctx, args...)
+	if err != nil {
+		return out, err
+	}
+	cloudprovider.SetCached(c.cache, c.Logger, key, out)
+	return out, nil
+}
+
+// context returns a context for a single provider operation, it is cancelled
+// once operationTimeout passes.
+func (c *Cloud) context() (context.Context, context.CancelFunc) {
+	if c.operationTimeout > 0 {
+		return context.WithTimeout(context.Background(), c.operationTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// makeMasterMAC returns a MAC address of the n-th master of a cluster. It is
+// derived from the cluster name, so that a DHCP reservation can be made
+// before the master exists.
+func makeMasterMAC(clusterName string, n int) string {
+	h := sha1.Sum([]byte(clusterName + "/" + strconv.Itoa(n)))
+	// 52:54:00 is the prefix used by QEMU / KVM.
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", h[0], h[1], h[2])
+}
+
+// makeDHCPHost returns a libvirt network DHCP host entry of the n-th master
+// of a cluster.
+func makeDHCPHost(clusterName string, n int, ip string) string {
+	return fmt.Sprintf("<host mac='%s' ip='%s'/>", makeMasterMAC(clusterName, n), ip)
+}
+
+// init registers libvirt cloud with the cloudprovider.
+func init() {
+	// f knows how to initialize the cloud
+	f := func(l cloudprovider.Logger, cfg cloudprovider.Config) (cloudprovider.Interface, error) {
+		return &Cloud{
+			Logger:           l,
+			config:           configFromEnv(),
+			cache:            cfg.Cache,
+			requestTimeout:   cfg.RequestTimeout,
+			operationTimeout: cfg.OperationTimeout,
+		}, nil
+	}
+	cloudprovider.Register(ProviderName, f)
+}
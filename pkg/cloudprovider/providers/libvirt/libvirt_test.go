@@ -0,0 +1,375 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirt
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/UKHomeOffice/keto/pkg/cache"
+	"github.com/UKHomeOffice/keto/pkg/model"
+	"github.com/UKHomeOffice/keto/pkg/userdata"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	for _, e := range []string{uriEnv, poolEnv, networkEnv, masterIPsEnv, stateDirEnv} {
+		defer os.Setenv(e, os.Getenv(e))
+		os.Unsetenv(e)
+	}
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", "/home/keto")
+
+	cfg := configFromEnv()
+	want := config{
+		URI:        defaultURI,
+		DomainType: defaultDomainType,
+		Pool:       defaultPool,
+		Network:    defaultNetwork,
+		MasterIPs:  defaultMasterIPs,
+		StateDir:   "/home/keto/.keto/libvirt",
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %+v; want %+v", cfg, want)
+	}
+
+	os.Setenv(masterIPsEnv, "10.0.0.1, 10.0.0.2")
+	if cfg := configFromEnv(); !reflect.DeepEqual(cfg.MasterIPs, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("got master IPs %v", cfg.MasterIPs)
+	}
+}
+
+func TestMakeMasterMAC(t *testing.T) {
+	mac := makeMasterMAC("foo", 0)
+	if !strings.HasPrefix(mac, "52:54:00:") || len(mac) != 17 {
+		t.Errorf("invalid MAC %q", mac)
+	}
+	if mac != makeMasterMAC("foo", 0) {
+		t.Error("MAC is not stable")
+	}
+	if mac == makeMasterMAC("foo", 1) || mac == makeMasterMAC("bar", 0) {
+		t.Error("MACs are not unique")
+	}
+}
+
+func TestDomainMetadata(t *testing.T) {
+	md := nodeMetadata{ClusterName: "foo", PoolName: "compute", PoolType: computePoolType, PoolSpec: "{}"}
+	x, err := xml.Marshal(makeDomain(domainParams{Name: "keto-foo-compute-0", Networks: []string{"default"}, Metadata: md}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d domain
+	if err := xml.Unmarshal(x, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Metadata == nil || d.Metadata.Node == nil {
+		t.Fatalf("metadata not found in %s", x)
+	}
+	got := *d.Metadata.Node
+	got.XMLName = xml.Name{}
+	if !reflect.DeepEqual(got, md) {
+		t.Errorf("got %+v; want %+v", got, md)
+	}
+
+	// libvirt uses a namespace prefix when dumping metadata.
+	x = []byte(`<domain type="kvm"><name>keto-foo-compute-0</name><metadata>` +
+		`<keto:node xmlns:keto="` + metadataNamespace + `"><keto:cluster>foo</keto:cluster>` +
+		`<keto:pool>compute</keto:pool></keto:node></metadata></domain>`)
+	d = domain{}
+	if err := xml.Unmarshal(x, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Metadata == nil || d.Metadata.Node == nil || d.Metadata.Node.PoolName != "compute" {
+		t.Errorf("failed to decode prefixed metadata, got %+v", d.Metadata)
+	}
+}
+
+func TestGetComputePools(t *testing.T) {
+	spec, err := json.Marshal(model.NodePool{
+		ResourceMeta: model.ResourceMeta{Name: "compute", ClusterName: "foo"},
+		NodePoolSpec: model.NodePoolSpec{MachineType: "2x4"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	domains := map[string]nodeMetadata{
+		"keto-foo-compute-0": {ClusterName: "foo", PoolName: "compute", PoolType: computePoolType, PoolSpec: string(spec)},
+		"keto-foo-compute-1": {ClusterName: "foo", PoolName: "compute", PoolType: computePoolType, PoolSpec: string(spec)},
+		"keto-foo-master-0":  {ClusterName: "foo", PoolName: "master", PoolType: masterPoolType, PoolSpec: "{}"},
+	}
+
+	defer func(f func(context.Context, string, ...string) ([]byte, error)) { runCommand = f }(runCommand)
+	runCommand = func(_ context.Context, name string, args ...string) ([]byte, error) {
+		switch args[2] {
+		case "list":
+			return []byte("keto-foo-compute-0\nketo-foo-compute-1\nketo-foo-master-0\nsomething-else\n\n"), nil
+		case "dumpxml":
+			md, ok := domains[args[4]]
+			if !ok {
+				return nil, fmt.Errorf("unexpected domain %q", args[4])
+			}
+			return xml.Marshal(makeDomain(domainParams{Name: args[4], Metadata: md}))
+		}
+		return nil, fmt.Errorf("unexpected command %v", args)
+	}
+
+	c := &Cloud{Logger: log.New(ioutil.Discard, "", 0), config: config{URI: defaultURI}}
+	pools, err := c.GetComputePools("foo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 1 {
+		t.Fatalf("got %d pools; want 1", len(pools))
+	}
+	if pools[0].Name != "compute" || pools[0].Size != 2 || pools[0].MachineType != "2x4" {
+		t.Errorf("got unexpected pool %+v", pools[0])
+	}
+}
+
+func TestValidateNodePoolCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keto-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	calls := map[string]int{}
+	defer func(f func(context.Context, string, ...string) ([]byte, error)) { runCommand = f }(runCommand)
+	runCommand = func(_ context.Context, name string, args ...string) ([]byte, error) {
+		calls[args[2]]++
+		switch args[2] {
+		case "vol-path":
+			return []byte("/var/lib/libvirt/images/coreos.img\n"), nil
+		case "net-uuid":
+			if args[3] != "default" {
+				return nil, errors.New("network not found")
+			}
+			return []byte("4ea0b9bb-7e4e-4b8d-9d39-1f6d7e9a5d6b\n"), nil
+		}
+		return nil, fmt.Errorf("unexpected command %v", args)
+	}
+
+	c := &Cloud{
+		Logger: log.New(ioutil.Discard, "", 0),
+		config: config{URI: defaultURI, Pool: "default", Network: "default"},
+		cache:  cache.New(dir, time.Hour),
+	}
+	p := model.NodePool{NodePoolSpec: model.NodePoolSpec{MachineType: "2x4", CoreOSVersion: "coreos.img"}}
+	// The second validation is served from the cache.
+	for i := 0; i < 2; i++ {
+		if err := c.ValidateNodePool(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls["vol-path"] != 1 || calls["net-uuid"] != 1 {
+		t.Errorf("got virsh calls %v; want one of each", calls)
+	}
+
+	p.Networks = []string{"missing"}
+	if err := c.ValidateNodePool(p); err == nil {
+		t.Error("expected an error for a network that does not exist")
+	}
+}
+
+func TestGetNodeData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keto-libvirt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { configDriveDir = d }(configDriveDir)
+	configDriveDir = dir
+
+	want := model.NodeData{
+		KubeAPIURL:  "https://192.168.122.11",
+		ClusterName: "foo",
+		KubeVersion: "v1.6.4",
+		Labels:      model.Labels{"env": "dev"},
+	}
+	b, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := makeConfigDriveFiles("keto-foo-compute-0", "", []byte("#cloud-config"), b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, b := range files {
+		p = filepath.Join(dir, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := Cloud{}.GetNodeData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("got %+v; want %+v", data, want)
+	}
+}
+
+func TestClusterDNSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keto-libvirt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(f func(context.Context, string, ...string) ([]byte, error)) { runCommand = f }(runCommand)
+	runCommand = func(context.Context, string, ...string) ([]byte, error) {
+		return nil, nil
+	}
+
+	c := &Cloud{
+		Logger: log.New(ioutil.Discard, "", 0),
+		config: config{URI: defaultURI, StateDir: dir, Network: "default", MasterIPs: []string{"192.168.122.11"}},
+	}
+	dns := model.DNSConfig{Provider: "kube-dns", UpstreamNameservers: []string{"10.0.0.2"}}
+	if err := c.CreateClusterInfra(model.Cluster{ResourceMeta: model.ResourceMeta{Name: "foo"}, DNS: dns}); err != nil {
+		t.Fatal(err)
+	}
+
+	clusters, err := c.GetClusters("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 1 || !reflect.DeepEqual(clusters[0].DNS, dns) {
+		t.Errorf("got clusters %+v; want DNS config %+v", clusters, dns)
+	}
+}
+
+func TestCreateMasterPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keto-libvirt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// User data of each master is read from its config drive.
+	userData := []string{}
+	defer func(f func(context.Context, string, ...string) ([]byte, error)) { runCommand = f }(runCommand)
+	runCommand = func(_ context.Context, name string, args ...string) ([]byte, error) {
+		if name != isoTool {
+			return nil, nil
+		}
+		b, err := ioutil.ReadFile(filepath.Join(args[len(args)-1], userDataPath))
+		if err != nil {
+			return nil, err
+		}
+		userData = append(userData, string(b))
+		return nil, ioutil.WriteFile(args[1], nil, 0600)
+	}
+
+	c := &Cloud{
+		Logger: log.New(ioutil.Discard, "", 0),
+		config: config{URI: defaultURI, StateDir: dir, Network: "default", MasterIPs: []string{"192.168.122.11", "192.168.122.12"}},
+	}
+	if err := c.CreateClusterInfra(model.Cluster{ResourceMeta: model.ResourceMeta{Name: "foo"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PushAssets("foo", model.Assets{}); err != nil {
+		t.Fatal(err)
+	}
+
+	p := model.MasterPool{NodePool: model.NodePool{
+		ResourceMeta: model.ResourceMeta{Name: "master", ClusterName: "foo"},
+		NodePoolSpec: model.NodePoolSpec{MachineType: "2x4"},
+	}}
+	p.UserData = []byte("#cloud-config\nwrite_files:\n")
+	if err := c.CreateMasterPool(p); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(userData) != len(c.config.MasterIPs) {
+		t.Fatalf("got %d config drives; want one per master", len(userData))
+	}
+	for i, ip := range c.config.MasterIPs {
+		env := userdata.MasterEnvFile(strconv.Itoa(i), ip)
+		if !strings.Contains(userData[i], base64.StdEncoding.EncodeToString(env.Content)) {
+			t.Errorf("master %d user data has no master environment file", i)
+		}
+	}
+}
+
+func TestCreateClusterInfra(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keto-libvirt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The second reservation of the first attempt fails.
+	calls := [][]string{}
+	defer func(f func(context.Context, string, ...string) ([]byte, error)) { runCommand = f }(runCommand)
+	runCommand = func(_ context.Context, name string, args ...string) ([]byte, error) {
+		calls = append(calls, args[2:5])
+		if len(calls) == 2 {
+			return nil, errors.New("failed to update network")
+		}
+		return nil, nil
+	}
+
+	c := &Cloud{
+		Logger: log.New(ioutil.Discard, "", 0),
+		config: config{URI: defaultURI, StateDir: dir, Network: "default", MasterIPs: []string{"192.168.122.11", "192.168.122.12"}},
+	}
+	cluster := model.Cluster{ResourceMeta: model.ResourceMeta{Name: "foo"}}
+	if err := c.CreateClusterInfra(cluster); err == nil {
+		t.Fatal("expected an error reserving IPs")
+	}
+	want := [][]string{
+		{"net-update", "default", "add-last"},
+		{"net-update", "default", "add-last"},
+		{"net-update", "default", "delete"},
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("got calls %v; want the reserved IP released %v", calls, want)
+	}
+	if clusters, err := c.GetClusters("foo"); err != nil || len(clusters) != 0 {
+		t.Errorf("got clusters %v, error %v; want no cluster spec left behind", clusters, err)
+	}
+
+	if err := c.CreateClusterInfra(cluster); err != nil {
+		t.Fatalf("failed to retry creating a cluster: %v", err)
+	}
+
+	// Another cluster cannot reserve the same IPs.
+	calls = nil
+	if err := c.CreateClusterInfra(model.Cluster{ResourceMeta: model.ResourceMeta{Name: "bar"}}); err == nil {
+		t.Error("expected an error, IPs are reserved by another cluster")
+	}
+	if len(calls) != 0 {
+		t.Errorf("got calls %v; want no reservations", calls)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/UKHomeOffice/keto/pkg/cloudprovider"
+	"github.com/UKHomeOffice/keto/pkg/model"
+)
+
+// configDriveDir is where CoreOS mounts the config drive. It is a variable so
+// that it can be replaced in tests.
+var configDriveDir = "/media/configdrive"
+
+// Node returns an implementation of Node interface for libvirt Cloud.
+func (c *Cloud) Node() (cloudprovider.Node, bool) {
+	return c, true
+}
+
+// GetNodeData returns model.NodeData which contains information like node
+// labels, kube version, etc.
+func (c Cloud) GetNodeData() (model.NodeData, error) {
+	var data model.NodeData
+
+	p := filepath.Join(configDriveDir, nodeDataPath)
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return data, err
+	}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return data, fmt.Errorf("failed to decode %q: %v", p, err)
+	}
+	return data, nil
+}
+
+// GetAssets gets assets from the config drive. Only master nodes have
+// assets.
+func (c *Cloud) GetAssets() (model.Assets, error) {
+	var a model.Assets
+	var err error
+
+	dir := filepath.Join(configDriveDir, configDriveAssetDir)
+	if a.EtcdCACert, err = ioutil.ReadFile(filepath.Join(dir, etcdCACertFileName)); err != nil {
+		return a, err
+	}
+	if a.EtcdCAKey, err = ioutil.ReadFile(filepath.Join(dir, etcdCAKeyFileName)); err != nil {
+		return a, err
+	}
+	if a.KubeCACert, err = ioutil.ReadFile(filepath.Join(dir, kubeCACertFileName)); err != nil {
+		return a, err
+	}
+	if a.KubeCAKey, err = ioutil.ReadFile(filepath.Join(dir, kubeCAKeyFileName)); err != nil {
+		return a, err
+	}
+	return a, nil
+}
@@ -0,0 +1,413 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirt
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/UKHomeOffice/keto/pkg/cloudprovider"
+	"github.com/UKHomeOffice/keto/pkg/kubeargs"
+	"github.com/UKHomeOffice/keto/pkg/model"
+	"github.com/UKHomeOffice/keto/pkg/userdata"
+)
+
+const (
+	masterPoolType  = "masterpool"
+	computePoolType = "computepool"
+
+	domainStateRunning = "running"
+)
+
+// NodePooler returns an implementation of NodePooler interface for libvirt
+// Cloud.
+func (c *Cloud) NodePooler() (cloudprovider.NodePooler, bool) {
+	return c, true
+}
+
+// CreateMasterPool creates a master node pool. A master is created for each
+// reserved master IP.
+func (c *Cloud) CreateMasterPool(p model.MasterPool) error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	spec, err := c.getClusterSpec(p.ClusterName)
+	if err != nil {
+		return err
+	}
+	assets, err := c.getAssetFiles(p.ClusterName)
+	if err != nil {
+		return err
+	}
+
+	for i, ip := range spec.MasterIPs {
+		// Each master gets its node ID and reserved IP from its user data.
+		master := p.NodePool
+		master.UserData, err = userdata.AddWriteFiles(p.UserData, []userdata.File{userdata.MasterEnvFile(strconv.Itoa(i), ip)})
+		if err != nil {
+			return err
+		}
+		mac := makeMasterMAC(p.ClusterName, i)
+		if err := c.createNode(ctx, spec, master, masterPoolType, i, mac, []string{spec.Network}, assets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateComputePool creates a compute node pool. Nodes are attached to the
+// cluster network, unless networks are given.
+func (c *Cloud) CreateComputePool(p model.ComputePool) error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	spec, err := c.getClusterSpec(p.ClusterName)
+	if err != nil {
+		return err
+	}
+	networks := p.Networks
+	if len(networks) == 0 {
+		networks = []string{spec.Network}
+	}
+
+	for i := 0; i < p.Size; i++ {
+		if err := c.createNode(ctx, spec, p.NodePool, computePoolType, i, "", networks, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createNode creates and starts the n-th node domain of a pool. CoreOSVersion
+// is the name of a CoreOS image volume in the storage pool, which the node
+// boot disk is backed by.
+func (c *Cloud) createNode(ctx context.Context, cluster clusterSpec, p model.NodePool, poolType string, n int, mac string, networks []string, assets map[string][]byte) error {
+	cpus, mem, err := parseMachineType(p.MachineType)
+	if err != nil {
+		return err
+	}
+	sshKey, err := readSSHKey(p.SSHKey)
+	if err != nil {
+		return err
+	}
+
+	// User data is big and only needed at creation time.
+	poolSpec := p
+	poolSpec.UserData = nil
+	b, err := json.Marshal(poolSpec)
+	if err != nil {
+		return err
+	}
+	nodeData, err := json.Marshal(model.NodeData{
+		KubeAPIURL:  c.kubeAPIURL(cluster),
+		ClusterName: p.ClusterName,
+		KubeVersion: p.KubeVersion,
+		Labels:      p.Labels,
+		KubeArgs:    kubeargs.ToKubeArgs(p.ExtraArgs),
+	})
+	if err != nil {
+		return err
+	}
+
+	name := makeDomainName(p.ClusterName, p.Name, n)
+	files, err := makeConfigDriveFiles(name, sshKey, p.UserData, nodeData, assets)
+	if err != nil {
+		return err
+	}
+	iso, cleanup, err := buildConfigDrive(ctx, files)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	diskVolume := makeDiskVolumeName(name)
+	c.Logger.Printf("creating volume %q backed by %q", diskVolume, p.CoreOSVersion)
+	if _, err := c.virsh(ctx, "vol-create-as", "--pool", c.config.Pool, "--name", diskVolume,
+		"--capacity", strconv.Itoa(p.DiskSize)+"G", "--format", "qcow2",
+		"--backing-vol", p.CoreOSVersion, "--backing-vol-format", "qcow2"); err != nil {
+		return err
+	}
+
+	isoVolume := makeISOVolumeName(name)
+	fi, err := os.Stat(iso)
+	if err != nil {
+		return err
+	}
+	c.Logger.Printf("uploading config drive volume %q", isoVolume)
+	if _, err := c.virsh(ctx, "vol-create-as", "--pool", c.config.Pool, "--name", isoVolume,
+		"--capacity", strconv.FormatInt(fi.Size(), 10), "--format", "raw"); err != nil {
+		return err
+	}
+	if _, err := c.virsh(ctx, "vol-upload", "--pool", c.config.Pool, "--vol", isoVolume, "--file", iso); err != nil {
+		return err
+	}
+
+	d := makeDomain(domainParams{
+		Name:        name,
+		Type:        c.config.DomainType,
+		VCPUs:       cpus,
+		MemoryMiB:   mem,
+		StoragePool: c.config.Pool,
+		DiskVolume:  diskVolume,
+		ISOVolume:   isoVolume,
+		Networks:    networks,
+		MAC:         mac,
+		Metadata: nodeMetadata{
+			ClusterName: p.ClusterName,
+			PoolName:    p.Name,
+			PoolType:    poolType,
+			PoolSpec:    string(b),
+		},
+	})
+	x, err := xml.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile("", "keto-domain")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(x); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	c.Logger.Printf("defining domain %q", name)
+	if _, err := c.virsh(ctx, "define", "--file", f.Name()); err != nil {
+		return err
+	}
+	c.Logger.Printf("starting domain %q", name)
+	_, err = c.virsh(ctx, "start", "--domain", name)
+	return err
+}
+
+// ValidateNodePool checks the node pool machine type and SSH key, and that
+// its image volume and networks exist. Volume and network lookups are cached.
+func (c *Cloud) ValidateNodePool(p model.NodePool) error {
+	if _, _, err := parseMachineType(p.MachineType); err != nil {
+		return err
+	}
+	if _, err := readSSHKey(p.SSHKey); err != nil {
+		return err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	if _, err := c.virshCached(ctx, "vol-path", "--pool", c.config.Pool, p.CoreOSVersion); err != nil {
+		return fmt.Errorf("image volume %q not found in pool %q: %v", p.CoreOSVersion, c.config.Pool, err)
+	}
+	networks := p.Networks
+	if len(networks) == 0 {
+		networks = []string{c.config.Network}
+	}
+	for _, n := range networks {
+		if _, err := c.virshCached(ctx, "net-uuid", n); err != nil {
+			return fmt.Errorf("network %q not found: %v", n, err)
+		}
+	}
+	return nil
+}
+
+// readSSHKey returns a public SSH key. The key is read from a file if key is
+// a path to one.
+func readSSHKey(key string) (string, error) {
+	if key == "" {
+		return "", nil
+	}
+	if _, err := os.Stat(key); err != nil {
+		return key, nil
+	}
+	b, err := ioutil.ReadFile(key)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// GetMasterPools returns a list of master pools. Pools can be filtered by
+// their name / cluster.
+func (c *Cloud) GetMasterPools(clusterName, name string) ([]*model.MasterPool, error) {
+	pools := []*model.MasterPool{}
+
+	nodePools, err := c.getNodePools(masterPoolType, clusterName, name)
+	if err != nil {
+		return pools, err
+	}
+	for _, p := range nodePools {
+		pools = append(pools, &model.MasterPool{NodePool: *p})
+	}
+	return pools, nil
+}
+
+// GetComputePools returns a list of compute pools. Pools can be filtered by
+// their name / cluster.
+func (c *Cloud) GetComputePools(clusterName, name string) ([]*model.ComputePool, error) {
+	pools := []*model.ComputePool{}
+
+	nodePools, err := c.getNodePools(computePoolType, clusterName, name)
+	if err != nil {
+		return pools, err
+	}
+	for _, p := range nodePools {
+		pools = append(pools, &model.ComputePool{NodePool: *p})
+	}
+	return pools, nil
+}
+
+// getNodePools returns node pools of poolType built from domain metadata,
+// with their size set to the number of domains. Pools can be filtered by
+// their name / cluster.
+func (c *Cloud) getNodePools(poolType, clusterName, name string) ([]*model.NodePool, error) {
+	pools := []*model.NodePool{}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	domains, err := c.getPoolDomains(ctx, poolType, clusterName, name)
+	if err != nil {
+		return pools, err
+	}
+
+	byName := make(map[string]*model.NodePool)
+	keys := []string{}
+	for _, d := range domains {
+		md := d.Metadata.Node
+		key := md.ClusterName + "/" + md.PoolName
+		if p, ok := byName[key]; ok {
+			p.Size++
+			continue
+		}
+		p := &model.NodePool{}
+		if err := json.Unmarshal([]byte(md.PoolSpec), p); err != nil {
+			return pools, fmt.Errorf("failed to decode domain %q pool spec: %v", d.Name, err)
+		}
+		p.Size = 1
+		byName[key] = p
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		pools = append(pools, byName[k])
+	}
+	return pools, nil
+}
+
+// getPoolDomains returns keto domains of poolType pools. Domains can be
+// filtered by their pool name / cluster.
+func (c *Cloud) getPoolDomains(ctx context.Context, poolType, clusterName, name string) ([]domain, error) {
+	domains := []domain{}
+
+	out, err := c.virsh(ctx, "list", "--all", "--name")
+	if err != nil {
+		return domains, err
+	}
+	for _, n := range strings.Split(string(out), "\n") {
+		n = strings.TrimSpace(n)
+		if !strings.HasPrefix(n, "keto-") {
+			continue
+		}
+		x, err := c.virsh(ctx, "dumpxml", "--domain", n)
+		if err != nil {
+			return domains, err
+		}
+		var d domain
+		if err := xml.Unmarshal(x, &d); err != nil {
+			return domains, fmt.Errorf("failed to decode domain %q: %v", n, err)
+		}
+		if d.Metadata == nil || d.Metadata.Node == nil {
+			continue
+		}
+		md := d.Metadata.Node
+		if md.PoolType != poolType ||
+			(clusterName != "" && md.ClusterName != clusterName) ||
+			(name != "" && md.PoolName != name) {
+			continue
+		}
+		domains = append(domains, d)
+	}
+	return domains, nil
+}
+
+// DescribeNodePool lists nodes pools.
+func (c *Cloud) DescribeNodePool() error {
+	return ErrNotImplemented
+}
+
+// UpgradeNodePool upgrades a node pool.
+func (c *Cloud) UpgradeNodePool() error {
+	return ErrNotImplemented
+}
+
+// DeleteMasterPool deletes a master node pool. Master IP reservations are
+// kept until the cluster is deleted.
+func (c *Cloud) DeleteMasterPool(clusterName string) error {
+	return c.deletePools(masterPoolType, clusterName, "")
+}
+
+// DeleteComputePool deletes a compute node pool. All compute pools of a
+// cluster are deleted if name is empty.
+func (c *Cloud) DeleteComputePool(clusterName, name string) error {
+	return c.deletePools(computePoolType, clusterName, name)
+}
+
+// deletePools stops and undefines domains of poolType pools and deletes
+// their volumes.
+func (c *Cloud) deletePools(poolType, clusterName, name string) error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	domains, err := c.getPoolDomains(ctx, poolType, clusterName, name)
+	if err != nil {
+		return err
+	}
+	for _, d := range domains {
+		state, err := c.virsh(ctx, "domstate", "--domain", d.Name)
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(state)) == domainStateRunning {
+			c.Logger.Printf("stopping domain %q", d.Name)
+			if _, err := c.virsh(ctx, "destroy", "--domain", d.Name); err != nil {
+				return err
+			}
+		}
+		c.Logger.Printf("undefining domain %q", d.Name)
+		if _, err := c.virsh(ctx, "undefine", "--domain", d.Name); err != nil {
+			return err
+		}
+		for _, v := range []string{makeDiskVolumeName(d.Name), makeISOVolumeName(d.Name)} {
+			c.Logger.Printf("deleting volume %q", v)
+			if _, err := c.virsh(ctx, "vol-delete", "--pool", c.config.Pool, "--vol", v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
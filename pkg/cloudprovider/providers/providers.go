@@ -19,4 +19,7 @@ package cloudprovider
 import (
 	// Register cloud providers.
 	_ "github.com/UKHomeOffice/keto/pkg/cloudprovider/providers/aws"
+	_ "github.com/UKHomeOffice/keto/pkg/cloudprovider/providers/digitalocean"
+	_ "github.com/UKHomeOffice/keto/pkg/cloudprovider/providers/libvirt"
+	_ "github.com/UKHomeOffice/keto/pkg/cloudprovider/providers/vsphere"
 )
@@ -0,0 +1,218 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/UKHomeOffice/keto/pkg/cloudprovider"
+	"github.com/UKHomeOffice/keto/pkg/keto/util"
+	"github.com/UKHomeOffice/keto/pkg/model"
+)
+
+// hostUsrDir is where keto-k8 containers get the host /usr, which has
+// vmware-rpctool and the libraries it links against. It is a variable so that
+// it can be replaced in tests.
+var hostUsrDir = "/host/usr"
+
+// rpcTool returns a vmware-rpctool command. In a keto-k8 container the host
+// tool is run with the host dynamic loader, so that it does not depend on the
+// container libraries.
+func rpcTool(args ...string) *exec.Cmd {
+	libDir := filepath.Join(hostUsrDir, "lib64")
+	loader := filepath.Join(libDir, "ld-linux-x86-64.so.2")
+	if _, err := os.Stat(loader); err != nil {
+		return exec.Command("vmware-rpctool", args...)
+	}
+	return exec.Command(loader, append([]string{"--library-path", libDir, filepath.Join(hostUsrDir, "bin", "vmware-rpctool")}, args...)...)
+}
+
+// getGuestInfo returns a value of a guestinfo key of the VM it runs on. It
+// is a variable so that it can be replaced in tests.
+var getGuestInfo = func(key string) (string, error) {
+	out, err := rpcTool("info-get " + key).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get guestinfo %q: %v", key, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Masters wait for asset tickets, which keto adds to their guestinfo once they
+// are up. These are variables so that they can be replaced in tests.
+var (
+	assetTicketsTimeout      = 15 * time.Minute
+	assetTicketsPollInterval = 5 * time.Second
+	assetDownloadTimeout     = time.Minute
+)
+
+// Node returns an implementation of Node interface for vSphere Cloud.
+func (c *Cloud) Node() (cloudprovider.Node, bool) {
+	return c, true
+}
+
+// GetNodeData returns model.NodeData which contains information like node
+// labels, kube version, etc.
+func (c Cloud) GetNodeData() (model.NodeData, error) {
+	var data model.NodeData
+	var err error
+
+	if data.KubeAPIURL, err = getGuestInfo(kubeAPIURLKey); err != nil {
+		return data, err
+	}
+	if data.ClusterName, err = getGuestInfo(clusterNameKey); err != nil {
+		return data, err
+	}
+	if data.KubeVersion, err = getGuestInfo(kubeVersionKey); err != nil {
+		return data, err
+	}
+	labels, err := getGuestInfo(labelsKey)
+	if err != nil {
+		return data, err
+	}
+	data.Labels = util.KVsToLabels(strings.Split(labels, ","))
+
+	// VMs created before extra args were supported have no such keys.
+	guestInfo := make(map[string]string)
+	for _, k := range []string{kubeletExtraArgsKey, apiServerExtraArgsKey, controllerManagerExtraArgsKey, schedulerExtraArgsKey} {
+		guestInfo[k], _ = getGuestInfo(k)
+	}
+	data.KubeArgs = makeKubeArgs(guestInfo)
+
+	return data, nil
+}
+
+// GetAssets downloads assets from the cluster datastore directory, with
+// one-time tickets added to guestinfo once the master is up. Only master nodes
+// have assets.
+func (c *Cloud) GetAssets() (model.Assets, error) {
+	var a model.Assets
+
+	if t, err := getGuestInfo(poolTypeKey); err != nil || t != masterPoolType {
+		return a, ErrNotMaster
+	}
+	tickets, err := waitForAssetTickets()
+	if err != nil {
+		return a, err
+	}
+
+	client := makePinnedClient(tickets.Thumbprint)
+	files := map[string]*[]byte{
+		etcdCACertFileName: &a.EtcdCACert,
+		etcdCAKeyFileName:  &a.EtcdCAKey,
+		kubeCACertFileName: &a.KubeCACert,
+		kubeCAKeyFileName:  &a.KubeCAKey,
+	}
+	for name, b := range files {
+		t, ok := tickets.Assets[name]
+		if !ok {
+			return a, fmt.Errorf("no ticket to download %q", name)
+		}
+		if *b, err = downloadAsset(client, t); err != nil {
+			return a, fmt.Errorf("failed to download %q: %v", name, err)
+		}
+	}
+	return a, nil
+}
+
+// waitForAssetTickets polls guestinfo until asset tickets are added.
+func waitForAssetTickets() (assetTickets, error) {
+	var tickets assetTickets
+
+	timeout := time.After(assetTicketsTimeout)
+	for {
+		if s, err := getGuestInfo(assetTicketsKey); err == nil && s != "" {
+			if err := json.Unmarshal([]byte(s), &tickets); err != nil {
+				return tickets, fmt.Errorf("failed to decode guestinfo %q: %v", assetTicketsKey, err)
+			}
+			return tickets, nil
+		}
+		select {
+		case <-timeout:
+			return tickets, fmt.Errorf("timed out waiting for guestinfo %q", assetTicketsKey)
+		case <-time.After(assetTicketsPollInterval):
+		}
+	}
+}
+
+// downloadAsset downloads an asset file with a ticket.
+func downloadAsset(client *http.Client, t assetTicket) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, t.URL, nil)
+	if err != nil {
+		return []byte{}, err
+	}
+	req.AddCookie(&http.Cookie{Name: serviceTicketCookie, Value: t.Ticket})
+	resp, err := client.Do(req)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return []byte{}, fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// makePinnedClient returns an HTTP client that only trusts a server
+// certificate with a given SHA-1 thumbprint. Certificates are verified as
+// usual if the thumbprint is not known.
+func makePinnedClient(thumbprint string) *http.Client {
+	if thumbprint == "" {
+		return &http.Client{Timeout: assetDownloadTimeout}
+	}
+	verify := func(certs [][]byte, _ [][]*x509.Certificate) error {
+		if len(certs) == 0 {
+			return errors.New("no server certificate")
+		}
+		if t := makeThumbprint(certs[0]); !strings.EqualFold(t, thumbprint) {
+			return fmt.Errorf("server certificate thumbprint %s does not match %s", t, thumbprint)
+		}
+		return nil
+	}
+	return &http.Client{
+		Timeout: assetDownloadTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				// The certificate is verified by its thumbprint instead.
+				InsecureSkipVerify:    true,
+				VerifyPeerCertificate: verify,
+			},
+		},
+	}
+}
+
+// makeThumbprint returns a SHA-1 thumbprint of a DER encoded certificate in
+// the format vSphere uses, e.g. 01:23:...:EF.
+func makeThumbprint(cert []byte) string {
+	sum := sha1.Sum(cert)
+	hex := []string{}
+	for _, b := range sum {
+		hex = append(hex, fmt.Sprintf("%02X", b))
+	}
+	return strings.Join(hex, ":")
+}
@@ -0,0 +1,792 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/UKHomeOffice/keto/pkg/cloudprovider"
+	"github.com/UKHomeOffice/keto/pkg/keto/util"
+	"github.com/UKHomeOffice/keto/pkg/kubeargs"
+	"github.com/UKHomeOffice/keto/pkg/model"
+	"github.com/UKHomeOffice/keto/pkg/userdata"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const (
+	masterPoolType  = "masterpool"
+	computePoolType = "computepool"
+
+	ethernetCardType = "vmxnet3"
+
+	// CoreOS reads its cloud-config from these guestinfo keys.
+	userDataKey         = "guestinfo.coreos.config.data"
+	userDataEncodingKey = "guestinfo.coreos.config.data.encoding"
+
+	// Keys of node pool metadata stored as VM guestinfo. Guestinfo can be
+	// read from within a VM, which is how nodes get their node data.
+	guestInfoKeyPrefix = "guestinfo.keto."
+	clusterNameKey     = guestInfoKeyPrefix + "cluster-name"
+	poolNameKey        = guestInfoKeyPrefix + "pool-name"
+	poolTypeKey        = guestInfoKeyPrefix + "pool-type"
+	kubeVersionKey     = guestInfoKeyPrefix + "kube-version"
+	coreOSVersionKey   = guestInfoKeyPrefix + "coreos-version"
+	machineTypeKey     = guestInfoKeyPrefix + "machine-type"
+	diskSizeKey        = guestInfoKeyPrefix + "disk-size"
+	labelsKey          = guestInfoKeyPrefix + "labels"
+	kubeAPIURLKey      = guestInfoKeyPrefix + "kube-api-url"
+
+	kubeletExtraArgsKey           = guestInfoKeyPrefix + "kubelet-extra-args"
+	apiServerExtraArgsKey         = guestInfoKeyPrefix + "apiserver-extra-args"
+	controllerManagerExtraArgsKey = guestInfoKeyPrefix + "controller-manager-extra-args"
+	schedulerExtraArgsKey         = guestInfoKeyPrefix + "scheduler-extra-args"
+
+	nodeIDKey       = guestInfoKeyPrefix + "node-id"
+	assetTicketsKey = guestInfoKeyPrefix + "asset-tickets"
+
+	// CoreOS configures the network of the first interface of a VM from
+	// these guestinfo keys.
+	interfaceMACKey         = "guestinfo.interface.0.mac"
+	interfaceDHCPKey        = "guestinfo.interface.0.dhcp"
+	interfaceAddressKey     = "guestinfo.interface.0.ip.0.address"
+	interfaceGatewayKey     = "guestinfo.interface.0.route.0.gateway"
+	interfaceDestinationKey = "guestinfo.interface.0.route.0.destination"
+	dnsServerKeyPrefix      = "guestinfo.dns.server."
+)
+
+// poolVM is a keto managed VM with its guestinfo metadata.
+type poolVM struct {
+	vm        *object.VirtualMachine
+	name      string
+	poweredOn bool
+	guestInfo map[string]string
+}
+
+// NodePooler returns an implementation of NodePooler interface for
+// vSphere Cloud.
+func (c *Cloud) NodePooler() (cloudprovider.NodePooler, bool) {
+	return c, true
+}
+
+// CreateMasterPool creates a master node pool, one VM per master IP. The
+// first network card of a master gets its IP statically. Once a master is up,
+// it gets one-time tickets to download the cluster assets from the cluster
+// datastore directory, so that assets are never stored in guestinfo.
+func (c *Cloud) CreateMasterPool(p model.MasterPool) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	if err := c.connect(ctx); err != nil {
+		return err
+	}
+
+	ips, err := c.GetMasterPersistentIPs(p.ClusterName)
+	if err != nil {
+		return err
+	}
+	spec, err := c.getClusterSpec(ctx, p.ClusterName)
+	if err != nil {
+		return err
+	}
+
+	guestInfo := makePoolGuestInfo(p.NodePool, masterPoolType, c.kubeAPIURL(spec))
+	nodes := []map[string]string{}
+	for i := 0; i < len(ips); i++ {
+		nodes = append(nodes, map[string]string{nodeIDKey: strconv.Itoa(i)})
+	}
+	configure := func(n int, mac string) (map[string]string, []byte, error) {
+		id := strconv.Itoa(n)
+		userData, err := userdata.AddWriteFiles(p.UserData, []userdata.File{userdata.MasterEnvFile(id, ips[id])})
+		return c.makeNetworkGuestInfo(mac, ips[id]), userData, err
+	}
+
+	vms, err := c.createPool(ctx, p.NodePool, guestInfo, nodes, configure)
+	if err != nil {
+		return err
+	}
+	for _, v := range vms {
+		if err := c.putAssetTickets(ctx, p.ClusterName, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateComputePool creates a compute node pool.
+func (c *Cloud) CreateComputePool(p model.ComputePool) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	if err := c.connect(ctx); err != nil {
+		return err
+	}
+
+	spec, err := c.getClusterSpec(ctx, p.ClusterName)
+	if err != nil {
+		return err
+	}
+
+	guestInfo := makePoolGuestInfo(p.NodePool, computePoolType, c.kubeAPIURL(spec))
+	nodes := []map[string]string{}
+	for i := 0; i < p.Size; i++ {
+		nodes = append(nodes, map[string]string{nodeIDKey: strconv.Itoa(i)})
+	}
+	_, err = c.createPool(ctx, p.NodePool, guestInfo, nodes, nil)
+	return err
+}
+
+// configureNode returns guestinfo and user data of the n-th VM of a pool,
+// given the MAC address of its first network card.
+type configureNode func(n int, mac string) (map[string]string, []byte, error)
+
+// createPool clones a VM per nodes item from a template named after the
+// pool CoreOS version. Each VM gets pool guestInfo merged with its node
+// specific guestinfo. Unless configure is nil, VMs are cloned powered off
+// and configured before they are powered on. VMs of the pool are kept on
+// separate hosts by a DRS anti-affinity rule.
+func (c *Cloud) createPool(ctx context.Context, p model.NodePool, guestInfo map[string]string, nodes []map[string]string, configure configureNode) ([]*poolVM, error) {
+	vms := []*poolVM{}
+
+	cpus, memoryMB, err := parseMachineType(p.MachineType)
+	if err != nil {
+		return vms, err
+	}
+
+	c.Logger.Printf("finding template %q", p.CoreOSVersion)
+	template, err := c.finder.VirtualMachine(ctx, p.CoreOSVersion)
+	if err != nil {
+		return vms, err
+	}
+	devices, err := template.Device(ctx)
+	if err != nil {
+		return vms, err
+	}
+	deviceChange, err := c.makeDeviceChange(ctx, devices, p.Networks, p.DiskSize)
+	if err != nil {
+		return vms, err
+	}
+
+	folder, err := c.clusterFolder(ctx, p.ClusterName)
+	if err != nil {
+		return vms, err
+	}
+	pool, err := c.finder.ResourcePoolOrDefault(ctx, c.config.ResourcePool)
+	if err != nil {
+		return vms, err
+	}
+	poolRef := pool.Reference()
+	dsRef := c.datastore.Reference()
+
+	refs := []types.ManagedObjectReference{}
+	for i, node := range nodes {
+		name := makeVMName(p.ClusterName, p.Name, i)
+		spec := types.VirtualMachineCloneSpec{
+			Location: types.VirtualMachineRelocateSpec{
+				Pool:      &poolRef,
+				Datastore: &dsRef,
+			},
+			Config: &types.VirtualMachineConfigSpec{
+				NumCPUs:      cpus,
+				MemoryMB:     memoryMB,
+				DeviceChange: deviceChange,
+				ExtraConfig:  makeExtraConfig(guestInfo, node, p.UserData),
+			},
+			PowerOn: configure == nil,
+		}
+
+		c.Logger.Printf("cloning VM %q from template %q", name, p.CoreOSVersion)
+		task, err := template.Clone(ctx, folder, name, spec)
+		if err != nil {
+			return vms, err
+		}
+		info, err := task.WaitForResult(ctx, nil)
+		if err != nil {
+			return vms, fmt.Errorf("failed to clone VM %q: %v", name, err)
+		}
+		ref, ok := info.Result.(types.ManagedObjectReference)
+		if !ok {
+			continue
+		}
+		refs = append(refs, ref)
+		v := &poolVM{vm: object.NewVirtualMachine(c.client.Client, ref), name: name, poweredOn: configure == nil}
+		vms = append(vms, v)
+
+		if configure != nil {
+			if err := c.configureVM(ctx, v, i, configure); err != nil {
+				return vms, err
+			}
+		}
+	}
+
+	return vms, c.createAntiAffinityRule(ctx, makeRuleName(p.ClusterName, p.Name), refs)
+}
+
+// configureVM reconfigures a powered off VM with guestinfo and user data made
+// for it, then powers it on.
+func (c *Cloud) configureVM(ctx context.Context, v *poolVM, n int, configure configureNode) error {
+	devices, err := v.vm.Device(ctx)
+	if err != nil {
+		return err
+	}
+	cards := devices.SelectByType((*types.VirtualEthernetCard)(nil))
+	if len(cards) == 0 {
+		return fmt.Errorf("VM %q has no network cards", v.name)
+	}
+	mac := cards[0].(types.BaseVirtualEthernetCard).GetVirtualEthernetCard().MacAddress
+
+	guestInfo, userData, err := configure(n, mac)
+	if err != nil {
+		return err
+	}
+	c.Logger.Printf("configuring VM %q", v.name)
+	task, err := v.vm.Reconfigure(ctx, types.VirtualMachineConfigSpec{
+		ExtraConfig: makeExtraConfig(guestInfo, nil, userData),
+	})
+	if err != nil {
+		return err
+	}
+	if err := task.Wait(ctx); err != nil {
+		return err
+	}
+
+	c.Logger.Printf("powering on VM %q", v.name)
+	task, err = v.vm.PowerOn(ctx)
+	if err != nil {
+		return err
+	}
+	if err := task.Wait(ctx); err != nil {
+		return err
+	}
+	v.poweredOn = true
+	return nil
+}
+
+// makeDeviceChange returns device changes that replace template network
+// cards with a card per network and grow the first disk to diskSize GBs.
+// Networks can be standard or distributed port groups or NSX logical
+// switches, the card backing is chosen based on the network type.
+func (c *Cloud) makeDeviceChange(ctx context.Context, devices object.VirtualDeviceList, networks []string, diskSize int) ([]types.BaseVirtualDeviceConfigSpec, error) {
+	changes := []types.BaseVirtualDeviceConfigSpec{}
+
+	if len(networks) > 0 {
+		for _, d := range devices.SelectByType((*types.VirtualEthernetCard)(nil)) {
+			changes = append(changes, &types.VirtualDeviceConfigSpec{
+				Operation: types.VirtualDeviceConfigSpecOperationRemove,
+				Device:    d,
+			})
+		}
+	}
+	for i, n := range networks {
+		net, err := c.finder.Network(ctx, n)
+		if err != nil {
+			return changes, err
+		}
+		backing, err := net.EthernetCardBackingInfo(ctx)
+		if err != nil {
+			return changes, err
+		}
+		card, err := devices.CreateEthernetCard(ethernetCardType, backing)
+		if err != nil {
+			return changes, err
+		}
+		// New devices need unique temporary negative keys.
+		card.GetVirtualDevice().Key = int32(-100 - i)
+		changes = append(changes, &types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationAdd,
+			Device:    card,
+		})
+	}
+
+	disks := devices.SelectByType((*types.VirtualDisk)(nil))
+	if len(disks) > 0 && diskSize > 0 {
+		disk := disks[0].(*types.VirtualDisk)
+		capacity := int64(diskSize) * 1024 * 1024
+		if capacity > disk.CapacityInKB {
+			disk.CapacityInKB = capacity
+			changes = append(changes, &types.VirtualDeviceConfigSpec{
+				Operation: types.VirtualDeviceConfigSpecOperationEdit,
+				Device:    disk,
+			})
+		}
+	}
+	return changes, nil
+}
+
+// createAntiAffinityRule creates a DRS rule that keeps given VMs on separate
+// hosts. No rule is created if a compute cluster is not configured or there
+// are less than two VMs.
+func (c *Cloud) createAntiAffinityRule(ctx context.Context, name string, vms []types.ManagedObjectReference) error {
+	if c.config.Cluster == "" || len(vms) < 2 {
+		return nil
+	}
+	cluster, err := c.finder.ClusterComputeResource(ctx, c.config.Cluster)
+	if err != nil {
+		return err
+	}
+
+	spec := &types.ClusterConfigSpecEx{
+		RulesSpec: []types.ClusterRuleSpec{
+			{
+				ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: types.ArrayUpdateOperationAdd},
+				Info: &types.ClusterAntiAffinityRuleSpec{
+					ClusterRuleInfo: types.ClusterRuleInfo{
+						Name:    name,
+						Enabled: types.NewBool(true),
+					},
+					Vm: vms,
+				},
+			},
+		},
+	}
+
+	c.Logger.Printf("creating anti-affinity rule %q", name)
+	task, err := cluster.Reconfigure(ctx, spec, true)
+	if err != nil {
+		return err
+	}
+	return task.Wait(ctx)
+}
+
+// deleteAntiAffinityRule deletes a DRS rule by name, if it exists.
+func (c *Cloud) deleteAntiAffinityRule(ctx context.Context, name string) error {
+	if c.config.Cluster == "" {
+		return nil
+	}
+	cluster, err := c.finder.ClusterComputeResource(ctx, c.config.Cluster)
+	if err != nil {
+		return err
+	}
+
+	var cc mo.ClusterComputeResource
+	if err := cluster.Properties(ctx, cluster.Reference(), []string{"configurationEx"}, &cc); err != nil {
+		return err
+	}
+	info, ok := cc.ConfigurationEx.(*types.ClusterConfigInfoEx)
+	if !ok {
+		return nil
+	}
+
+	for _, r := range info.Rule {
+		rule := r.GetClusterRuleInfo()
+		if rule.Name != name {
+			continue
+		}
+		spec := &types.ClusterConfigSpecEx{
+			RulesSpec: []types.ClusterRuleSpec{
+				{
+					ArrayUpdateSpec: types.ArrayUpdateSpec{
+						Operation: types.ArrayUpdateOperationRemove,
+						RemoveKey: rule.Key,
+					},
+				},
+			},
+		}
+
+		c.Logger.Printf("deleting anti-affinity rule %q", name)
+		task, err := cluster.Reconfigure(ctx, spec, true)
+		if err != nil {
+			return err
+		}
+		return task.Wait(ctx)
+	}
+	return nil
+}
+
+// GetMasterPools returns a list of master pools. Pools can be filtered by
+// their name / cluster.
+func (c *Cloud) GetMasterPools(clusterName, name string) ([]*model.MasterPool, error) {
+	pools := []*model.MasterPool{}
+
+	nodePools, err := c.getNodePools(masterPoolType, clusterName, name)
+	if err != nil {
+		return pools, err
+	}
+	for _, p := range nodePools {
+		pools = append(pools, &model.MasterPool{NodePool: *p})
+	}
+	return pools, nil
+}
+
+// GetComputePools returns a list of compute pools. Pools can be filtered by
+// their name / cluster.
+func (c *Cloud) GetComputePools(clusterName, name string) ([]*model.ComputePool, error) {
+	pools := []*model.ComputePool{}
+
+	nodePools, err := c.getNodePools(computePoolType, clusterName, name)
+	if err != nil {
+		return pools, err
+	}
+	for _, p := range nodePools {
+		pools = append(pools, &model.ComputePool{NodePool: *p})
+	}
+	return pools, nil
+}
+
+// ValidateNodePool checks the node pool machine type and that its template and
+// networks exist. Lookups are cached, vCenter is only logged in to if any of
+// them is not.
+func (c *Cloud) ValidateNodePool(p model.NodePool) error {
+	if _, _, err := parseMachineType(p.MachineType); err != nil {
+		return err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	if err := c.findCached(ctx, "templates", p.CoreOSVersion, func(name string) (types.ManagedObjectReference, error) {
+		vm, err := c.finder.VirtualMachine(ctx, name)
+		if err != nil {
+			return types.ManagedObjectReference{}, err
+		}
+		return vm.Reference(), nil
+	}); err != nil {
+		return err
+	}
+	for _, n := range p.Networks {
+		if err := c.findCached(ctx, "networks", n, func(name string) (types.ManagedObjectReference, error) {
+			net, err := c.finder.Network(ctx, name)
+			if err != nil {
+				return types.ManagedObjectReference{}, err
+			}
+			return net.Reference(), nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findCached looks up a named inventory object of a kind with find, unless
+// its reference is cached already.
+func (c *Cloud) findCached(ctx context.Context, kind, name string, find func(string) (types.ManagedObjectReference, error)) error {
+	var ref types.ManagedObjectReference
+	key := fmt.Sprintf("%s/%s/%s/%s/%s", ProviderName, c.config.URL, c.config.Datacenter, kind, name)
+	if cloudprovider.GetCached(c.cache, c.Logger, key, &ref) {
+		return nil
+	}
+
+	if err := c.connect(ctx); err != nil {
+		return err
+	}
+	ref, err := find(name)
+	if err != nil {
+		return err
+	}
+	cloudprovider.SetCached(c.cache, c.Logger, key, ref)
+	return nil
+}
+
+// getNodePools returns node pools of poolType made up from VMs in cluster
+// folders. Pools can be filtered by their name / cluster.
+func (c *Cloud) getNodePools(poolType, clusterName, name string) ([]*model.NodePool, error) {
+	pools := []*model.NodePool{}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	if err := c.connect(ctx); err != nil {
+		return pools, err
+	}
+
+	clusters, err := c.getClusterNames(ctx)
+	if err != nil {
+		return pools, err
+	}
+	for _, cl := range clusters {
+		if clusterName != "" && cl != clusterName {
+			continue
+		}
+		vms, err := c.getPoolVMs(ctx, cl, poolType, name)
+		if err != nil {
+			return pools, err
+		}
+		pools = append(pools, groupNodePools(vms)...)
+	}
+	return pools, nil
+}
+
+// groupNodePools returns a node pool per distinct pool name of given VMs.
+func groupNodePools(vms []*poolVM) []*model.NodePool {
+	pools := []*model.NodePool{}
+	byName := make(map[string]*model.NodePool)
+
+	for _, v := range vms {
+		name := v.guestInfo[poolNameKey]
+		if p, ok := byName[name]; ok {
+			p.Size++
+			continue
+		}
+		p := nodePoolFromGuestInfo(v.guestInfo)
+		p.Size = 1
+		byName[name] = p
+		pools = append(pools, p)
+	}
+	return pools
+}
+
+// getPoolVMs returns keto managed VMs of poolType in a cluster folder. VMs
+// can be filtered by pool name.
+func (c *Cloud) getPoolVMs(ctx context.Context, clusterName, poolType, poolName string) ([]*poolVM, error) {
+	vms := []*poolVM{}
+
+	folder, err := c.clusterFolder(ctx, clusterName)
+	if err != nil {
+		return vms, err
+	}
+	children, err := folder.Children(ctx)
+	if err != nil {
+		return vms, err
+	}
+	refs := []types.ManagedObjectReference{}
+	for _, ch := range children {
+		if vm, ok := ch.(*object.VirtualMachine); ok {
+			refs = append(refs, vm.Reference())
+		}
+	}
+	if len(refs) == 0 {
+		return vms, nil
+	}
+
+	var props []mo.VirtualMachine
+	ps := []string{"name", "config.extraConfig", "runtime.powerState"}
+	if err := property.DefaultCollector(c.client.Client).Retrieve(ctx, refs, ps, &props); err != nil {
+		return vms, err
+	}
+	for _, p := range props {
+		if p.Config == nil {
+			continue
+		}
+		guestInfo := extraConfigToGuestInfo(p.Config.ExtraConfig)
+		if guestInfo[poolTypeKey] != poolType || guestInfo[clusterNameKey] != clusterName {
+			continue
+		}
+		if poolName != "" && guestInfo[poolNameKey] != poolName {
+			continue
+		}
+		vms = append(vms, &poolVM{
+			vm:        object.NewVirtualMachine(c.client.Client, p.Reference()),
+			name:      p.Name,
+			poweredOn: p.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn,
+			guestInfo: guestInfo,
+		})
+	}
+	sort.Slice(vms, func(i, j int) bool { return vms[i].name < vms[j].name })
+	return vms, nil
+}
+
+// DescribeNodePool lists nodes pools.
+func (c *Cloud) DescribeNodePool() error {
+	return ErrNotImplemented
+}
+
+// UpgradeNodePool upgrades a node pool.
+func (c *Cloud) UpgradeNodePool() error {
+	return ErrNotImplemented
+}
+
+// DeleteMasterPool deletes a master node pool.
+func (c *Cloud) DeleteMasterPool(clusterName string) error {
+	return c.deletePools(masterPoolType, clusterName, "")
+}
+
+// DeleteComputePool deletes a compute node pool. All compute pools of a
+// cluster are deleted if name is empty.
+func (c *Cloud) DeleteComputePool(clusterName, name string) error {
+	return c.deletePools(computePoolType, clusterName, name)
+}
+
+// deletePools powers off and destroys VMs of poolType pools and deletes the
+// pools anti-affinity rules.
+func (c *Cloud) deletePools(poolType, clusterName, name string) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	if err := c.connect(ctx); err != nil {
+		return err
+	}
+
+	vms, err := c.getPoolVMs(ctx, clusterName, poolType, name)
+	if err != nil {
+		return err
+	}
+
+	pools := make(map[string]bool)
+	for _, v := range vms {
+		if v.poweredOn {
+			c.Logger.Printf("powering off VM %q", v.name)
+			task, err := v.vm.PowerOff(ctx)
+			if err != nil {
+				return err
+			}
+			if err := task.Wait(ctx); err != nil {
+				return err
+			}
+		}
+		c.Logger.Printf("destroying VM %q", v.name)
+		task, err := v.vm.Destroy(ctx)
+		if err != nil {
+			return err
+		}
+		if err := task.Wait(ctx); err != nil {
+			return err
+		}
+		pools[v.guestInfo[poolNameKey]] = true
+	}
+
+	for p := range pools {
+		if err := c.deleteAntiAffinityRule(ctx, makeRuleName(clusterName, p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makePoolGuestInfo returns guestinfo shared by all VMs of a pool.
+func makePoolGuestInfo(p model.NodePool, poolType, kubeAPIURL string) map[string]string {
+	a := kubeargs.ToKubeArgs(p.ExtraArgs)
+	return map[string]string{
+		clusterNameKey:                p.ClusterName,
+		poolNameKey:                   p.Name,
+		poolTypeKey:                   poolType,
+		kubeVersionKey:                p.KubeVersion,
+		coreOSVersionKey:              p.CoreOSVersion,
+		machineTypeKey:                p.MachineType,
+		diskSizeKey:                   strconv.Itoa(p.DiskSize),
+		labelsKey:                     util.LabelsToKVs(p.Labels),
+		kubeAPIURLKey:                 kubeAPIURL,
+		kubeletExtraArgsKey:           a.KubeletExtraArgs,
+		apiServerExtraArgsKey:         a.APIServerExtraArgs,
+		controllerManagerExtraArgsKey: a.ControllerManagerExtraArgs,
+		schedulerExtraArgsKey:         a.SchedulerExtraArgs,
+	}
+}
+
+// makeNetworkGuestInfo returns guestinfo that configures a static IP of the
+// network card with a given MAC address.
+func (c *Cloud) makeNetworkGuestInfo(mac, ip string) map[string]string {
+	m := map[string]string{
+		interfaceMACKey:     mac,
+		interfaceDHCPKey:    "no",
+		interfaceAddressKey: fmt.Sprintf("%s/%d", ip, c.config.MasterPrefixLength),
+	}
+	if c.config.MasterGateway != "" {
+		m[interfaceGatewayKey] = c.config.MasterGateway
+		m[interfaceDestinationKey] = "0.0.0.0/0"
+	}
+	for i, s := range c.config.MasterDNS {
+		m[dnsServerKeyPrefix+strconv.Itoa(i)] = s
+	}
+	return m
+}
+
+// nodePoolFromGuestInfo returns a node pool described by VM guestinfo.
+func nodePoolFromGuestInfo(guestInfo map[string]string) *model.NodePool {
+	p := &model.NodePool{}
+	p.ClusterName = guestInfo[clusterNameKey]
+	p.Name = guestInfo[poolNameKey]
+	p.KubeVersion = guestInfo[kubeVersionKey]
+	p.CoreOSVersion = guestInfo[coreOSVersionKey]
+	p.MachineType = guestInfo[machineTypeKey]
+	p.DiskSize, _ = strconv.Atoi(guestInfo[diskSizeKey])
+	p.Labels = util.KVsToLabels(strings.Split(guestInfo[labelsKey], ","))
+	p.ExtraArgs = kubeargs.FromKubeArgs(makeKubeArgs(guestInfo))
+	return p
+}
+
+// makeKubeArgs returns extra args of Kubernetes components given guestinfo.
+func makeKubeArgs(guestInfo map[string]string) model.KubeArgs {
+	return model.KubeArgs{
+		KubeletExtraArgs:           guestInfo[kubeletExtraArgsKey],
+		APIServerExtraArgs:         guestInfo[apiServerExtraArgsKey],
+		ControllerManagerExtraArgs: guestInfo[controllerManagerExtraArgsKey],
+		SchedulerExtraArgs:         guestInfo[schedulerExtraArgsKey],
+	}
+}
+
+// makeExtraConfig returns VM extra config options given pool and node
+// guestinfo and base64 encoded userData.
+func makeExtraConfig(pool, node map[string]string, userData []byte) []types.BaseOptionValue {
+	m := make(map[string]string)
+	for k, v := range pool {
+		m[k] = v
+	}
+	for k, v := range node {
+		m[k] = v
+	}
+	m[userDataKey] = base64.StdEncoding.EncodeToString(userData)
+	m[userDataEncodingKey] = "base64"
+
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	opts := []types.BaseOptionValue{}
+	for _, k := range keys {
+		opts = append(opts, &types.OptionValue{Key: k, Value: m[k]})
+	}
+	return opts
+}
+
+// extraConfigToGuestInfo returns keto guestinfo from VM extra config options.
+func extraConfigToGuestInfo(opts []types.BaseOptionValue) map[string]string {
+	m := make(map[string]string)
+	for _, o := range opts {
+		v := o.GetOptionValue()
+		if !strings.HasPrefix(v.Key, guestInfoKeyPrefix) {
+			continue
+		}
+		if s, ok := v.Value.(string); ok {
+			m[v.Key] = s
+		}
+	}
+	return m
+}
+
+// parseMachineType parses a machine type in <vCPUs>x<memory GB> format, e.g.
+// 2x8, and returns the number of vCPUs and memory in MBs.
+func parseMachineType(t string) (int32, int64, error) {
+	s := strings.Split(strings.ToLower(t), "x")
+	if len(s) != 2 {
+		return 0, 0, fmt.Errorf("invalid machine type %q, must be in <vCPUs>x<memory GB> format", t)
+	}
+	cpus, err := strconv.Atoi(s[0])
+	if err != nil || cpus < 1 {
+		return 0, 0, fmt.Errorf("invalid number of vCPUs in machine type %q", t)
+	}
+	mem, err := strconv.Atoi(s[1])
+	if err != nil || mem < 1 {
+		return 0, 0, fmt.Errorf("invalid memory size in machine type %q", t)
+	}
+	return int32(cpus), int64(mem) * 1024, nil
+}
+
+// makeVMName returns a VM name of the n-th node in a pool.
+func makeVMName(clusterName, poolName string, n int) string {
+	return fmt.Sprintf("%s-%s-%d", clusterName, poolName, n)
+}
+
+// makeRuleName returns an anti-affinity rule name of a pool.
+func makeRuleName(clusterName, poolName string) string {
+	return fmt.Sprintf("keto-%s-%s", clusterName, poolName)
+}
@@ -0,0 +1,688 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UKHomeOffice/keto/pkg/cloudprovider"
+	"github.com/UKHomeOffice/keto/pkg/model"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const (
+	// ProviderName is the name of this provider.
+	ProviderName = "vsphere"
+
+	// Environment variables used to configure the provider.
+	urlEnv          = "VSPHERE_URL"
+	userEnv         = "VSPHERE_USER"
+	passwordEnv     = "VSPHERE_PASSWORD"
+	insecureEnv     = "VSPHERE_INSECURE"
+	datacenterEnv   = "VSPHERE_DATACENTER"
+	clusterEnv      = "VSPHERE_CLUSTER"
+	datastoreEnv    = "VSPHERE_DATASTORE"
+	resourcePoolEnv = "VSPHERE_RESOURCE_POOL"
+	folderEnv       = "VSPHERE_FOLDER"
+	masterIPsEnv    = "VSPHERE_MASTER_IPS"
+	kubeAPIHostEnv  = "VSPHERE_KUBE_API_HOST"
+
+	masterPrefixLengthEnv = "VSPHERE_MASTER_PREFIX_LENGTH"
+	masterGatewayEnv      = "VSPHERE_MASTER_GATEWAY"
+	masterDNSEnv          = "VSPHERE_MASTER_DNS"
+
+	defaultMasterPrefixLength = 24
+
+	// Every cluster gets its own VM folder and datastore directory named
+	// after the cluster with this prefix.
+	clusterFolderPrefix = "keto-"
+	clusterSpecFileName = "cluster.json"
+
+	etcdCACertFileName = "etcd_ca.crt"
+	etcdCAKeyFileName  = "etcd_ca.key"
+	kubeCACertFileName = "kube_ca.crt"
+	kubeCAKeyFileName  = "kube_ca.key"
+
+	// serviceTicketCookie is the cookie that ESXi expects service tickets in.
+	serviceTicketCookie = "vmware_cgi_ticket"
+)
+
+var (
+	// ErrNotImplemented defines an error for not implemented features.
+	ErrNotImplemented = errors.New("not implemented")
+	// ErrNoMasterIPs defines an error when master IPs are not configured.
+	ErrNoMasterIPs = fmt.Errorf("master IPs are not configured, %s must be set", masterIPsEnv)
+	// ErrRetainNotSupported defines an error when resources are requested to
+	// be retained on cluster deletion. There are no separate volume, DNS or
+	// load balancer resources in vSphere to retain.
+	ErrRetainNotSupported = errors.New("retaining resources is not supported by vsphere")
+	// ErrNotMaster defines an error when assets are requested on a node that
+	// is not a master.
+	ErrNotMaster = errors.New("only masters have assets")
+
+	// assetFileNames are the names of asset files in a cluster datastore
+	// directory.
+	assetFileNames = []string{etcdCACertFileName, etcdCAKeyFileName, kubeCACertFileName, kubeCAKeyFileName}
+)
+
+// config represents vSphere provider configuration.
+type config struct {
+	URL          string
+	User         string
+	Password     string
+	Insecure     bool
+	Datacenter   string
+	Cluster      string
+	Datastore    string
+	ResourcePool string
+	Folder       string
+	MasterIPs    []string
+	KubeAPIHost  string
+
+	// Static network config of masters.
+	MasterPrefixLength int
+	MasterGateway      string
+	MasterDNS          []string
+}
+
+// configFromEnv returns a config populated from environment variables.
+func configFromEnv() config {
+	cfg := config{
+		URL:          os.Getenv(urlEnv),
+		User:         os.Getenv(userEnv),
+		Password:     os.Getenv(passwordEnv),
+		Datacenter:   os.Getenv(datacenterEnv),
+		Cluster:      os.Getenv(clusterEnv),
+		Datastore:    os.Getenv(datastoreEnv),
+		ResourcePool: os.Getenv(resourcePoolEnv),
+		Folder:       os.Getenv(folderEnv),
+		KubeAPIHost:  os.Getenv(kubeAPIHostEnv),
+
+		MasterGateway: os.Getenv(masterGatewayEnv),
+		MasterDNS:     splitList(os.Getenv(masterDNSEnv)),
+	}
+	cfg.Insecure, _ = strconv.ParseBool(os.Getenv(insecureEnv))
+	cfg.MasterIPs = splitList(os.Getenv(masterIPsEnv))
+	cfg.MasterPrefixLength, _ = strconv.Atoi(os.Getenv(masterPrefixLengthEnv))
+	if cfg.MasterPrefixLength == 0 {
+		cfg.MasterPrefixLength = defaultMasterPrefixLength
+	}
+	return cfg
+}
+
+// splitList returns non-empty items of a comma separated list.
+func splitList(s string) []string {
+	items := []string{}
+	for _, i := range strings.Split(s, ",") {
+		if i = strings.TrimSpace(i); i != "" {
+			items = append(items, i)
+		}
+	}
+	return items
+}
+
+// Cloud is an implementation of cloudprovider.Interface.
+type Cloud struct {
+	Logger cloudprovider.Logger
+	config config
+	cache  cloudprovider.Cache
+
+	// client and friends are set up lazily on first use, so that nodes,
+	// which only read guestinfo, do not need vCenter credentials.
+	client    *govmomi.Client
+	finder    *find.Finder
+	dc        *object.Datacenter
+	datastore *object.Datastore
+
+	// requestTimeout limits how long a single vSphere API call may take.
+	requestTimeout time.Duration
+	// operationTimeout limits how long to wait for a provider operation.
+	operationTimeout time.Duration
+}
+
+// Compile-time check whether Cloud type value implements
+// cloudprovider.Interface interface.
+var _ cloudprovider.Interface = (*Cloud)(nil)
+
+// ProviderName returns the cloud provider ID.
+func (c *Cloud) ProviderName() string {
+	return ProviderName
+}
+
+// Clusters returns an implementation of Clusters interface for vSphere Cloud.
+func (c *Cloud) Clusters() (cloudprovider.Clusters, bool) {
+	return c, true
+}
+
+// Events returns an implementation of Events interface for vSphere Cloud.
+// Events are not supported yet.
+func (c *Cloud) Events() (cloudprovider.Events, bool) {
+	return nil, false
+}
+
+// Drift returns an implementation of Drift interface for vSphere Cloud. Drift
+// is not supported.
+func (c *Cloud) Drift() (cloudprovider.Drift, bool) {
+	return nil, false
+}
+
+// Capabilities returns optional features supported by vSphere Cloud. The kube
+// API is served by master IPs, there is no load balancer.
+func (c *Cloud) Capabilities() cloudprovider.Capabilities {
+	return cloudprovider.Capabilities{
+		// Node pool guestinfo has no SSH keys or networks.
+		NodePoolFields: []string{
+			"kube_version", "coreos_version", "machine_type", "disk_size",
+			"size", "labels", "extra_args",
+		},
+	}
+}
+
+// clusterSpec is a cluster spec stored in the cluster datastore directory.
+// Master IPs are stored, so that every cluster keeps its own masters if the
+// configuration changes afterwards.
+type clusterSpec struct {
+	model.Cluster
+	MasterIPs []string `json:"master_ips,omitempty"`
+}
+
+// CreateClusterInfra creates a VM folder and a datastore directory for a new
+// cluster and stores the cluster spec. The cluster gets the configured master
+// IPs, unless another cluster already uses any of them.
+func (c *Cloud) CreateClusterInfra(cluster model.Cluster) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	if err := c.connect(ctx); err != nil {
+		return err
+	}
+	if len(c.config.MasterIPs) == 0 {
+		return ErrNoMasterIPs
+	}
+	specs, err := c.getClusterSpecs(ctx, "")
+	if err != nil {
+		return err
+	}
+	if err := c.checkMasterIPs(c.config.MasterIPs, specs); err != nil {
+		return err
+	}
+
+	base, err := c.baseFolder(ctx)
+	if err != nil {
+		return err
+	}
+	c.Logger.Printf("creating folder %q", makeClusterFolderName(cluster.Name))
+	if _, err := base.CreateFolder(ctx, makeClusterFolderName(cluster.Name)); err != nil {
+		return err
+	}
+
+	b, err := encodeClusterSpec(clusterSpec{Cluster: cluster, MasterIPs: c.config.MasterIPs})
+	if err != nil {
+		return err
+	}
+	return c.putFile(ctx, cluster.Name, clusterSpecFileName, b)
+}
+
+// checkMasterIPs returns an error if any of the master IPs is used by one of
+// the existing clusters.
+func (c *Cloud) checkMasterIPs(ips []string, specs []*clusterSpec) error {
+	used := make(map[string]string)
+	for _, spec := range specs {
+		for _, ip := range c.masterIPs(spec) {
+			used[ip] = spec.Name
+		}
+	}
+	for _, ip := range ips {
+		if name, ok := used[ip]; ok {
+			return fmt.Errorf("master IP %s is already used by cluster %q, %s must be set to free IPs", ip, name, masterIPsEnv)
+		}
+	}
+	return nil
+}
+
+// masterIPs returns master IPs of a cluster. Clusters created before master
+// IPs were stored with them use the configured master IPs.
+func (c *Cloud) masterIPs(spec *clusterSpec) []string {
+	if len(spec.MasterIPs) == 0 {
+		return c.config.MasterIPs
+	}
+	return spec.MasterIPs
+}
+
+// encodeClusterSpec encodes a cluster spec to be stored in the datastore,
+// including the cluster DNS config that masters are rendered with.
+func encodeClusterSpec(spec clusterSpec) ([]byte, error) {
+	// Node pools are stored separately, as VMs.
+	spec.MasterPool = model.MasterPool{}
+	spec.ComputePools = nil
+	return json.Marshal(spec)
+}
+
+// decodeClusterSpec decodes a cluster spec stored in the datastore.
+func decodeClusterSpec(b []byte) (*clusterSpec, error) {
+	spec := &clusterSpec{}
+	err := json.Unmarshal(b, spec)
+	return spec, err
+}
+
+// GetClusters returns a cluster by name or all clusters in the base folder.
+func (c *Cloud) GetClusters(name string) ([]*model.Cluster, error) {
+	clusters := []*model.Cluster{}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	if err := c.connect(ctx); err != nil {
+		return clusters, err
+	}
+
+	specs, err := c.getClusterSpecs(ctx, name)
+	if err != nil {
+		return clusters, err
+	}
+	for _, spec := range specs {
+		cluster := spec.Cluster
+		cluster.KubeAPIURL = c.kubeAPIURL(spec)
+		clusters = append(clusters, &cluster)
+	}
+	return clusters, nil
+}
+
+// getClusterSpecs returns a spec of a cluster by name or of all clusters in
+// the base folder.
+func (c *Cloud) getClusterSpecs(ctx context.Context, name string) ([]*clusterSpec, error) {
+	specs := []*clusterSpec{}
+
+	names, err := c.getClusterNames(ctx)
+	if err != nil {
+		return specs, err
+	}
+	for _, n := range names {
+		if name != "" && n != name {
+			continue
+		}
+		b, err := c.getFile(ctx, n, clusterSpecFileName)
+		if err != nil {
+			return specs, fmt.Errorf("failed to get cluster %q spec: %v", n, err)
+		}
+		spec, err := decodeClusterSpec(b)
+		if err != nil {
+			return specs, fmt.Errorf("failed to decode cluster %q spec: %v", n, err)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// getClusterSpec returns a spec of a given cluster.
+func (c *Cloud) getClusterSpec(ctx context.Context, name string) (*clusterSpec, error) {
+	specs, err := c.getClusterSpecs(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("cluster %q does not exist", name)
+	}
+	return specs[0], nil
+}
+
+// getClusterNames returns names of keto managed clusters, each of them being
+// a prefixed folder in the base folder.
+func (c *Cloud) getClusterNames(ctx context.Context) ([]string, error) {
+	names := []string{}
+
+	base, err := c.baseFolder(ctx)
+	if err != nil {
+		return names, err
+	}
+	children, err := base.Children(ctx)
+	if err != nil {
+		return names, err
+	}
+	refs := []types.ManagedObjectReference{}
+	for _, ch := range children {
+		if f, ok := ch.(*object.Folder); ok {
+			refs = append(refs, f.Reference())
+		}
+	}
+	if len(refs) == 0 {
+		return names, nil
+	}
+
+	var folders []mo.Folder
+	if err := property.DefaultCollector(c.client.Client).Retrieve(ctx, refs, []string{"name"}, &folders); err != nil {
+		return names, err
+	}
+	for _, f := range folders {
+		if strings.HasPrefix(f.Name, clusterFolderPrefix) {
+			names = append(names, strings.TrimPrefix(f.Name, clusterFolderPrefix))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// DescribeCluster describes a given cluster.
+func (c *Cloud) DescribeCluster(name string) error {
+	return ErrNotImplemented
+}
+
+// DeleteCluster deletes a cluster's node pools, its datastore directory and
+// the VM folder.
+func (c *Cloud) DeleteCluster(name string, retain []string) ([]*model.Resource, error) {
+	retained := []*model.Resource{}
+	if len(retain) > 0 {
+		return retained, ErrRetainNotSupported
+	}
+
+	c.Logger.Printf("deleting compute pools that belong to cluster %q", name)
+	if err := c.DeleteComputePool(name, ""); err != nil {
+		return retained, err
+	}
+	c.Logger.Printf("deleting master pool that belongs to cluster %q", name)
+	if err := c.DeleteMasterPool(name); err != nil {
+		return retained, err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	if err := c.connect(ctx); err != nil {
+		return retained, err
+	}
+
+	dir := c.datastore.Path(makeClusterFolderName(name))
+	c.Logger.Printf("deleting datastore directory %q", dir)
+	task, err := object.NewFileManager(c.client.Client).DeleteDatastoreFile(ctx, dir, c.dc)
+	if err != nil {
+		return retained, err
+	}
+	if err := task.Wait(ctx); err != nil {
+		return retained, err
+	}
+
+	folder, err := c.clusterFolder(ctx, name)
+	if err != nil {
+		return retained, err
+	}
+	c.Logger.Printf("deleting folder %q", folder.InventoryPath)
+	task, err = folder.Destroy(ctx)
+	if err != nil {
+		return retained, err
+	}
+	return retained, task.Wait(ctx)
+}
+
+// GetMasterPersistentIPs returns a map of master node IDs to their IPs. On
+// premises master IPs are reserved up front and stored with the cluster spec.
+func (c *Cloud) GetMasterPersistentIPs(clusterName string) (map[string]string, error) {
+	m := make(map[string]string)
+
+	ctx, cancel := c.context()
+	defer cancel()
+	if err := c.connect(ctx); err != nil {
+		return m, err
+	}
+	spec, err := c.getClusterSpec(ctx, clusterName)
+	if err != nil {
+		return m, err
+	}
+	ips := c.masterIPs(spec)
+	if len(ips) == 0 {
+		return m, ErrNoMasterIPs
+	}
+	for i, ip := range ips {
+		m[strconv.Itoa(i)] = ip
+	}
+	return m, nil
+}
+
+// PushAssets uploads assets to the cluster datastore directory, which only
+// keto and masters, with one-time tickets, download them from.
+func (c *Cloud) PushAssets(clusterName string, a model.Assets) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	if err := c.connect(ctx); err != nil {
+		return err
+	}
+
+	// We only need the assets for the initial bootstrap.
+	if err := c.putFile(ctx, clusterName, etcdCACertFileName, a.EtcdCACert); err != nil {
+		return err
+	}
+	if err := c.putFile(ctx, clusterName, etcdCAKeyFileName, a.EtcdCAKey); err != nil {
+		return err
+	}
+	if err := c.putFile(ctx, clusterName, kubeCACertFileName, a.KubeCACert); err != nil {
+		return err
+	}
+	return c.putFile(ctx, clusterName, kubeCAKeyFileName, a.KubeCAKey)
+}
+
+// assetTickets is how a master downloads assets from the cluster datastore
+// directory. It is stored as JSON in master guestinfo.
+type assetTickets struct {
+	// Thumbprint is the SHA-1 thumbprint of the host certificate, ESXi hosts
+	// usually have self-signed ones.
+	Thumbprint string `json:"thumbprint,omitempty"`
+	// Assets are keyed by asset file name.
+	Assets map[string]assetTicket `json:"assets"`
+}
+
+// assetTicket is a one-time ticket to download an asset file from a host.
+type assetTicket struct {
+	URL    string `json:"url"`
+	Ticket string `json:"ticket"`
+}
+
+// putAssetTickets waits for a master VM to come up and adds tickets to
+// download assets from the host it runs on to its guestinfo. A ticket can
+// only be used once, so it is useless once the master has saved the assets.
+func (c *Cloud) putAssetTickets(ctx context.Context, clusterName string, v *poolVM) error {
+	c.Logger.Printf("waiting for VM %q to come up", v.name)
+	if _, err := v.vm.WaitForIP(ctx); err != nil {
+		return fmt.Errorf("failed to wait for VM %q: %v", v.name, err)
+	}
+	host, err := v.vm.HostSystem(ctx)
+	if err != nil {
+		return err
+	}
+	var h mo.HostSystem
+	if err := host.Properties(ctx, host.Reference(), []string{"summary.config"}, &h); err != nil {
+		return err
+	}
+
+	tickets := assetTickets{Thumbprint: h.Summary.Config.SslThumbprint, Assets: make(map[string]assetTicket)}
+	hostCtx := c.datastore.HostContext(ctx, host)
+	for _, name := range assetFileNames {
+		u, cookie, err := c.datastore.ServiceTicket(hostCtx, path.Join(makeClusterFolderName(clusterName), name), http.MethodGet)
+		if err != nil {
+			return err
+		}
+		if cookie == nil {
+			return fmt.Errorf("no service ticket to download %q", name)
+		}
+		tickets.Assets[name] = assetTicket{URL: u.String(), Ticket: cookie.Value}
+	}
+	b, err := json.Marshal(tickets)
+	if err != nil {
+		return err
+	}
+
+	c.Logger.Printf("adding asset tickets to VM %q", v.name)
+	task, err := v.vm.Reconfigure(ctx, types.VirtualMachineConfigSpec{
+		ExtraConfig: []types.BaseOptionValue{&types.OptionValue{Key: assetTicketsKey, Value: string(b)}},
+	})
+	if err != nil {
+		return err
+	}
+	return task.Wait(ctx)
+}
+
+// putFile uploads b as a file name to a cluster datastore directory.
+func (c *Cloud) putFile(ctx context.Context, clusterName, name string, b []byte) error {
+	dir := makeClusterFolderName(clusterName)
+	if err := object.NewFileManager(c.client.Client).MakeDirectory(ctx, c.datastore.Path(dir), c.dc, true); err != nil {
+		// MakeDirectory fails if the directory already exists.
+		if !soap.IsSoapFault(err) {
+			return err
+		}
+		if _, ok := soap.ToSoapFault(err).VimFault().(types.FileAlreadyExists); !ok {
+			return err
+		}
+	}
+
+	p := path.Join(dir, name)
+	c.Logger.Printf("uploading %q to datastore %q", p, c.datastore.Name())
+	return c.datastore.Upload(ctx, bytes.NewReader(b), p, &soap.DefaultUpload)
+}
+
+// getFile downloads a file name from a cluster datastore directory.
+func (c *Cloud) getFile(ctx context.Context, clusterName, name string) ([]byte, error) {
+	p := path.Join(makeClusterFolderName(clusterName), name)
+	c.Logger.Printf("downloading %q from datastore %q", p, c.datastore.Name())
+	r, _, err := c.datastore.Download(ctx, p, &soap.DefaultDownload)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// kubeAPIURL returns a Kubernetes API URL of a cluster. There is no load
+// balancer managed by keto on premises, so unless an API host is configured,
+// the first master is used.
+func (c *Cloud) kubeAPIURL(spec *clusterSpec) string {
+	host := c.config.KubeAPIHost
+	if ips := c.masterIPs(spec); host == "" && len(ips) > 0 {
+		host = ips[0]
+	}
+	if host == "" {
+		return ""
+	}
+	return "https://" + strings.ToLower(host)
+}
+
+// context returns a context for a single provider operation, it is cancelled
+// once operationTimeout passes.
+func (c *Cloud) context() (context.Context, context.CancelFunc) {
+	if c.operationTimeout > 0 {
+		return context.WithTimeout(context.Background(), c.operationTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// connect logs in to vCenter and looks up the configured datacenter and
+// datastore, unless that has been done already.
+func (c *Cloud) connect(ctx context.Context) error {
+	if c.client != nil {
+		return nil
+	}
+	if c.config.URL == "" {
+		return fmt.Errorf("%s is not set", urlEnv)
+	}
+	u, err := soap.ParseURL(c.config.URL)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", urlEnv, err)
+	}
+	if c.config.User != "" {
+		u.User = url.UserPassword(c.config.User, c.config.Password)
+	}
+
+	// Same as govmomi.NewClient, but with a request timeout.
+	soapClient := soap.NewClient(u, c.config.Insecure)
+	soapClient.Timeout = c.requestTimeout
+	vimClient, err := vim25.NewClient(ctx, soapClient)
+	if err != nil {
+		return err
+	}
+	client := &govmomi.Client{
+		Client:         vimClient,
+		SessionManager: session.NewManager(vimClient),
+	}
+	c.Logger.Printf("logging in to %q", u.Host)
+	if err := client.Login(ctx, u.User); err != nil {
+		return err
+	}
+
+	finder := find.NewFinder(client.Client, true)
+	dc, err := finder.DatacenterOrDefault(ctx, c.config.Datacenter)
+	if err != nil {
+		return err
+	}
+	finder.SetDatacenter(dc)
+	ds, err := finder.DatastoreOrDefault(ctx, c.config.Datastore)
+	if err != nil {
+		return err
+	}
+
+	c.client, c.finder, c.dc, c.datastore = client, finder, dc, ds
+	return nil
+}
+
+// baseFolder returns a VM folder in which cluster folders are created.
+func (c *Cloud) baseFolder(ctx context.Context) (*object.Folder, error) {
+	return c.finder.FolderOrDefault(ctx, c.config.Folder)
+}
+
+// clusterFolder returns a VM folder of a given cluster.
+func (c *Cloud) clusterFolder(ctx context.Context, clusterName string) (*object.Folder, error) {
+	base, err := c.baseFolder(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.finder.Folder(ctx, path.Join(base.InventoryPath, makeClusterFolderName(clusterName)))
+}
+
+// makeClusterFolderName returns a folder name of a given cluster.
+func makeClusterFolderName(clusterName string) string {
+	return clusterFolderPrefix + clusterName
+}
+
+// init registers vSphere cloud with the cloudprovider.
+func init() {
+	// f knows how to initialize the cloud
+	f := func(l cloudprovider.Logger, cfg cloudprovider.Config) (cloudprovider.Interface, error) {
+		return &Cloud{
+			Logger:           l,
+			config:           configFromEnv(),
+			cache:            cfg.Cache,
+			requestTimeout:   cfg.RequestTimeout,
+			operationTimeout: cfg.OperationTimeout,
+		}, nil
+	}
+	cloudprovider.Register(ProviderName, f)
+}
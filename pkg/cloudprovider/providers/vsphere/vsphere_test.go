@@ -0,0 +1,353 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/UKHomeOffice/keto/pkg/cache"
+	"github.com/UKHomeOffice/keto/pkg/model"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestParseMachineType(t *testing.T) {
+	testCases := []struct {
+		input    string
+		cpus     int32
+		memoryMB int64
+		wantErr  bool
+	}{
+		{"2x8", 2, 8192, false},
+		{"16X64", 16, 65536, false},
+		{"", 0, 0, true},
+		{"m4.large", 0, 0, true},
+		{"0x8", 0, 0, true},
+		{"2xfoo", 0, 0, true},
+	}
+
+	for _, tc := range testCases {
+		cpus, mem, err := parseMachineType(tc.input)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%q: got error %v; want error %v", tc.input, err, tc.wantErr)
+			continue
+		}
+		if cpus != tc.cpus || mem != tc.memoryMB {
+			t.Errorf("%q: got %d vCPUs and %d MB; want %d vCPUs and %d MB", tc.input, cpus, mem, tc.cpus, tc.memoryMB)
+		}
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	os.Setenv(masterIPsEnv, "10.0.0.1, 10.0.0.2,,10.0.0.3")
+	os.Setenv(insecureEnv, "true")
+	defer os.Unsetenv(masterIPsEnv)
+	defer os.Unsetenv(insecureEnv)
+
+	cfg := configFromEnv()
+	want := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	if !reflect.DeepEqual(cfg.MasterIPs, want) {
+		t.Errorf("got master IPs %v; want %v", cfg.MasterIPs, want)
+	}
+	if !cfg.Insecure {
+		t.Error("got insecure false; want true")
+	}
+	if cfg.MasterPrefixLength != defaultMasterPrefixLength {
+		t.Errorf("got master prefix length %d; want %d", cfg.MasterPrefixLength, defaultMasterPrefixLength)
+	}
+}
+
+func TestMakeNetworkGuestInfo(t *testing.T) {
+	c := Cloud{config: config{MasterPrefixLength: 24, MasterGateway: "10.0.0.254", MasterDNS: []string{"10.0.0.2", "10.0.0.3"}}}
+
+	got := c.makeNetworkGuestInfo("00:50:56:00:00:01", "10.0.0.1")
+	want := map[string]string{
+		interfaceMACKey:          "00:50:56:00:00:01",
+		interfaceDHCPKey:         "no",
+		interfaceAddressKey:      "10.0.0.1/24",
+		interfaceGatewayKey:      "10.0.0.254",
+		interfaceDestinationKey:  "0.0.0.0/0",
+		dnsServerKeyPrefix + "0": "10.0.0.2",
+		dnsServerKeyPrefix + "1": "10.0.0.3",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestNodePoolGuestInfo(t *testing.T) {
+	p := model.NodePool{}
+	p.ClusterName = "foo"
+	p.Name = "compute0"
+	p.KubeVersion = "v1.6.4"
+	p.CoreOSVersion = "coreos-stable-template"
+	p.MachineType = "2x8"
+	p.DiskSize = 20
+	p.Labels = model.Labels{"team": "a", "env": "dev"}
+
+	guestInfo := makePoolGuestInfo(p, computePoolType, "https://10.0.0.1")
+	opts := makeExtraConfig(guestInfo, map[string]string{nodeIDKey: "1"}, []byte("#cloud-config"))
+
+	got := extraConfigToGuestInfo(opts)
+	if got[nodeIDKey] != "1" {
+		t.Errorf("got node ID %q; want %q", got[nodeIDKey], "1")
+	}
+	if _, ok := got[userDataKey]; ok {
+		t.Errorf("user data must not be part of keto guestinfo")
+	}
+
+	pools := groupNodePools([]*poolVM{{name: "a", guestInfo: got}, {name: "b", guestInfo: got}})
+	if len(pools) != 1 {
+		t.Fatalf("got %d pools; want 1", len(pools))
+	}
+	p.Size = 2
+	if !reflect.DeepEqual(*pools[0], p) {
+		t.Errorf("got pool %+v; want %+v", *pools[0], p)
+	}
+}
+
+func TestGetNodeData(t *testing.T) {
+	guestInfo := map[string]string{
+		kubeAPIURLKey:  "https://10.0.0.1",
+		clusterNameKey: "foo",
+		kubeVersionKey: "v1.6.4",
+		labelsKey:      "env=dev,team=a",
+	}
+	defer func(f func(string) (string, error)) { getGuestInfo = f }(getGuestInfo)
+	getGuestInfo = func(key string) (string, error) {
+		v, ok := guestInfo[key]
+		if !ok {
+			return "", errors.New("no value")
+		}
+		return v, nil
+	}
+
+	c := Cloud{}
+	data, err := c.GetNodeData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := model.NodeData{
+		KubeAPIURL:  "https://10.0.0.1",
+		ClusterName: "foo",
+		KubeVersion: "v1.6.4",
+		Labels:      model.Labels{"env": "dev", "team": "a"},
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("got %+v; want %+v", data, want)
+	}
+
+	if _, err := c.GetAssets(); err == nil {
+		t.Error("expected an error getting assets from a non-master node")
+	}
+}
+
+func TestClusterSpecDNSConfig(t *testing.T) {
+	cluster := model.Cluster{
+		ResourceMeta: model.ResourceMeta{Name: "foo"},
+		MasterPool:   model.MasterPool{NodePool: model.NodePool{ResourceMeta: model.ResourceMeta{Name: "master"}}},
+		DNS:          model.DNSConfig{Provider: "kube-dns", UpstreamNameservers: []string{"10.0.0.2"}},
+	}
+
+	b, err := encodeClusterSpec(clusterSpec{Cluster: cluster})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeClusterSpec(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.DNS, cluster.DNS) {
+		t.Errorf("got DNS config %+v; want %+v", got.DNS, cluster.DNS)
+	}
+	if got.MasterPool.Name != "" {
+		t.Errorf("master pool should not be stored with the cluster spec, got %+v", got.MasterPool)
+	}
+}
+
+func TestGetAssets(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie(serviceTicketCookie); err != nil || c.Value != "ticket-"+path.Base(r.URL.Path) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(path.Base(r.URL.Path)))
+	}))
+	defer srv.Close()
+
+	tickets := assetTickets{
+		Thumbprint: makeThumbprint(srv.TLS.Certificates[0].Certificate[0]),
+		Assets:     make(map[string]assetTicket),
+	}
+	for _, name := range assetFileNames {
+		tickets.Assets[name] = assetTicket{URL: srv.URL + "/folder/keto-foo/" + name, Ticket: "ticket-" + name}
+	}
+	b, err := json.Marshal(tickets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guestInfo := map[string]string{poolTypeKey: masterPoolType, assetTicketsKey: string(b)}
+	defer func(f func(string) (string, error)) { getGuestInfo = f }(getGuestInfo)
+	getGuestInfo = func(key string) (string, error) {
+		v, ok := guestInfo[key]
+		if !ok {
+			return "", errors.New("no value")
+		}
+		return v, nil
+	}
+
+	c := Cloud{}
+	a, err := c.GetAssets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := model.Assets{
+		EtcdCACert: []byte(etcdCACertFileName),
+		EtcdCAKey:  []byte(etcdCAKeyFileName),
+		KubeCACert: []byte(kubeCACertFileName),
+		KubeCAKey:  []byte(kubeCAKeyFileName),
+	}
+	if !reflect.DeepEqual(a, want) {
+		t.Errorf("got assets %+v; want %+v", a, want)
+	}
+
+	// Only the host certificate is trusted.
+	tickets.Thumbprint = "00:00:00"
+	b, err = json.Marshal(tickets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guestInfo[assetTicketsKey] = string(b)
+	if _, err := c.GetAssets(); err == nil {
+		t.Error("expected an error for a host certificate thumbprint mismatch")
+	}
+
+	// Tickets are added to guestinfo once the master is up.
+	defer func(d time.Duration) { assetTicketsTimeout = d }(assetTicketsTimeout)
+	defer func(d time.Duration) { assetTicketsPollInterval = d }(assetTicketsPollInterval)
+	assetTicketsTimeout, assetTicketsPollInterval = 10*time.Millisecond, time.Millisecond
+	delete(guestInfo, assetTicketsKey)
+	if _, err := c.GetAssets(); err == nil {
+		t.Error("expected an error without asset tickets")
+	}
+}
+
+func TestRPCTool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keto-vsphere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { hostUsrDir = d }(hostUsrDir)
+	hostUsrDir = dir
+
+	if cmd := rpcTool("info-get foo"); !reflect.DeepEqual(cmd.Args, []string{"vmware-rpctool", "info-get foo"}) {
+		t.Errorf("got command %v without a host loader; want the tool in PATH", cmd.Args)
+	}
+
+	loader := filepath.Join(dir, "lib64", "ld-linux-x86-64.so.2")
+	if err := os.MkdirAll(filepath.Dir(loader), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(loader, nil, 0700); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{loader, "--library-path", filepath.Join(dir, "lib64"), filepath.Join(dir, "bin", "vmware-rpctool"), "info-get foo"}
+	if cmd := rpcTool("info-get foo"); !reflect.DeepEqual(cmd.Args, want) {
+		t.Errorf("got command %v; want %v", cmd.Args, want)
+	}
+}
+
+func TestCheckMasterIPs(t *testing.T) {
+	c := &Cloud{config: config{MasterIPs: []string{"10.0.0.1", "10.0.0.2"}}}
+	specs := []*clusterSpec{
+		{Cluster: model.Cluster{ResourceMeta: model.ResourceMeta{Name: "foo"}}, MasterIPs: []string{"10.0.1.1"}},
+		{Cluster: model.Cluster{ResourceMeta: model.ResourceMeta{Name: "bar"}}, MasterIPs: []string{"10.0.2.1"}},
+	}
+	if err := c.checkMasterIPs([]string{"10.0.0.1", "10.0.0.2"}, specs); err != nil {
+		t.Error(err)
+	}
+	if err := c.checkMasterIPs([]string{"10.0.0.1", "10.0.2.1"}, specs); err == nil {
+		t.Error("expected an error, master IP is used by another cluster")
+	}
+
+	// A cluster without stored master IPs uses the configured ones.
+	specs = append(specs, &clusterSpec{Cluster: model.Cluster{ResourceMeta: model.ResourceMeta{Name: "baz"}}})
+	if err := c.checkMasterIPs([]string{"10.0.0.2"}, specs); err == nil {
+		t.Error("expected an error, master IP is used by a cluster without stored master IPs")
+	}
+}
+
+func TestValidateNodePoolCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keto-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A non-nil client makes connect a no-op.
+	c := &Cloud{
+		Logger: log.New(ioutil.Discard, "", 0),
+		cache:  cache.New(dir, time.Hour),
+		client: &govmomi.Client{},
+	}
+	calls := 0
+	find := func(name string) (types.ManagedObjectReference, error) {
+		calls++
+		return types.ManagedObjectReference{Type: "VirtualMachine", Value: name}, nil
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.findCached(context.Background(), "templates", "coreos-stable", find); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.findCached(context.Background(), "networks", "VM Network", find); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("got %d lookups; want 2", calls)
+	}
+
+	// Without a client or a URL, vCenter can't be logged in to, so the
+	// validation is served from the cache.
+	c.client = nil
+	p := model.NodePool{NodePoolSpec: model.NodePoolSpec{
+		MachineType:   "2x4",
+		CoreOSVersion: "coreos-stable",
+		Networks:      []string{"VM Network"},
+	}}
+	if err := c.ValidateNodePool(p); err != nil {
+		t.Error(err)
+	}
+	p.Networks = []string{"other"}
+	if err := c.ValidateNodePool(p); err == nil {
+		t.Error("expected an error, an uncached network needs a vCenter login")
+	}
+}
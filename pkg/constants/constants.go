@@ -1,5 +1,7 @@
 package constants
 
+import "time"
+
 const (
 	// DefaultKubeVersion specifies a default kubernetes version.
 	DefaultKubeVersion = "v1.7.0"
@@ -7,6 +9,15 @@ const (
 	DefaultNetworkProvider = "canal"
 	// DefaultKetoK8Image specifies the image to use for keto-k8 container
 	DefaultKetoK8Image = "quay.io/ukhomeofficedigital/keto-k8:v0.2.1"
+	// DefaultDNSAutoscalerImage specifies the image to use for the DNS
+	// replicas autoscaler
+	DefaultDNSAutoscalerImage = "gcr.io/google_containers/cluster-proportional-autoscaler-amd64:1.1.2"
+	// DefaultCoreDNSImage specifies the image to use for the CoreDNS cluster
+	// DNS addon
+	DefaultCoreDNSImage = "coredns/coredns:1.0.1"
+	// DefaultAddonManagerImage specifies the image to use for the addon
+	// manager that applies cluster addons on masters
+	DefaultAddonManagerImage = "gcr.io/google-containers/kube-addon-manager:v6.4-beta.2"
 	// DefaultComputePoolSize specifies a default number of machines in a single compute pool.
 	DefaultComputePoolSize = 1
 	// DefaultDiskSizeInGigabytes specifies a default node disk size in gigabytes.
@@ -16,6 +27,54 @@ const (
 	// validation and CoreOS version to cloud image name mapping.
 	DefaultCoreOSVersion = "CoreOS-stable-1353.8.0-hvm"
 
+	// DriftPolicyNotify only reports out-of-band changes to cluster resources.
+	DriftPolicyNotify = "notify"
+	// DriftPolicyCorrect reverts out-of-band changes to cluster resources back
+	// to the declared spec.
+	DriftPolicyCorrect = "correct"
+	// DefaultDriftPolicy specifies a default cluster drift policy.
+	DefaultDriftPolicy = DriftPolicyNotify
+
+	// DNSProviderKubeDNS is the kube-dns cluster DNS addon.
+	DNSProviderKubeDNS = "kube-dns"
+	// DNSProviderCoreDNS is the CoreDNS cluster DNS addon, which replaces
+	// kube-dns.
+	DNSProviderCoreDNS = "coredns"
+	// DefaultDNSProvider specifies a default cluster DNS addon.
+	DefaultDNSProvider = DNSProviderKubeDNS
+
+	// DefaultDNSMinReplicas specifies a default minimum number of DNS
+	// replicas, when autoscaling them.
+	DefaultDNSMinReplicas = 1
+	// DefaultDNSCoresPerReplica specifies a default number of cluster cores
+	// per DNS replica, when autoscaling them.
+	DefaultDNSCoresPerReplica = 256
+	// DefaultDNSNodesPerReplica specifies a default number of cluster nodes
+	// per DNS replica, when autoscaling them.
+	DefaultDNSNodesPerReplica = 16
+
+	// RetainDNS retains cluster DNS records on cluster deletion.
+	RetainDNS = "dns"
+	// RetainVolumes retains master persistent volumes on cluster deletion.
+	RetainVolumes = "volumes"
+	// RetainLB retains the kube API load balancer on cluster deletion.
+	RetainLB = "lb"
+
+	// DefaultRequestTimeout specifies a default timeout of a single cloud
+	// provider API call.
+	DefaultRequestTimeout = time.Minute
+	// DefaultOperationTimeout specifies a default timeout of long running
+	// cloud operations, e.g. creating a node pool.
+	DefaultOperationTimeout = 30 * time.Minute
+
+	// DefaultCacheTTL specifies for how long read-only cloud provider
+	// responses are cached by default.
+	DefaultCacheTTL = 24 * time.Hour
+
+	// DefaultNodeReadyTimeout specifies a default time to wait for node pool
+	// nodes to register with the cluster API and become ready.
+	DefaultNodeReadyTimeout = 15 * time.Minute
+
 	// ClusterNameLabelKey label key name for cluster name label.
 	ClusterNameLabelKey = "cluster-name"
 	// PoolNameLabelKey label key name for pool name label.
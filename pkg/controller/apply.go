@@ -0,0 +1,417 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/UKHomeOffice/keto/pkg/constants"
+	"github.com/UKHomeOffice/keto/pkg/manifest"
+	"github.com/UKHomeOffice/keto/pkg/model"
+)
+
+// Actions of planned resource changes.
+const (
+	// ActionCreate creates a resource that does not exist.
+	ActionCreate = "create"
+	// ActionReplace deletes a resource and creates it with a new spec.
+	ActionReplace = "replace"
+	// ActionNone leaves an unchanged resource alone.
+	ActionNone = "none"
+)
+
+// Change is a planned change of a single manifest resource.
+type Change struct {
+	Kind        string
+	ClusterName string
+	Name        string
+	Action      string
+	// Diff lists spec fields that differ from the existing resource.
+	Diff []string
+	// Drift lists out-of-band changes to cloud resources of an unchanged
+	// compute pool, which are handled according to the cluster drift policy.
+	Drift       []string
+	DriftPolicy string
+
+	cluster     model.Cluster
+	masterPool  model.MasterPool
+	computePool model.ComputePool
+}
+
+// Plan resolves cluster references of manifest resources and returns changes
+// needed to apply the manifest, in dependency order. A cluster comes first,
+// followed by its master pool and then its compute pools.
+//
+// Only compute pools can be changed in place, by replacing them. A changed
+// cluster or master pool is reported as an error. Node pools to be created or
+// replaced are validated with the cloud provider and unchanged compute pools
+// are checked for drift, if the cloud provider supports it.
+func (c *Controller) Plan(m manifest.Manifest) ([]*Change, error) {
+	changes := []*Change{}
+
+	pooler, impl := c.Cloud.NodePooler()
+	if !impl {
+		return changes, ErrNotImplemented
+	}
+
+	existing, err := c.GetClusters()
+	if err != nil {
+		return changes, err
+	}
+	existingClusters := make(map[string]*model.Cluster)
+	for _, cl := range existing {
+		existingClusters[cl.Name] = cl
+	}
+
+	// Resolve cluster references, keeping the order clusters were defined or
+	// first referenced in.
+	order := []string{}
+	defined := make(map[string]model.Cluster)
+	for _, cl := range m.Clusters {
+		defined[cl.Name] = cl
+		order = append(order, cl.Name)
+	}
+	masterPools := make(map[string]model.MasterPool)
+	for _, p := range m.MasterPools {
+		masterPools[p.ClusterName] = p
+	}
+	computePools := make(map[string][]model.ComputePool)
+	for _, p := range m.ComputePools {
+		computePools[p.ClusterName] = append(computePools[p.ClusterName], p)
+	}
+	refs := []model.NodePool{}
+	for _, p := range m.MasterPools {
+		refs = append(refs, p.NodePool)
+	}
+	for _, p := range m.ComputePools {
+		refs = append(refs, p.NodePool)
+	}
+	for _, p := range refs {
+		if _, ok := defined[p.ClusterName]; ok {
+			continue
+		}
+		if _, ok := existingClusters[p.ClusterName]; !ok {
+			return changes, fmt.Errorf("node pool %q references unknown cluster %q", p.Name, p.ClusterName)
+		}
+		if !stringInSlice(p.ClusterName, order) {
+			order = append(order, p.ClusterName)
+		}
+	}
+
+	for _, name := range order {
+		cl, isDefined := defined[name]
+		current, exists := existingClusters[name]
+		mp, hasMasterPool := masterPools[name]
+
+		if !exists {
+			if !hasMasterPool {
+				return changes, fmt.Errorf("new cluster %q has no masterpool defined", name)
+			}
+			// A new cluster is created along with its node pools.
+			cl.MasterPool = mp
+			cl.ComputePools = computePools[name]
+			if err := c.validateNodePool(mp.NodePool); err != nil {
+				return changes, err
+			}
+			for _, p := range computePools[name] {
+				if err := c.validateNodePool(p.NodePool); err != nil {
+					return changes, err
+				}
+			}
+			changes = append(changes,
+				&Change{Kind: manifest.KindCluster, Name: name, Action: ActionCreate, cluster: cl},
+				&Change{Kind: manifest.KindMasterPool, ClusterName: name, Name: mp.Name, Action: ActionCreate})
+			for _, p := range computePools[name] {
+				changes = append(changes,
+					&Change{Kind: manifest.KindComputePool, ClusterName: name, Name: p.Name, Action: ActionCreate})
+			}
+			continue
+		}
+
+		if isDefined {
+			diff, err := c.diffClusters(cl, *current)
+			if err != nil {
+				return changes, err
+			}
+			if len(diff) > 0 {
+				return changes, fmt.Errorf("cluster %q changes are not supported, changed: %s", name, strings.Join(diff, ", "))
+			}
+			changes = append(changes, &Change{Kind: manifest.KindCluster, Name: name, Action: ActionNone})
+		}
+
+		if hasMasterPool {
+			pools, err := pooler.GetMasterPools(name, "")
+			if err != nil {
+				return changes, err
+			}
+			ch := &Change{Kind: manifest.KindMasterPool, ClusterName: name, Name: mp.Name, Action: ActionCreate, masterPool: mp}
+			if len(pools) > 0 {
+				ch.Action = ActionNone
+				if ch.Diff = c.diffNodePools(mp.NodePool, pools[0].NodePool, 0, current.Labels); len(ch.Diff) > 0 {
+					return changes, fmt.Errorf("masterpool %q of cluster %q changes are not supported, changed: %s",
+						mp.Name, name, strings.Join(ch.Diff, ", "))
+				}
+			} else if err := c.validateNodePool(mp.NodePool); err != nil {
+				return changes, err
+			}
+			changes = append(changes, ch)
+		}
+
+		if len(computePools[name]) == 0 {
+			continue
+		}
+		pools, err := pooler.GetComputePools(name, "")
+		if err != nil {
+			return changes, err
+		}
+		for _, p := range computePools[name] {
+			ch := &Change{Kind: manifest.KindComputePool, ClusterName: name, Name: p.Name, Action: ActionCreate, computePool: p}
+			for _, cp := range pools {
+				if cp.Name != p.Name {
+					continue
+				}
+				ch.Action = ActionNone
+				if ch.Diff = c.diffNodePools(p.NodePool, cp.NodePool, constants.DefaultComputePoolSize, current.Labels); len(ch.Diff) > 0 {
+					ch.Action = ActionReplace
+					continue
+				}
+				if ch.Drift, err = c.getComputePoolDrift(p); err != nil {
+					return changes, err
+				}
+				ch.DriftPolicy = current.DriftPolicy
+				if ch.DriftPolicy == "" {
+					ch.DriftPolicy = constants.DefaultDriftPolicy
+				}
+			}
+			if ch.Action != ActionNone {
+				if err := c.validateNodePool(p.NodePool); err != nil {
+					return changes, err
+				}
+			}
+			changes = append(changes, ch)
+		}
+	}
+	return changes, nil
+}
+
+// Apply applies changes planned for manifest m. Unchanged resources are not
+// touched, nor are existing resources that m does not define. Changes
+// applied before an error are returned along with it.
+func (c *Controller) Apply(m manifest.Manifest, assets model.Assets) ([]*Change, error) {
+	applied := []*Change{}
+
+	changes, err := c.Plan(m)
+	if err != nil {
+		return applied, err
+	}
+
+	created := make(map[string]bool)
+	for _, ch := range changes {
+		switch {
+		case ch.Action == ActionNone && len(ch.Drift) > 0:
+			c.Logger.Printf("%s %q of cluster %q drifted: %s", ch.Kind, ch.Name, ch.ClusterName, strings.Join(ch.Drift, ", "))
+			if ch.DriftPolicy != constants.DriftPolicyCorrect {
+				break
+			}
+			if err := c.correctComputePoolDrift(ch.computePool); err != nil {
+				return applied, err
+			}
+		case ch.Action == ActionNone:
+			c.Logger.Printf("%s %q is unchanged", ch.Kind, ch.Name)
+		case ch.Kind == manifest.KindCluster:
+			if err := c.CreateCluster(ch.cluster, assets); err != nil {
+				return applied, err
+			}
+			created[ch.Name] = true
+		case created[ch.ClusterName]:
+			// Node pools of a new cluster are created along with it.
+		case ch.Kind == manifest.KindMasterPool:
+			c.Logger.Printf("creating masterpool %q in cluster %q", ch.Name, ch.ClusterName)
+			if err := c.CreateMasterPool(ch.masterPool); err != nil {
+				return applied, err
+			}
+		case ch.Kind == manifest.KindComputePool:
+			replace := ch.Action == ActionReplace
+			if replace {
+				c.Logger.Printf("replacing computepool %q in cluster %q, changed: %s", ch.Name, ch.ClusterName, strings.Join(ch.Diff, ", "))
+			} else {
+				c.Logger.Printf("creating computepool %q in cluster %q", ch.Name, ch.ClusterName)
+			}
+			if err := c.createComputePool(ch.computePool, replace); err != nil {
+				return applied, err
+			}
+		}
+		applied = append(applied, ch)
+	}
+	return applied, nil
+}
+
+// getComputePoolDrift returns out-of-band changes to cloud resources of
+// compute pool p. Nothing is returned if the cloud provider does not support
+// drift detection.
+func (c *Controller) getComputePoolDrift(p model.ComputePool) ([]string, error) {
+	drift, impl := c.Cloud.Drift()
+	if !impl {
+		return nil, nil
+	}
+	if p.Size == 0 {
+		p.Size = constants.DefaultComputePoolSize
+	}
+	return drift.GetComputePoolDrift(p)
+}
+
+// correctComputePoolDrift reverts out-of-band changes to cloud resources of
+// compute pool p.
+func (c *Controller) correctComputePoolDrift(p model.ComputePool) error {
+	drift, impl := c.Cloud.Drift()
+	if !impl {
+		return ErrNotImplemented
+	}
+	if p.Size == 0 {
+		p.Size = constants.DefaultComputePoolSize
+	}
+	c.Logger.Printf("correcting computepool %q drift in cluster %q", p.Name, p.ClusterName)
+	return drift.CorrectComputePoolDrift(p)
+}
+
+// diffClusters returns names of cluster spec fields set in want that differ
+// from got. The DNS config is only compared if got has one recorded.
+func (c *Controller) diffClusters(want, got model.Cluster) ([]string, error) {
+	diff := []string{}
+
+	if want.DriftPolicy == "" {
+		want.DriftPolicy = constants.DefaultDriftPolicy
+	}
+	if err := c.setDNSConfigDefaults(&want.DNS); err != nil {
+		return diff, err
+	}
+
+	if want.Internal != got.Internal {
+		diff = append(diff, "internal")
+	}
+	if got.DriftPolicy != "" && want.DriftPolicy != got.DriftPolicy {
+		diff = append(diff, "drift_policy")
+	}
+	if got.DNS.Provider != "" && !reflect.DeepEqual(want.DNS, got.DNS) {
+		diff = append(diff, "dns")
+	}
+	if !isLabelsSubset(want.Labels, got.Labels) {
+		diff = append(diff, "labels")
+	}
+	return diff, nil
+}
+
+// diffNodePools returns names of node pool spec fields that differ from got,
+// once defaults are applied to want. Only fields that the cloud provider
+// reports are compared, an empty reported field is compared as such. Labels
+// of got also hold clusterLabels and the pool name label. A zero defaultSize
+// means size is not compared.
+func (c *Controller) diffNodePools(want, got model.NodePool, defaultSize int, clusterLabels model.Labels) []string {
+	diff := []string{}
+
+	caps := c.Cloud.Capabilities()
+	reported := func(field string) bool {
+		return stringInSlice(field, caps.NodePoolFields)
+	}
+
+	if want.DiskSize == 0 {
+		want.DiskSize = constants.DefaultDiskSizeInGigabytes
+	}
+	if want.KubeVersion == "" {
+		want.KubeVersion = constants.DefaultKubeVersion
+	}
+	if want.CoreOSVersion == "" {
+		want.CoreOSVersion = constants.DefaultCoreOSVersion
+	}
+	if want.Size == 0 {
+		want.Size = defaultSize
+	}
+	// Pools without a volume type use the cloud default.
+	if len(caps.VolumeTypes) > 0 {
+		if want.VolumeType == "" {
+			want.VolumeType = caps.VolumeTypes[0]
+		}
+		if got.VolumeType == "" {
+			got.VolumeType = caps.VolumeTypes[0]
+		}
+	}
+
+	if reported("kube_version") && want.KubeVersion != got.KubeVersion {
+		diff = append(diff, "kube_version")
+	}
+	if reported("coreos_version") && want.CoreOSVersion != got.CoreOSVersion {
+		diff = append(diff, "coreos_version")
+	}
+	if reported("machine_type") && want.MachineType != got.MachineType {
+		diff = append(diff, "machine_type")
+	}
+	if reported("disk_size") && want.DiskSize != got.DiskSize {
+		diff = append(diff, "disk_size")
+	}
+	if reported("size") && defaultSize != 0 && want.Size != got.Size {
+		diff = append(diff, "size")
+	}
+	if reported("ssh_key") && want.SSHKey != got.SSHKey {
+		diff = append(diff, "ssh_key")
+	}
+	if reported("volume_type") && want.VolumeType != got.VolumeType {
+		diff = append(diff, "volume_type")
+	}
+	if reported("spot_price") && want.SpotPrice != got.SpotPrice {
+		diff = append(diff, "spot_price")
+	}
+	if reported("networks") && !reflect.DeepEqual(sortedStrings(want.Networks), sortedStrings(got.Networks)) {
+		diff = append(diff, "networks")
+	}
+	if reported("labels") && !reflect.DeepEqual(nodePoolLabels(want, clusterLabels), nodePoolLabels(got, nil)) {
+		diff = append(diff, "labels")
+	}
+	if reported("extra_args") && !reflect.DeepEqual(normalizeExtraArgs(want.ExtraArgs), normalizeExtraArgs(got.ExtraArgs)) {
+		diff = append(diff, "extra_args")
+	}
+	return diff
+}
+
+// isLabelsSubset returns true if all labels in a are set in b, which also
+// holds cluster and keto managed labels.
+func isLabelsSubset(a, b model.Labels) bool {
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedStrings(s []string) []string {
+	sorted := append([]string{}, s...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// normalizeExtraArgs returns a with empty sets of extra args set to nil.
+func normalizeExtraArgs(a model.ComponentExtraArgs) model.ComponentExtraArgs {
+	for _, args := range []*model.ExtraArgs{&a.Kubelet, &a.APIServer, &a.ControllerManager, &a.Scheduler} {
+		if len(*args) == 0 {
+			*args = nil
+		}
+	}
+	return a
+}
@@ -0,0 +1,255 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/UKHomeOffice/keto/pkg/cloudprovider"
+	"github.com/UKHomeOffice/keto/pkg/constants"
+	"github.com/UKHomeOffice/keto/pkg/manifest"
+	"github.com/UKHomeOffice/keto/pkg/model"
+	"github.com/UKHomeOffice/keto/testutil"
+
+	"github.com/stretchr/testify/mock"
+)
+
+func TestPlan(t *testing.T) {
+	m, ctrl := makeTestMock()
+
+	existing := model.Cluster{ResourceMeta: model.ResourceMeta{Name: "bar"}}
+	unchanged := model.ComputePool{NodePool: testutil.MakeNodePool("bar", "unchanged")}
+	changed := model.ComputePool{NodePool: testutil.MakeNodePool("bar", "changed")}
+	master := model.MasterPool{NodePool: testutil.MakeNodePool("bar", "master")}
+
+	m.Clusters.On("GetClusters", "").Return([]*model.Cluster{&existing}, nil)
+	m.NodePooler.On("GetMasterPools", "bar", "").Return([]*model.MasterPool{&master}, nil)
+	m.NodePooler.On("GetComputePools", "bar", "").Return([]*model.ComputePool{&unchanged, &changed}, nil)
+	m.NodePooler.On("ValidateNodePool", mock.AnythingOfType("model.NodePool")).Return(nil)
+	m.Provider.On("Drift").Return(m.Drift, true)
+	m.Drift.On("GetComputePoolDrift", mock.AnythingOfType("model.ComputePool")).Return([]string{}, nil)
+
+	want := func(p model.ComputePool) model.ComputePool {
+		p.UserData = nil
+		return p
+	}
+	resized := want(changed)
+	resized.Size = 3
+	mf := manifest.Manifest{
+		Clusters: []model.Cluster{
+			{ResourceMeta: model.ResourceMeta{Name: "foo"}},
+		},
+		MasterPools: []model.MasterPool{
+			{NodePool: testutil.MakeNodePool("foo", "master")},
+		},
+		ComputePools: []model.ComputePool{
+			want(unchanged),
+			resized,
+			{NodePool: testutil.MakeNodePool("bar", "new")},
+			{NodePool: testutil.MakeNodePool("foo", "compute")},
+		},
+	}
+
+	changes, err := ctrl.Plan(mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type change struct {
+		Kind, ClusterName, Name, Action string
+		Diff                            []string
+	}
+	got := []change{}
+	for _, ch := range changes {
+		got = append(got, change{ch.Kind, ch.ClusterName, ch.Name, ch.Action, ch.Diff})
+	}
+	wantChanges := []change{
+		{manifest.KindCluster, "", "foo", ActionCreate, nil},
+		{manifest.KindMasterPool, "foo", "master", ActionCreate, nil},
+		{manifest.KindComputePool, "foo", "compute", ActionCreate, nil},
+		{manifest.KindComputePool, "bar", "unchanged", ActionNone, []string{}},
+		{manifest.KindComputePool, "bar", "changed", ActionReplace, []string{"size"}},
+		{manifest.KindComputePool, "bar", "new", ActionCreate, nil},
+	}
+	if !reflect.DeepEqual(got, wantChanges) {
+		t.Errorf("got changes %+v; want %+v", got, wantChanges)
+	}
+
+	if cl := changes[0].cluster; len(cl.ComputePools) != 1 || cl.MasterPool.Name != "master" {
+		t.Errorf("new cluster is not planned with its node pools: %+v", cl)
+	}
+	// Created and replaced pools are validated.
+	m.NodePooler.AssertNumberOfCalls(t, "ValidateNodePool", 4)
+}
+
+func TestPlanUnsetFields(t *testing.T) {
+	m, ctrl := makeTestMock()
+
+	existing := model.Cluster{ResourceMeta: model.ResourceMeta{Name: "bar", Labels: model.Labels{"env": "dev"}}}
+	spot := model.ComputePool{NodePool: testutil.MakeNodePool("bar", "spot")}
+	args := model.ComputePool{NodePool: testutil.MakeNodePool("bar", "args")}
+	labels := model.ComputePool{NodePool: testutil.MakeNodePool("bar", "labels")}
+	// Reported pool labels also hold cluster labels.
+	for _, p := range []*model.ComputePool{&spot, &args, &labels} {
+		p.Labels = model.Labels{"env": "dev", constants.PoolNameLabelKey: p.Name}
+	}
+	labels.Labels["role"] = "worker"
+
+	m.Clusters.On("GetClusters", "").Return([]*model.Cluster{&existing}, nil)
+	m.NodePooler.On("GetComputePools", "bar", "").Return([]*model.ComputePool{&spot, &args, &labels}, nil)
+	m.NodePooler.On("ValidateNodePool", mock.AnythingOfType("model.NodePool")).Return(nil)
+	m.Provider.On("Drift").Return(m.Drift, true)
+	m.Drift.On("GetComputePoolDrift", mock.AnythingOfType("model.ComputePool")).Return([]string{}, nil)
+
+	want := func(p model.ComputePool) model.ComputePool {
+		p.UserData = nil
+		p.Labels = nil
+		return p
+	}
+	mf := manifest.Manifest{
+		ComputePools: []model.ComputePool{want(spot), want(args), want(labels)},
+	}
+	mf.ComputePools[0].SpotPrice = "0.05"
+	mf.ComputePools[1].ExtraArgs = model.ComponentExtraArgs{Kubelet: model.ExtraArgs{"v": "4"}}
+
+	changes, err := ctrl.Plan(mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDiffs := [][]string{{"spot_price"}, {"extra_args"}, {"labels"}}
+	if len(changes) != len(wantDiffs) {
+		t.Fatalf("got %d changes; want %d", len(changes), len(wantDiffs))
+	}
+	for i, ch := range changes {
+		if ch.Action != ActionReplace || !reflect.DeepEqual(ch.Diff, wantDiffs[i]) {
+			t.Errorf("got %s of pool %q, changed: %v; want %s, changed: %v", ch.Action, ch.Name, ch.Diff, ActionReplace, wantDiffs[i])
+		}
+	}
+
+	// Fields that a cloud provider does not report are not compared.
+	ctrl.Cloud = limitedCloud{
+		Interface: m.Provider,
+		caps:      cloudprovider.Capabilities{NodePoolFields: []string{"kube_version", "machine_type"}},
+	}
+	changes, err = ctrl.Plan(mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range changes {
+		if ch.Action != ActionNone {
+			t.Errorf("got %s of pool %q without reported fields, changed: %v; want %s", ch.Action, ch.Name, ch.Diff, ActionNone)
+		}
+	}
+}
+
+func TestApplyReplace(t *testing.T) {
+	m, ctrl := makeTestMock()
+
+	existing := model.Cluster{ResourceMeta: model.ResourceMeta{Name: "bar"}}
+	current := model.ComputePool{NodePool: testutil.MakeNodePool("bar", "compute")}
+
+	m.Clusters.On("GetClusters", "").Return([]*model.Cluster{&existing}, nil)
+	m.NodePooler.On("GetComputePools", "bar", "").Return([]*model.ComputePool{&current}, nil)
+	m.NodePooler.On("ValidateNodePool", mock.AnythingOfType("model.NodePool")).Return(nil)
+
+	invalid := current
+	invalid.UserData = nil
+	invalid.ExtraArgs = model.ComponentExtraArgs{APIServer: model.ExtraArgs{"v": "2"}}
+	if _, err := ctrl.Apply(manifest.Manifest{ComputePools: []model.ComputePool{invalid}}, model.Assets{}); err != ErrMasterExtraArgs {
+		t.Errorf("wrong error; got %q; want %q", err, ErrMasterExtraArgs)
+	}
+	// An invalid pool does not replace the current one.
+	m.NodePooler.AssertNotCalled(t, "DeleteComputePool", "bar", "compute")
+
+	resized := current
+	resized.UserData = nil
+	resized.Size = 3
+	m.Provider.On("ProviderName").Return(cloudProviderName)
+	m.UserData.On("RenderComputeCloudConfig", cloudProviderName, "bar", resized.KubeVersion).Return([]byte("mocked userdata"), nil)
+	m.NodePooler.On("DeleteComputePool", "bar", "compute").Return(nil)
+	m.NodePooler.On("CreateComputePool", mock.AnythingOfType("model.ComputePool")).Return(nil)
+
+	applied, err := ctrl.Apply(manifest.Manifest{ComputePools: []model.ComputePool{resized}}, model.Assets{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 || applied[0].Action != ActionReplace {
+		t.Errorf("got applied changes %+v; want a replaced compute pool", applied)
+	}
+	m.NodePooler.AssertExpectations(t)
+}
+
+func TestApplyDrift(t *testing.T) {
+	for _, policy := range []string{constants.DriftPolicyNotify, constants.DriftPolicyCorrect} {
+		m, ctrl := makeTestMock()
+
+		existing := model.Cluster{ResourceMeta: model.ResourceMeta{Name: "bar"}, DriftPolicy: policy}
+		current := model.ComputePool{NodePool: testutil.MakeNodePool("bar", "compute")}
+		declared := current
+		declared.UserData = nil
+
+		m.Clusters.On("GetClusters", "").Return([]*model.Cluster{&existing}, nil)
+		m.NodePooler.On("GetComputePools", "bar", "").Return([]*model.ComputePool{&current}, nil)
+		m.Provider.On("Drift").Return(m.Drift, true)
+		m.Drift.On("GetComputePoolDrift", declared).Return([]string{"resized"}, nil)
+		m.Drift.On("CorrectComputePoolDrift", declared).Return(nil)
+
+		applied, err := ctrl.Apply(manifest.Manifest{ComputePools: []model.ComputePool{declared}}, model.Assets{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(applied) != 1 || !reflect.DeepEqual(applied[0].Drift, []string{"resized"}) || applied[0].DriftPolicy != policy {
+			t.Errorf("%s: got applied changes %+v; want a drifted compute pool", policy, applied)
+		}
+		if policy == constants.DriftPolicyCorrect {
+			m.Drift.AssertCalled(t, "CorrectComputePoolDrift", declared)
+		} else {
+			m.Drift.AssertNotCalled(t, "CorrectComputePoolDrift", declared)
+		}
+	}
+}
+
+func TestPlanErrors(t *testing.T) {
+	m, ctrl := makeTestMock()
+
+	existing := model.Cluster{ResourceMeta: model.ResourceMeta{Name: "bar"}}
+	master := model.MasterPool{NodePool: testutil.MakeNodePool("bar", "master")}
+
+	m.Clusters.On("GetClusters", "").Return([]*model.Cluster{&existing}, nil)
+	m.NodePooler.On("GetMasterPools", "bar", "").Return([]*model.MasterPool{&master}, nil)
+
+	changedMaster := master
+	changedMaster.MachineType = "huge"
+
+	tests := []manifest.Manifest{
+		// Unknown cluster reference.
+		{ComputePools: []model.ComputePool{{NodePool: testutil.MakeNodePool("baz", "compute")}}},
+		// New cluster without a master pool.
+		{Clusters: []model.Cluster{{ResourceMeta: model.ResourceMeta{Name: "foo"}}}},
+		// Changed cluster.
+		{Clusters: []model.Cluster{{ResourceMeta: model.ResourceMeta{Name: "bar", Internal: true}}}},
+		// Changed master pool.
+		{MasterPools: []model.MasterPool{changedMaster}},
+	}
+
+	for i, mf := range tests {
+		if _, err := ctrl.Plan(mf); err == nil {
+			t.Errorf("test %d: expected an error", i)
+		}
+	}
+}
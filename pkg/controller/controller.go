@@ -19,9 +19,15 @@ package controller
 import (
 	"errors"
 	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/UKHomeOffice/keto/pkg/cloudprovider"
 	"github.com/UKHomeOffice/keto/pkg/constants"
+	"github.com/UKHomeOffice/keto/pkg/kube"
+	"github.com/UKHomeOffice/keto/pkg/kubeargs"
 	"github.com/UKHomeOffice/keto/pkg/model"
 	"github.com/UKHomeOffice/keto/pkg/userdata"
 )
@@ -37,8 +43,89 @@ var (
 	ErrMasterPoolAlreadyExists = errors.New("masterpool already exists")
 	// ErrComputePoolAlreadyExists is an error to report an existing compute pool.
 	ErrComputePoolAlreadyExists = errors.New("computepool already exists")
+	// ErrUnknownDriftPolicy is an error to report an unsupported drift policy.
+	ErrUnknownDriftPolicy = errors.New("unknown drift policy")
+	// ErrUnknownRetainKind is an error to report an unsupported kind of
+	// resources to retain.
+	ErrUnknownRetainKind = errors.New("unknown kind of resources to retain")
+	// ErrMasterExtraArgs is an error to report master component extra args
+	// set on a compute pool.
+	ErrMasterExtraArgs = errors.New("only kubelet extra args can be set on a computepool")
+	// ErrUnknownKubeAPIURL is an error to report a cluster without a known
+	// kube API URL.
+	ErrUnknownKubeAPIURL = errors.New("cluster kube API URL is unknown")
+	// ErrUnknownDNSProvider is an error to report an unsupported cluster DNS
+	// addon.
+	ErrUnknownDNSProvider = errors.New("unknown DNS provider")
+	// ErrMasterSpotInstances is an error to report a spot price set on a
+	// master pool.
+	ErrMasterSpotInstances = errors.New("masterpool nodes cannot run on spot instances")
 )
 
+// NotSupportedError is an error to report an option that the cloud provider
+// does not support, see cloudprovider.Capabilities.
+type NotSupportedError struct {
+	// Feature is a human readable name of the option.
+	Feature string
+	Cloud   string
+}
+
+func (e *NotSupportedError) Error() string {
+	return fmt.Sprintf("%s: not supported by this cloud (%s)", e.Feature, e.Cloud)
+}
+
+// maxUpstreamNameservers is the maximum number of upstream nameservers that
+// DNS addons support.
+const maxUpstreamNameservers = 3
+
+// nodePollInterval is how often node readiness is checked when waiting for
+// node pool nodes.
+var nodePollInterval = 10 * time.Second
+
+// nodeLister lists nodes registered with a cluster API.
+type nodeLister interface {
+	GetNodes(labels model.Labels) ([]kube.Node, error)
+}
+
+// newNodeLister returns a nodeLister of a kube API at apiURL, whose requests
+// time out after timeout.
+var newNodeLister = func(apiURL string, a model.Assets, timeout time.Duration) (nodeLister, error) {
+	return kube.NewClient(apiURL, a, timeout)
+}
+
+// NodesNotReadyError is an error to report node pool nodes that have not
+// registered with the cluster API or are not ready.
+type NodesNotReadyError struct {
+	// Kind is either a masterpool or a computepool.
+	Kind string
+	Name string
+	// Size is the expected number of ready nodes.
+	Size int
+	// Nodes are the nodes that did register.
+	Nodes []kube.Node
+	// Err is the last error returned by the kube API, if any.
+	Err error
+}
+
+func (e *NodesNotReadyError) Error() string {
+	ready := 0
+	reasons := []string{}
+	for _, n := range e.Nodes {
+		if n.Ready {
+			ready++
+			continue
+		}
+		reasons = append(reasons, fmt.Sprintf("node %q is not ready: %s: %s", n.Name, n.Reason, n.Message))
+	}
+	if missing := e.Size - len(e.Nodes); missing > 0 {
+		reasons = append(reasons, fmt.Sprintf("%d node(s) did not register with the cluster", missing))
+	}
+	if e.Err != nil {
+		reasons = append(reasons, fmt.Sprintf("kube API error: %v", e.Err))
+	}
+	return fmt.Sprintf("%s %q has %d of %d nodes ready: %s", e.Kind, e.Name, ready, e.Size, strings.Join(reasons, "; "))
+}
+
 // Controller represents a controller.
 type Controller struct {
 	Config
@@ -49,6 +136,9 @@ type Config struct {
 	Logger   logger
 	Cloud    cloudprovider.Interface
 	UserData userdata.UserDater
+	// RequestTimeout limits how long a single cluster API call may take.
+	// Zero means no limit.
+	RequestTimeout time.Duration
 }
 
 // logger is a generic interface that is used for passing in a logger.
@@ -78,6 +168,33 @@ func (c *Controller) CreateCluster(cluster model.Cluster, assets model.Assets) e
 		return ErrNotImplemented
 	}
 
+	if cluster.DriftPolicy == "" {
+		cluster.DriftPolicy = constants.DefaultDriftPolicy
+		c.Logger.Printf("drift policy is not specified, using default %q", cluster.DriftPolicy)
+	}
+	if !isValidDriftPolicy(cluster.DriftPolicy) {
+		return ErrUnknownDriftPolicy
+	}
+	if err := c.setDNSConfigDefaults(&cluster.DNS); err != nil {
+		return err
+	}
+	if cluster.Internal && !c.Cloud.Capabilities().InternalLoadBalancer {
+		return c.notSupported("internal load balancers")
+	}
+	// Node pools are validated upfront, so that a cluster is not left without
+	// them half way through.
+	if cluster.MasterPool.SpotPrice != "" {
+		return ErrMasterSpotInstances
+	}
+	if err := c.checkNodePoolCapabilities(&cluster.MasterPool.NodePool); err != nil {
+		return err
+	}
+	for i := range cluster.ComputePools {
+		if err := c.checkNodePoolCapabilities(&cluster.ComputePools[i].NodePool); err != nil {
+			return err
+		}
+	}
+
 	c.Logger.Printf("checking whether cluster %q already exists", cluster.Name)
 	exists, err := c.clusterExists(cluster.Name, cl)
 	if err != nil {
@@ -99,6 +216,22 @@ func (c *Controller) CreateCluster(cluster model.Cluster, assets model.Assets) e
 		cluster.Labels = model.Labels{}
 	}
 
+	// Nodes would fail to bootstrap with a keto-k8 image that does not
+	// support the cloud provider.
+	if _, err := userdata.KetoK8Image(c.Cloud.ProviderName()); err != nil {
+		return err
+	}
+
+	// Cloud resources that node pools refer to have to exist.
+	if err := c.validateNodePool(cluster.MasterPool.NodePool); err != nil {
+		return err
+	}
+	for _, p := range cluster.ComputePools {
+		if err := c.validateNodePool(p.NodePool); err != nil {
+			return err
+		}
+	}
+
 	c.Logger.Printf("creating cluster %q infrastructure", cluster.Name)
 	if err := cl.CreateClusterInfra(cluster); err != nil {
 		return err
@@ -169,6 +302,18 @@ func (c *Controller) CreateMasterPool(p model.MasterPool) error {
 		p.CoreOSVersion = constants.DefaultCoreOSVersion
 		c.Logger.Printf("coreos version is not specified, using default %q", p.CoreOSVersion)
 	}
+	if err := kubeargs.Validate(p.ExtraArgs, p.KubeVersion); err != nil {
+		return err
+	}
+	if p.SpotPrice != "" {
+		return ErrMasterSpotInstances
+	}
+	if err := c.checkNodePoolCapabilities(&p.NodePool); err != nil {
+		return err
+	}
+	if err := c.validateNodePool(p.NodePool); err != nil {
+		return err
+	}
 
 	pooler, impl := c.Cloud.NodePooler()
 	if !impl {
@@ -182,22 +327,76 @@ func (c *Controller) CreateMasterPool(p model.MasterPool) error {
 	}
 	c.Logger.Printf("got IPs and IDs: %#v", ips)
 
-	cloudConfig, err := c.UserData.RenderMasterCloudConfig(c.Cloud.ProviderName(), p.ClusterName, p.KubeVersion, ips)
+	cloudConfig, err := c.UserData.RenderMasterCloudConfig(c.Cloud.ProviderName(), p.ClusterName, p.KubeVersion, ips, clusters[0].DNS)
 	if err != nil {
 		return err
 	}
 	p.UserData = cloudConfig
+	if err := c.checkUserDataSize(p.NodePool); err != nil {
+		return err
+	}
 
 	// Cluster scope labels get applied to node pools by default.
-	if p.Labels == nil {
-		p.Labels = model.Labels{}
+	p.Labels = nodePoolLabels(p.NodePool, clusters[0].Labels)
+
+	return pooler.CreateMasterPool(p)
+}
+
+// setDNSConfigDefaults validates DNS addon options and sets defaults of the
+// ones not specified.
+func (c *Controller) setDNSConfigDefaults(d *model.DNSConfig) error {
+	if d.Provider == "" {
+		d.Provider = constants.DefaultDNSProvider
 	}
-	for k, v := range clusters[0].Labels {
-		p.Labels[k] = v
+	if d.Provider != constants.DNSProviderKubeDNS && d.Provider != constants.DNSProviderCoreDNS {
+		return ErrUnknownDNSProvider
 	}
-	p.Labels[constants.PoolNameLabelKey] = p.Name
 
-	return pooler.CreateMasterPool(p)
+	if len(d.UpstreamNameservers) > maxUpstreamNameservers {
+		return fmt.Errorf("at most %d upstream nameservers are supported", maxUpstreamNameservers)
+	}
+	for _, ns := range d.UpstreamNameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("invalid upstream nameserver %q, must be an IP address", ns)
+		}
+	}
+	for domain, servers := range d.StubDomains {
+		if domain == "" || len(servers) == 0 {
+			return fmt.Errorf("invalid stub domain %q, a domain and its nameservers must be set", domain)
+		}
+		for _, ns := range servers {
+			if net.ParseIP(ns) == nil {
+				return fmt.Errorf("invalid stub domain %q nameserver %q, must be an IP address", domain, ns)
+			}
+		}
+	}
+
+	a := d.Autoscaling
+	if a == nil {
+		return nil
+	}
+	if a.MinReplicas == 0 {
+		a.MinReplicas = constants.DefaultDNSMinReplicas
+		c.Logger.Printf("DNS min replicas is not specified, using default %d", a.MinReplicas)
+	}
+	if a.CoresPerReplica == 0 && a.NodesPerReplica == 0 {
+		a.CoresPerReplica = constants.DefaultDNSCoresPerReplica
+		a.NodesPerReplica = constants.DefaultDNSNodesPerReplica
+		c.Logger.Printf("DNS cores and nodes per replica are not specified, using defaults %d and %d",
+			a.CoresPerReplica, a.NodesPerReplica)
+	}
+	if a.MinReplicas < 0 || a.MaxReplicas < 0 || a.CoresPerReplica < 0 || a.NodesPerReplica < 0 {
+		return errors.New("DNS autoscaling parameters must not be negative")
+	}
+	if a.MaxReplicas != 0 && a.MaxReplicas < a.MinReplicas {
+		return fmt.Errorf("DNS max replicas %d is less than min replicas %d", a.MaxReplicas, a.MinReplicas)
+	}
+	return nil
+}
+
+// isValidDriftPolicy returns true if p is a supported drift policy.
+func isValidDriftPolicy(p string) bool {
+	return p == constants.DriftPolicyNotify || p == constants.DriftPolicyCorrect
 }
 
 func (c *Controller) clusterExists(name string, cl cloudprovider.Clusters) (bool, error) {
@@ -210,6 +409,13 @@ func (c *Controller) clusterExists(name string, cl cloudprovider.Clusters) (bool
 
 // CreateComputePool create a compute node pool.
 func (c *Controller) CreateComputePool(p model.ComputePool) error {
+	return c.createComputePool(p, false)
+}
+
+// createComputePool creates compute pool p. If replace is true, an existing
+// compute pool of the same name is deleted first, but only once p is valid,
+// so that invalid changes don't leave the cluster without the pool.
+func (c *Controller) createComputePool(p model.ComputePool, replace bool) error {
 	pooler, impl := c.Cloud.NodePooler()
 	if !impl {
 		return ErrNotImplemented
@@ -228,15 +434,17 @@ func (c *Controller) CreateComputePool(p model.ComputePool) error {
 	p.Internal = clusters[0].Internal
 
 	// Check if a compute pool with the same name exists already.
-	c.Logger.Printf("checking whether computepool %q already exists in cluster %q", p.Name, p.ClusterName)
-	computeExists, err := c.computePoolExists(p.ClusterName, p.Name, pooler)
-	if err != nil {
-		return err
-	}
-	if computeExists {
-		return ErrComputePoolAlreadyExists
+	if !replace {
+		c.Logger.Printf("checking whether computepool %q already exists in cluster %q", p.Name, p.ClusterName)
+		computeExists, err := c.computePoolExists(p.ClusterName, p.Name, pooler)
+		if err != nil {
+			return err
+		}
+		if computeExists {
+			return ErrComputePoolAlreadyExists
+		}
+		c.Logger.Printf("computepool %q does not exist in cluster %q", p.Name, p.ClusterName)
 	}
-	c.Logger.Printf("computepool %q does not exist in cluster %q", p.Name, p.ClusterName)
 
 	// Use defaults if values aren't specified.
 	if p.DiskSize == 0 {
@@ -260,23 +468,92 @@ func (c *Controller) CreateComputePool(p model.ComputePool) error {
 		p.CoreOSVersion = constants.DefaultCoreOSVersion
 		c.Logger.Printf("coreos version is not specified, using default %q", p.CoreOSVersion)
 	}
+	if len(p.ExtraArgs.APIServer)+len(p.ExtraArgs.ControllerManager)+len(p.ExtraArgs.Scheduler) > 0 {
+		return ErrMasterExtraArgs
+	}
+	if err := kubeargs.Validate(p.ExtraArgs, p.KubeVersion); err != nil {
+		return err
+	}
+	if err := c.checkNodePoolCapabilities(&p.NodePool); err != nil {
+		return err
+	}
+	if err := c.validateNodePool(p.NodePool); err != nil {
+		return err
+	}
 
 	cloudConfig, err := c.UserData.RenderComputeCloudConfig(c.Cloud.ProviderName(), p.ClusterName, p.KubeVersion)
 	if err != nil {
 		return err
 	}
 	p.UserData = cloudConfig
+	if err := c.checkUserDataSize(p.NodePool); err != nil {
+		return err
+	}
 
 	// Cluster scope labels get applied to node pools by default.
-	if p.Labels == nil {
-		p.Labels = model.Labels{}
+	p.Labels = nodePoolLabels(p.NodePool, clusters[0].Labels)
+
+	if replace {
+		if err := c.DeleteComputePool(p.ClusterName, p.Name); err != nil {
+			return err
+		}
 	}
-	for k, v := range clusters[0].Labels {
-		p.Labels[k] = v
+	return pooler.CreateComputePool(p)
+}
+
+// checkNodePoolCapabilities checks whether the cloud provider supports
+// options of a given node pool and sets the default volume type if it is not
+// specified.
+func (c *Controller) checkNodePoolCapabilities(p *model.NodePool) error {
+	caps := c.Cloud.Capabilities()
+
+	if p.SpotPrice != "" && !caps.SpotInstances {
+		return c.notSupported("spot instances")
 	}
-	p.Labels[constants.PoolNameLabelKey] = p.Name
 
-	return pooler.CreateComputePool(p)
+	if len(caps.VolumeTypes) == 0 {
+		if p.VolumeType != "" {
+			return c.notSupported("volume types")
+		}
+		return nil
+	}
+	if p.VolumeType == "" {
+		p.VolumeType = caps.VolumeTypes[0]
+		c.Logger.Printf("volume type is not specified, using default %q", p.VolumeType)
+	}
+	if !stringInSlice(p.VolumeType, caps.VolumeTypes) {
+		return c.notSupported(fmt.Sprintf("volume type %q, must be one of %s", p.VolumeType, strings.Join(caps.VolumeTypes, ", ")))
+	}
+	return nil
+}
+
+// validateNodePool checks with the cloud provider that cloud resources node
+// pool p refers to exist. The default CoreOS version is used if p has none.
+func (c *Controller) validateNodePool(p model.NodePool) error {
+	pooler, impl := c.Cloud.NodePooler()
+	if !impl {
+		return ErrNotImplemented
+	}
+	if p.CoreOSVersion == "" {
+		p.CoreOSVersion = constants.DefaultCoreOSVersion
+	}
+	c.Logger.Printf("validating node pool %q cloud resources", p.Name)
+	return pooler.ValidateNodePool(p)
+}
+
+// checkUserDataSize checks whether rendered user data of a given node pool
+// fits the cloud provider limit.
+func (c *Controller) checkUserDataSize(p model.NodePool) error {
+	max := c.Cloud.Capabilities().MaxUserDataSize
+	if max > 0 && len(p.UserData) > max {
+		return fmt.Errorf("rendered user data is %d bytes, this cloud (%s) supports at most %d bytes",
+			len(p.UserData), c.Cloud.ProviderName(), max)
+	}
+	return nil
+}
+
+func (c *Controller) notSupported(feature string) error {
+	return &NotSupportedError{Feature: feature, Cloud: c.Cloud.ProviderName()}
 }
 
 func (c *Controller) computePoolExists(clusterName, name string, pooler cloudprovider.NodePooler) (bool, error) {
@@ -338,22 +615,37 @@ func (c *Controller) GetClusters(names ...string) ([]*model.Cluster, error) {
 
 }
 
-// DeleteCluster deletes a cluster.
-func (c *Controller) DeleteCluster(names ...string) error {
+// DeleteCluster deletes clusters. Resources of kinds listed in retain are
+// preserved and returned.
+func (c *Controller) DeleteCluster(retain []string, names ...string) ([]*model.Resource, error) {
+	retained := []*model.Resource{}
 	cl, impl := c.Cloud.Clusters()
 	if !impl {
-		return ErrNotImplemented
+		return retained, ErrNotImplemented
+	}
+
+	for _, r := range retain {
+		if !isValidRetainKind(r) {
+			return retained, ErrUnknownRetainKind
+		}
 	}
 
 	for _, n := range names {
-		c.Logger.Printf("deleting cluster %q", n)
-		err := cl.DeleteCluster(n)
+		c.Logger.Printf("deleting cluster %q, retaining %v", n, retain)
+		res, err := cl.DeleteCluster(n, retain)
+		retained = append(retained, res...)
 		if err != nil {
-			return err
+			return retained, err
 		}
 	}
 
-	return nil
+	return retained, nil
+}
+
+// isValidRetainKind returns true if k is a supported kind of resources to
+// retain on cluster deletion.
+func isValidRetainKind(k string) bool {
+	return k == constants.RetainDNS || k == constants.RetainVolumes || k == constants.RetainLB
 }
 
 // DeleteMasterPool deletes a master node pool.
@@ -384,6 +676,94 @@ func (c *Controller) DeleteComputePool(clusterName string, names ...string) erro
 	return nil
 }
 
+// GetEvents returns a list of cloud provider events of a given cluster in
+// chronological order.
+func (c *Controller) GetEvents(clusterName string) ([]*model.Event, error) {
+	ev, impl := c.Cloud.Events()
+	if !impl {
+		return []*model.Event{}, ErrNotImplemented
+	}
+
+	c.Logger.Printf("getting events of cluster %q", clusterName)
+	events, err := ev.GetEvents(clusterName)
+	if err != nil {
+		return []*model.Event{}, err
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time < events[j].Time })
+	return events, nil
+}
+
+// WaitForMasterPool waits until a master for each of the cluster master
+// persistent IPs registers with the cluster API and becomes ready. A zero
+// timeout means no limit.
+func (c *Controller) WaitForMasterPool(clusterName, name string, a model.Assets, timeout time.Duration) error {
+	cl, impl := c.Cloud.Clusters()
+	if !impl {
+		return ErrNotImplemented
+	}
+
+	ips, err := cl.GetMasterPersistentIPs(clusterName)
+	if err != nil {
+		return err
+	}
+	return c.waitForNodes("masterpool", clusterName, name, len(ips), a, timeout)
+}
+
+// WaitForComputePool waits until size nodes of a compute pool register with
+// the cluster API and become ready. A zero timeout means no limit.
+func (c *Controller) WaitForComputePool(clusterName, name string, size int, a model.Assets, timeout time.Duration) error {
+	if size == 0 {
+		size = constants.DefaultComputePoolSize
+	}
+	return c.waitForNodes("computepool", clusterName, name, size, a, timeout)
+}
+
+// waitForNodes polls the cluster API until size nodes labeled with a given
+// pool name are ready. A NodesNotReadyError is returned on timeout.
+func (c *Controller) waitForNodes(kind, clusterName, name string, size int, a model.Assets, timeout time.Duration) error {
+	clusters, err := c.GetClusters(clusterName)
+	if err != nil {
+		return err
+	}
+	if len(clusters) != 1 || clusters[0].Name != clusterName {
+		return ErrClusterDoesNotExist
+	}
+	if clusters[0].KubeAPIURL == "" {
+		return ErrUnknownKubeAPIURL
+	}
+
+	lister, err := newNodeLister(clusters[0].KubeAPIURL, a, c.RequestTimeout)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		nodes, err := lister.GetNodes(model.Labels{constants.PoolNameLabelKey: name})
+		if err != nil {
+			// The kube API is likely not up yet.
+			c.Logger.Printf("failed to get %s %q nodes: %v", kind, name, err)
+		}
+		ready := 0
+		for _, n := range nodes {
+			if n.Ready {
+				ready++
+			}
+		}
+		if err == nil && ready >= size {
+			c.Logger.Printf("%s %q has %d of %d nodes ready", kind, name, ready, size)
+			return nil
+		}
+		c.Logger.Printf("waiting for %s %q nodes, %d of %d ready", kind, name, ready, size)
+
+		if timeout != 0 && time.Now().Add(nodePollInterval).After(deadline) {
+			return &NodesNotReadyError{Kind: kind, Name: name, Size: size, Nodes: nodes, Err: err}
+		}
+		time.Sleep(nodePollInterval)
+	}
+}
+
 func filterMasterPools(pools []*model.MasterPool, names []string) []*model.MasterPool {
 	filteredPools := []*model.MasterPool{}
 
@@ -433,6 +813,20 @@ func filterClusters(clusters []*model.Cluster, names []string) []*model.Cluster
 	return clusters
 }
 
+// nodePoolLabels returns labels of node pool p along with cluster labels and
+// the pool name label, which nodes of p are labeled with.
+func nodePoolLabels(p model.NodePool, clusterLabels model.Labels) model.Labels {
+	labels := model.Labels{}
+	for k, v := range p.Labels {
+		labels[k] = v
+	}
+	for k, v := range clusterLabels {
+		labels[k] = v
+	}
+	labels[constants.PoolNameLabelKey] = p.Name
+	return labels
+}
+
 func stringInSlice(name string, names []string) bool {
 	for _, n := range names {
 		if name == n {
@@ -17,25 +17,41 @@ limitations under the License.
 package controller
 
 import (
+	"errors"
 	"log"
 	"os"
+	"reflect"
 	"testing"
+	"time"
 
 	cloudProviderMocks "github.com/UKHomeOffice/keto/pkg/cloudprovider/mocks"
 	userdataMocks "github.com/UKHomeOffice/keto/pkg/userdata/mocks"
 
+	"github.com/UKHomeOffice/keto/pkg/cloudprovider"
 	"github.com/UKHomeOffice/keto/pkg/constants"
+	"github.com/UKHomeOffice/keto/pkg/kube"
 	"github.com/UKHomeOffice/keto/pkg/model"
+	"github.com/UKHomeOffice/keto/pkg/userdata"
 	"github.com/UKHomeOffice/keto/testutil"
+
+	"github.com/stretchr/testify/mock"
 )
 
 const cloudProviderName = "mock"
 
+func TestMain(m *testing.M) {
+	// The default keto-k8 image does not support the mock cloud provider.
+	os.Setenv(userdata.KetoK8ImageEnv, "quay.io/ukhomeofficedigital/keto-k8:test")
+	os.Exit(m.Run())
+}
+
 type testMock struct {
 	Provider   *cloudProviderMocks.Interface
 	Clusters   *cloudProviderMocks.Clusters
 	NodePooler *cloudProviderMocks.NodePooler
 	Node       *cloudProviderMocks.Node
+	Events     *cloudProviderMocks.Events
+	Drift      *cloudProviderMocks.Drift
 	UserData   *userdataMocks.UserDater
 }
 
@@ -50,7 +66,9 @@ func TestCreateCluster(t *testing.T) {
 				constants.ClusterNameLabelKey: "foo",
 			},
 		},
-		MasterPool: model.MasterPool{NodePool: testutil.MakeNodePool("foo", "master")},
+		MasterPool:  model.MasterPool{NodePool: testutil.MakeNodePool("foo", "master")},
+		DriftPolicy: constants.DefaultDriftPolicy,
+		DNS:         model.DNSConfig{Provider: constants.DefaultDNSProvider},
 	}
 	cluster.MasterPool.Labels = cluster.Labels
 
@@ -61,6 +79,7 @@ func TestCreateCluster(t *testing.T) {
 	// At this point the cluster infra already exists.
 	m.Clusters.On("GetClusters", "").Return([]*model.Cluster{&cluster}, nil).Once()
 	m.NodePooler.On("GetMasterPools", cluster.Name, "").Return([]*model.MasterPool{}, nil)
+	m.NodePooler.On("ValidateNodePool", cluster.MasterPool.NodePool).Return(nil)
 	m.Clusters.On("GetMasterPersistentIPs", cluster.Name).Return(persistentIPs, nil)
 	m.Provider.On("ProviderName").Return(cloudProviderName)
 
@@ -68,10 +87,13 @@ func TestCreateCluster(t *testing.T) {
 		cloudProviderName,
 		cluster.Name,
 		cluster.MasterPool.KubeVersion,
-		persistentIPs).Return(cluster.MasterPool.UserData,
+		persistentIPs,
+		cluster.DNS).Return(cluster.MasterPool.UserData,
 		nil)
 
-	m.NodePooler.On("CreateMasterPool", cluster.MasterPool).Return(nil)
+	master := cluster.MasterPool
+	master.Labels = model.Labels{constants.ClusterNameLabelKey: "foo", constants.PoolNameLabelKey: "master"}
+	m.NodePooler.On("CreateMasterPool", master).Return(nil)
 
 	if err := ctrl.CreateCluster(cluster, model.Assets{}); err != nil {
 		t.Error(err)
@@ -100,6 +122,197 @@ func TestCreateClusterAlreadyExists(t *testing.T) {
 	m.Clusters.AssertExpectations(t)
 }
 
+func TestCreateClusterUnsupportedKetoK8Image(t *testing.T) {
+	m, ctrl := makeTestMock()
+
+	cluster := model.Cluster{
+		ResourceMeta: model.ResourceMeta{Name: "foo"},
+		MasterPool:   model.MasterPool{NodePool: testutil.MakeNodePool("foo", "master")},
+	}
+	m.Clusters.On("GetClusters", cluster.Name).Return([]*model.Cluster{}, nil).Once()
+	m.Provider.On("ProviderName").Return(cloudProviderName)
+
+	defer os.Setenv(userdata.KetoK8ImageEnv, os.Getenv(userdata.KetoK8ImageEnv))
+	os.Unsetenv(userdata.KetoK8ImageEnv)
+	if err := ctrl.CreateCluster(cluster, model.Assets{}); err == nil {
+		t.Error("expected an error, the default keto-k8 image does not support the cloud provider")
+	}
+
+	// No cloud resources are created.
+	m.Clusters.AssertExpectations(t)
+}
+
+func TestCreateClusterInvalidNodePool(t *testing.T) {
+	m, ctrl := makeTestMock()
+
+	cluster := model.Cluster{
+		ResourceMeta: model.ResourceMeta{Name: "foo"},
+		MasterPool:   model.MasterPool{NodePool: testutil.MakeNodePool("foo", "master")},
+		ComputePools: []model.ComputePool{{NodePool: testutil.MakeNodePool("foo", "compute")}},
+	}
+	m.Clusters.On("GetClusters", cluster.Name).Return([]*model.Cluster{}, nil).Once()
+	m.Provider.On("ProviderName").Return(cloudProviderName)
+	m.NodePooler.On("ValidateNodePool", cluster.MasterPool.NodePool).Return(nil)
+	m.NodePooler.On("ValidateNodePool", cluster.ComputePools[0].NodePool).Return(errors.New("image not found"))
+
+	if err := ctrl.CreateCluster(cluster, model.Assets{}); err == nil {
+		t.Error("expected an error, the compute pool image does not exist")
+	}
+
+	// No cloud resources are created.
+	m.Clusters.AssertExpectations(t)
+	m.NodePooler.AssertExpectations(t)
+}
+
+func TestCreateClusterUnknownDriftPolicy(t *testing.T) {
+	_, ctrl := makeTestMock()
+
+	cluster := model.Cluster{
+		ResourceMeta: model.ResourceMeta{Name: "foo"},
+		DriftPolicy:  "ignore",
+	}
+
+	if err := ctrl.CreateCluster(cluster, model.Assets{}); err != ErrUnknownDriftPolicy {
+		t.Errorf("wrong error; got %q; want %q", err, ErrUnknownDriftPolicy)
+	}
+}
+
+func TestCreateClusterDNSConfig(t *testing.T) {
+	_, ctrl := makeTestMock()
+
+	tests := []struct {
+		dns     model.DNSConfig
+		want    model.DNSConfig
+		wantErr bool
+	}{
+		{
+			dns: model.DNSConfig{
+				UpstreamNameservers: []string{"8.8.8.8"},
+				StubDomains:         map[string][]string{"acme.local": {"10.0.0.2"}},
+				Autoscaling:         &model.DNSAutoscaling{MaxReplicas: 5},
+			},
+			want: model.DNSConfig{
+				Provider:            constants.DefaultDNSProvider,
+				UpstreamNameservers: []string{"8.8.8.8"},
+				StubDomains:         map[string][]string{"acme.local": {"10.0.0.2"}},
+				Autoscaling: &model.DNSAutoscaling{
+					MinReplicas:     constants.DefaultDNSMinReplicas,
+					MaxReplicas:     5,
+					CoresPerReplica: constants.DefaultDNSCoresPerReplica,
+					NodesPerReplica: constants.DefaultDNSNodesPerReplica,
+				},
+			},
+		},
+		{dns: model.DNSConfig{Provider: "bind"}, wantErr: true},
+		{
+			dns:  model.DNSConfig{Provider: constants.DNSProviderCoreDNS},
+			want: model.DNSConfig{Provider: constants.DNSProviderCoreDNS},
+		},
+		{dns: model.DNSConfig{UpstreamNameservers: []string{"dns.google"}}, wantErr: true},
+		{dns: model.DNSConfig{UpstreamNameservers: []string{"1.1.1.1", "1.0.0.1", "8.8.8.8", "8.8.4.4"}}, wantErr: true},
+		{dns: model.DNSConfig{StubDomains: map[string][]string{"acme.local": nil}}, wantErr: true},
+		{dns: model.DNSConfig{Autoscaling: &model.DNSAutoscaling{MinReplicas: 3, MaxReplicas: 2}}, wantErr: true},
+	}
+
+	for i, tt := range tests {
+		err := ctrl.setDNSConfigDefaults(&tt.dns)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("test %d: got error %v; want error %t", i, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(tt.dns, tt.want) {
+			t.Errorf("test %d: got %+v; want %+v", i, tt.dns, tt.want)
+		}
+	}
+}
+
+// limitedCloud is a cloud provider with a given set of capabilities.
+type limitedCloud struct {
+	cloudprovider.Interface
+	caps cloudprovider.Capabilities
+}
+
+func (c limitedCloud) Capabilities() cloudprovider.Capabilities {
+	return c.caps
+}
+
+func TestCreateClusterNotSupported(t *testing.T) {
+	m, ctrl := makeTestMock()
+	m.Provider.On("ProviderName").Return(cloudProviderName)
+	ctrl.Cloud = limitedCloud{
+		Interface: m.Provider,
+		caps:      cloudprovider.Capabilities{VolumeTypes: []string{"ssd"}},
+	}
+
+	tests := []struct {
+		cluster func(*model.Cluster)
+		wantErr error
+	}{
+		{
+			cluster: func(c *model.Cluster) { c.Internal = true },
+		},
+		{
+			cluster: func(c *model.Cluster) { c.ComputePools[0].SpotPrice = "0.05" },
+		},
+		{
+			cluster: func(c *model.Cluster) { c.ComputePools[0].VolumeType = "hdd" },
+		},
+		{
+			cluster: func(c *model.Cluster) { c.MasterPool.SpotPrice = "0.05" },
+			wantErr: ErrMasterSpotInstances,
+		},
+	}
+
+	for i, tt := range tests {
+		cluster := model.Cluster{
+			ResourceMeta: model.ResourceMeta{Name: "foo"},
+			MasterPool:   model.MasterPool{NodePool: testutil.MakeNodePool("foo", "master")},
+			ComputePools: []model.ComputePool{{NodePool: testutil.MakeNodePool("foo", "compute")}},
+		}
+		tt.cluster(&cluster)
+
+		err := ctrl.CreateCluster(cluster, model.Assets{})
+		if tt.wantErr != nil {
+			if err != tt.wantErr {
+				t.Errorf("test %d: wrong error; got %q; want %q", i, err, tt.wantErr)
+			}
+			continue
+		}
+		if _, ok := err.(*NotSupportedError); !ok {
+			t.Errorf("test %d: got error %v; want *NotSupportedError", i, err)
+		}
+	}
+
+	// No cloud resources are looked up nor created.
+	m.Clusters.AssertExpectations(t)
+}
+
+func TestCreateComputePoolUserDataSize(t *testing.T) {
+	m, ctrl := makeTestMock()
+	ctrl.Cloud = limitedCloud{
+		Interface: m.Provider,
+		caps:      cloudprovider.Capabilities{MaxUserDataSize: 4},
+	}
+
+	clusterName := "foo"
+	p := model.ComputePool{
+		NodePool: testutil.MakeNodePool(clusterName, "compute"),
+	}
+
+	m.Clusters.On("GetClusters", "").Return([]*model.Cluster{&model.Cluster{ResourceMeta: model.ResourceMeta{Name: clusterName}}}, nil).Once()
+	m.NodePooler.On("GetComputePools", clusterName, "compute").Return([]*model.ComputePool{}, nil)
+	m.NodePooler.On("ValidateNodePool", mock.AnythingOfType("model.NodePool")).Return(nil)
+	m.Provider.On("ProviderName").Return(cloudProviderName)
+	m.UserData.On("RenderComputeCloudConfig", cloudProviderName, clusterName, p.KubeVersion).Return([]byte("mocked userdata"), nil)
+
+	if err := ctrl.CreateComputePool(p); err == nil {
+		t.Error("expected an error")
+	}
+
+	// The compute pool is not created.
+	m.NodePooler.AssertExpectations(t)
+}
+
 func TestCreateMasterPoolAlreadyExists(t *testing.T) {
 	m, ctrl := makeTestMock()
 
@@ -119,28 +332,168 @@ func TestCreateMasterPoolAlreadyExists(t *testing.T) {
 	m.NodePooler.AssertExpectations(t)
 }
 
+func TestCreateComputePoolMasterExtraArgs(t *testing.T) {
+	m, ctrl := makeTestMock()
+
+	clusterName := "foo"
+	p := model.ComputePool{
+		NodePool: testutil.MakeNodePool(clusterName, "compute"),
+	}
+	p.ExtraArgs.APIServer = model.ExtraArgs{"v": "2"}
+
+	m.Clusters.On("GetClusters", "").Return([]*model.Cluster{&model.Cluster{ResourceMeta: model.ResourceMeta{Name: clusterName}}}, nil).Once()
+	m.NodePooler.On("GetComputePools", clusterName, "compute").Return([]*model.ComputePool{}, nil)
+
+	if err := ctrl.CreateComputePool(p); err != ErrMasterExtraArgs {
+		t.Errorf("wrong error; got %q; want %q", err, ErrMasterExtraArgs)
+	}
+
+	m.Clusters.AssertExpectations(t)
+	m.NodePooler.AssertExpectations(t)
+}
+
 func TestDeleteCluster(t *testing.T) {
 	m, ctrl := makeTestMock()
-	m.Clusters.On("DeleteCluster", "foo").Return(nil)
+	m.Clusters.On("DeleteCluster", "foo", []string(nil)).Return([]*model.Resource{}, nil)
+
+	if _, err := ctrl.DeleteCluster(nil, "foo"); err != nil {
+		t.Error(err)
+	}
+
+	m.Clusters.AssertExpectations(t)
+}
+
+func TestDeleteClusterRetain(t *testing.T) {
+	m, ctrl := makeTestMock()
+	retain := []string{constants.RetainVolumes}
+	volume := &model.Resource{Type: "volume", ID: "vol-123"}
+	m.Clusters.On("DeleteCluster", "foo", retain).Return([]*model.Resource{volume}, nil)
 
-	if err := ctrl.DeleteCluster("foo"); err != nil {
+	retained, err := ctrl.DeleteCluster(retain, "foo")
+	if err != nil {
 		t.Error(err)
 	}
+	if len(retained) != 1 || retained[0] != volume {
+		t.Errorf("got retained resources %v; want %v", retained, []*model.Resource{volume})
+	}
+
+	if _, err := ctrl.DeleteCluster([]string{"everything"}, "foo"); err != ErrUnknownRetainKind {
+		t.Errorf("wrong error; got %q; want %q", err, ErrUnknownRetainKind)
+	}
 
 	m.Clusters.AssertExpectations(t)
 }
 
+func TestGetEvents(t *testing.T) {
+	m, ctrl := makeTestMock()
+	m.Provider.On("Events").Return(m.Events, true)
+	m.Events.On("GetEvents", "foo").Return([]*model.Event{
+		{Time: 30, ResourceID: "c"},
+		{Time: 10, ResourceID: "a"},
+		{Time: 20, ResourceID: "b"},
+	}, nil)
+
+	events, err := ctrl.GetEvents("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := ""
+	for _, e := range events {
+		got += e.ResourceID
+	}
+	if got != "abc" {
+		t.Errorf("events are not in chronological order; got %q; want %q", got, "abc")
+	}
+
+	m.Events.AssertExpectations(t)
+}
+
+// fakeNodeLister returns a list of nodes per GetNodes call.
+type fakeNodeLister struct {
+	labels model.Labels
+	nodes  [][]kube.Node
+	errs   []error
+}
+
+func (f *fakeNodeLister) GetNodes(labels model.Labels) ([]kube.Node, error) {
+	f.labels = labels
+	nodes, err := f.nodes[0], f.errs[0]
+	if len(f.nodes) > 1 {
+		f.nodes, f.errs = f.nodes[1:], f.errs[1:]
+	}
+	return nodes, err
+}
+
+func TestWaitForComputePool(t *testing.T) {
+	m, ctrl := makeTestMock()
+
+	cluster := &model.Cluster{ResourceMeta: model.ResourceMeta{Name: "foo"}, KubeAPIURL: "https://kube.example.com"}
+	m.Clusters.On("GetClusters", "").Return([]*model.Cluster{cluster}, nil)
+
+	lister := &fakeNodeLister{
+		nodes: [][]kube.Node{
+			nil,
+			{{Name: "a", Ready: true}, {Name: "b"}},
+			{{Name: "a", Ready: true}, {Name: "b", Ready: true}},
+		},
+		errs: []error{errors.New("connection refused"), nil, nil},
+	}
+	ctrl.RequestTimeout = 5 * time.Second
+	defer func(f func(string, model.Assets, time.Duration) (nodeLister, error)) { newNodeLister = f }(newNodeLister)
+	newNodeLister = func(apiURL string, a model.Assets, timeout time.Duration) (nodeLister, error) {
+		if apiURL != cluster.KubeAPIURL {
+			t.Errorf("got kube API URL %q; want %q", apiURL, cluster.KubeAPIURL)
+		}
+		if timeout != ctrl.RequestTimeout {
+			t.Errorf("got request timeout %s; want %s", timeout, ctrl.RequestTimeout)
+		}
+		return lister, nil
+	}
+	defer func(d time.Duration) { nodePollInterval = d }(nodePollInterval)
+	nodePollInterval = time.Millisecond
+
+	if err := ctrl.WaitForComputePool("foo", "compute", 2, model.Assets{}, time.Minute); err != nil {
+		t.Error(err)
+	}
+	if lister.labels[constants.PoolNameLabelKey] != "compute" {
+		t.Errorf("nodes are not filtered by pool name, got labels %v", lister.labels)
+	}
+
+	// One node keeps failing and another one never registers.
+	lister.nodes = [][]kube.Node{{{Name: "a", Ready: true}, {Name: "b", Reason: "KubeletNotReady", Message: "network not ready"}}}
+	lister.errs = []error{nil}
+	err := ctrl.WaitForComputePool("foo", "compute", 3, model.Assets{}, 10*time.Millisecond)
+	want := `computepool "compute" has 1 of 3 nodes ready: node "b" is not ready: KubeletNotReady: network not ready; 1 node(s) did not register with the cluster`
+	if err == nil || err.Error() != want {
+		t.Errorf("wrong error; got %v; want %q", err, want)
+	}
+	if _, ok := err.(*NodesNotReadyError); !ok {
+		t.Errorf("got error of type %T; want *NodesNotReadyError", err)
+	}
+
+	if err := ctrl.WaitForComputePool("bar", "compute", 2, model.Assets{}, time.Minute); err != ErrClusterDoesNotExist {
+		t.Errorf("wrong error; got %q; want %q", err, ErrClusterDoesNotExist)
+	}
+}
+
 func makeTestMock() (*testMock, *Controller) {
 	m := &testMock{
 		Provider:   &cloudProviderMocks.Interface{},
 		Clusters:   &cloudProviderMocks.Clusters{},
 		NodePooler: &cloudProviderMocks.NodePooler{},
 		Node:       &cloudProviderMocks.Node{},
+		Events:     &cloudProviderMocks.Events{},
+		Drift:      &cloudProviderMocks.Drift{},
 		UserData:   &userdataMocks.UserDater{},
 	}
 
 	m.Provider.On("Clusters").Return(m.Clusters, true)
 	m.Provider.On("NodePooler").Return(m.NodePooler, true)
+	m.Provider.On("Capabilities").Return(cloudprovider.Capabilities{
+		SpotInstances:        true,
+		InternalLoadBalancer: true,
+		NodePoolFields:       cloudprovider.AllNodePoolFields,
+	})
 
 	ctrl := New(Config{
 		Logger:   log.New(os.Stderr, "", log.LstdFlags),
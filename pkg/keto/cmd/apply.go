@@ -0,0 +1,124 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/UKHomeOffice/keto/pkg/controller"
+	"github.com/UKHomeOffice/keto/pkg/manifest"
+	"github.com/UKHomeOffice/keto/pkg/model"
+
+	"github.com/spf13/cobra"
+)
+
+// applyCmd represents the apply command
+var applyCmd = &cobra.Command{
+	Use:          "apply -f <FILENAME>",
+	Short:        "Apply a manifest of clusters and node pools",
+	SilenceUsage: true,
+	RunE: func(c *cobra.Command, args []string) error {
+		return applyCmdFunc(c, args)
+	},
+}
+
+func applyCmdFunc(c *cobra.Command, args []string) error {
+	filename, err := c.Flags().GetString("filename")
+	if err != nil {
+		return err
+	}
+	if filename == "" {
+		return errors.New("manifest file name is not specified")
+	}
+	dryRun, err := c.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	m, err := manifest.Parse(r)
+	if err != nil {
+		return err
+	}
+
+	cli, err := newCLI(c)
+	if err != nil {
+		return err
+	}
+
+	changes, err := cli.ctrl.Plan(m)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		printChanges(cli, changes)
+		return nil
+	}
+
+	// Assets are only needed to create new clusters.
+	a := model.Assets{}
+	for _, ch := range changes {
+		if ch.Kind == manifest.KindCluster && ch.Action == controller.ActionCreate {
+			if a, err = cli.readAssetsDirFlag(c); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	applied, err := cli.ctrl.Apply(m, a)
+	printChanges(cli, applied)
+	return err
+}
+
+func printChanges(cli *cli, changes []*controller.Change) {
+	for _, ch := range changes {
+		name := ch.Name
+		if ch.ClusterName != "" {
+			name = ch.ClusterName + "/" + ch.Name
+		}
+		if len(ch.Diff) > 0 {
+			cli.logger.Printf("%s %q: %s (%s)", ch.Kind, name, ch.Action, strings.Join(ch.Diff, ", "))
+			continue
+		}
+		if len(ch.Drift) > 0 {
+			cli.logger.Printf("%s %q: %s, drifted, %s (%s)", ch.Kind, name, ch.Action, ch.DriftPolicy, strings.Join(ch.Drift, ", "))
+			continue
+		}
+		cli.logger.Printf("%s %q: %s", ch.Kind, name, ch.Action)
+	}
+}
+
+func init() {
+	applyCmd.Flags().StringP("filename", "f", "", "Manifest file to apply, - reads it from stdin")
+	applyCmd.Flags().Bool("dry-run", false, "Only print changes that would be applied")
+
+	addAssetsDirFlag(
+		applyCmd,
+	)
+}
@@ -23,8 +23,11 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/UKHomeOffice/keto/pkg/keto/util"
+	"github.com/UKHomeOffice/keto/pkg/kubeargs"
 	"github.com/UKHomeOffice/keto/pkg/model"
 
 	"github.com/spf13/cobra"
@@ -86,19 +89,11 @@ func createClusterCmdFunc(c *cobra.Command, args []string) error {
 	}
 	name := args[0]
 
-	assetsDir, err := c.Flags().GetString("assets-dir")
+	a, err := cli.readAssetsDirFlag(c)
 	if err != nil {
 		return err
 	}
-	if assetsDir == "" {
-		d, err := os.Getwd()
-		if err != nil {
-			return err
-		}
-		assetsDir = d
-		cli.debugLogger.Printf("assets directory is not specified, using %q instead", assetsDir)
-	}
-	a, err := cli.readAssetFiles(assetsDir)
+	wait, waitTimeout, err := getWaitFlags(c)
 	if err != nil {
 		return err
 	}
@@ -121,12 +116,22 @@ func createClusterCmdFunc(c *cobra.Command, args []string) error {
 	}
 	cluster.DNSZone = dnsZone
 
+	driftPolicy, err := c.Flags().GetString("drift-policy")
+	if err != nil {
+		return err
+	}
+	cluster.DriftPolicy = driftPolicy
+
 	labels, err := c.Flags().GetStringSlice("labels")
 	if err != nil {
 		return err
 	}
 	cluster.Labels = util.KVsToLabels(labels)
 
+	if cluster.DNS, err = getDNSConfig(*c); err != nil {
+		return err
+	}
+
 	p, err := makeMasterPool("master", name, *c)
 	if err != nil {
 		return err
@@ -149,10 +154,107 @@ func createClusterCmdFunc(c *cobra.Command, args []string) error {
 	if err := cli.ctrl.CreateCluster(cluster, a); err != nil {
 		return err
 	}
+
+	if wait {
+		cli.logger.Printf("Waiting for cluster %q nodes to become ready", cluster.Name)
+		if err := cli.ctrl.WaitForMasterPool(cluster.Name, cluster.MasterPool.Name, a, waitTimeout); err != nil {
+			return err
+		}
+		for _, p := range cluster.ComputePools {
+			if err := cli.ctrl.WaitForComputePool(cluster.Name, p.Name, p.Size, a, waitTimeout); err != nil {
+				return err
+			}
+		}
+	}
 	cli.logger.Printf("Cluster %q successfully created", cluster.Name)
 	return nil
 }
 
+// getDNSConfig returns a cluster DNS addon config from DNS flags. Replicas
+// are only autoscaled if any of the autoscaling flags are set.
+func getDNSConfig(c cobra.Command) (model.DNSConfig, error) {
+	dns := model.DNSConfig{}
+
+	provider, err := c.Flags().GetString("dns-provider")
+	if err != nil {
+		return dns, err
+	}
+	dns.Provider = provider
+
+	upstream, err := c.Flags().GetStringSlice("dns-upstream-nameservers")
+	if err != nil {
+		return dns, err
+	}
+	if len(upstream) > 0 {
+		dns.UpstreamNameservers = upstream
+	}
+
+	stubDomains, err := c.Flags().GetStringArray("dns-stub-domains")
+	if err != nil {
+		return dns, err
+	}
+	for _, kv := range stubDomains {
+		s := strings.SplitN(kv, "=", 2)
+		if len(s) != 2 || s[0] == "" || s[1] == "" {
+			return dns, fmt.Errorf("invalid --dns-stub-domains %q, must be in domain=nameserver-ip[,nameserver-ip] format", kv)
+		}
+		if dns.StubDomains == nil {
+			dns.StubDomains = map[string][]string{}
+		}
+		dns.StubDomains[s[0]] = append(dns.StubDomains[s[0]], strings.Split(s[1], ",")...)
+	}
+
+	a := &model.DNSAutoscaling{}
+	autoscale := false
+	for flag, v := range map[string]*int{
+		"dns-min-replicas":      &a.MinReplicas,
+		"dns-max-replicas":      &a.MaxReplicas,
+		"dns-cores-per-replica": &a.CoresPerReplica,
+		"dns-nodes-per-replica": &a.NodesPerReplica,
+	} {
+		if *v, err = c.Flags().GetInt(flag); err != nil {
+			return dns, err
+		}
+		autoscale = autoscale || c.Flags().Changed(flag)
+	}
+	if autoscale {
+		dns.Autoscaling = a
+	}
+	return dns, nil
+}
+
+// readAssetsDirFlag reads asset files from the directory set by the
+// assets-dir flag, or the current directory if it is not set.
+func (c cli) readAssetsDirFlag(cmd *cobra.Command) (model.Assets, error) {
+	assetsDir, err := cmd.Flags().GetString("assets-dir")
+	if err != nil {
+		return model.Assets{}, err
+	}
+	if assetsDir == "" {
+		d, err := os.Getwd()
+		if err != nil {
+			return model.Assets{}, err
+		}
+		assetsDir = d
+		c.debugLogger.Printf("assets directory is not specified, using %q instead", assetsDir)
+	}
+	return c.readAssetFiles(assetsDir)
+}
+
+// getWaitFlags returns whether to wait for node pool nodes to become ready
+// and for how long.
+func getWaitFlags(c *cobra.Command) (bool, time.Duration, error) {
+	wait, err := c.Flags().GetBool("wait")
+	if err != nil {
+		return false, 0, err
+	}
+	timeout, err := c.Flags().GetDuration("wait-timeout")
+	if err != nil {
+		return false, 0, err
+	}
+	return wait, timeout, nil
+}
+
 // readAssetFiles reads asset files as byte arrays from the directory d and returns
 // model.Assets.
 func (c cli) readAssetFiles(d string) (model.Assets, error) {
@@ -254,10 +356,29 @@ func createMasterPoolCmdFunc(c *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+
+	// Assets are only needed to talk to the cluster API.
+	wait, waitTimeout, err := getWaitFlags(c)
+	if err != nil {
+		return err
+	}
+	a := model.Assets{}
+	if wait {
+		if a, err = cli.readAssetsDirFlag(c); err != nil {
+			return err
+		}
+	}
+
 	cli.logger.Printf("Creating masterpool %q for cluster %q", p.Name, p.ClusterName)
 	if err := cli.ctrl.CreateMasterPool(p); err != nil {
 		return err
 	}
+	if wait {
+		cli.logger.Printf("Waiting for masterpool %q nodes to become ready", p.Name)
+		if err := cli.ctrl.WaitForMasterPool(p.ClusterName, p.Name, a, waitTimeout); err != nil {
+			return err
+		}
+	}
 	cli.logger.Printf("Masterpool %q successfully created", p.Name)
 	return nil
 }
@@ -289,11 +410,27 @@ func makeMasterPool(name, clusterName string, c cobra.Command) (model.MasterPool
 	if err != nil {
 		return p, err
 	}
+	volumeType, err := c.Flags().GetString("volume-type")
+	if err != nil {
+		return p, err
+	}
 	labels, err := c.Flags().GetStringSlice("labels")
 	if err != nil {
 		return p, err
 	}
 	p.Labels = util.KVsToLabels(labels)
+	if p.ExtraArgs.Kubelet, err = getExtraArgs(c, "kubelet-extra-args"); err != nil {
+		return p, err
+	}
+	if p.ExtraArgs.APIServer, err = getExtraArgs(c, "api-server-extra-args"); err != nil {
+		return p, err
+	}
+	if p.ExtraArgs.ControllerManager, err = getExtraArgs(c, "controller-manager-extra-args"); err != nil {
+		return p, err
+	}
+	if p.ExtraArgs.Scheduler, err = getExtraArgs(c, "scheduler-extra-args"); err != nil {
+		return p, err
+	}
 
 	p.Name = name
 	p.ClusterName = clusterName
@@ -302,10 +439,24 @@ func makeMasterPool(name, clusterName string, c cobra.Command) (model.MasterPool
 	p.SSHKey = sshKey
 	p.Networks = networks
 	p.DiskSize = diskSize
+	p.VolumeType = volumeType
 	p.MachineType = machineType
 	return p, nil
 }
 
+// getExtraArgs returns parsed extra args of a given flag name.
+func getExtraArgs(c cobra.Command, name string) (model.ExtraArgs, error) {
+	kvs, err := c.Flags().GetStringArray(name)
+	if err != nil {
+		return nil, err
+	}
+	args, err := kubeargs.Parse(kvs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --%s: %v", name, err)
+	}
+	return args, nil
+}
+
 var createComputePoolCmd = &cobra.Command{
 	Use:          "computepool NAME",
 	Aliases:      computePoolCmdAliases,
@@ -339,10 +490,29 @@ func createComputePoolCmdFunc(c *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+
+	// Assets are only needed to talk to the cluster API.
+	wait, waitTimeout, err := getWaitFlags(c)
+	if err != nil {
+		return err
+	}
+	a := model.Assets{}
+	if wait {
+		if a, err = cli.readAssetsDirFlag(c); err != nil {
+			return err
+		}
+	}
+
 	cli.logger.Printf("Creating computepool %q for cluster %q", p.Name, p.ClusterName)
 	if err := cli.ctrl.CreateComputePool(p); err != nil {
 		return err
 	}
+	if wait {
+		cli.logger.Printf("Waiting for computepool %q nodes to become ready", p.Name)
+		if err := cli.ctrl.WaitForComputePool(p.ClusterName, p.Name, p.Size, a, waitTimeout); err != nil {
+			return err
+		}
+	}
 	cli.logger.Printf("Masterpool %q successfully created", p.Name)
 	return nil
 }
@@ -378,11 +548,22 @@ func makeComputePool(name, clusterName string, c cobra.Command) (model.ComputePo
 	if err != nil {
 		return p, err
 	}
+	volumeType, err := c.Flags().GetString("volume-type")
+	if err != nil {
+		return p, err
+	}
+	spotPrice, err := c.Flags().GetString("spot-price")
+	if err != nil {
+		return p, err
+	}
 	labels, err := c.Flags().GetStringSlice("labels")
 	if err != nil {
 		return p, err
 	}
 	p.Labels = util.KVsToLabels(labels)
+	if p.ExtraArgs.Kubelet, err = getExtraArgs(c, "kubelet-extra-args"); err != nil {
+		return p, err
+	}
 
 	p.Name = name
 	p.ClusterName = clusterName
@@ -391,8 +572,10 @@ func makeComputePool(name, clusterName string, c cobra.Command) (model.ComputePo
 	p.SSHKey = sshKey
 	p.Networks = networks
 	p.DiskSize = diskSize
+	p.VolumeType = volumeType
 	p.MachineType = machineType
 	p.Size = size
+	p.SpotPrice = spotPrice
 	return p, nil
 }
 
@@ -443,6 +626,17 @@ func init() {
 		createComputePoolCmd,
 	)
 
+	addVolumeTypeFlag(
+		createClusterCmd,
+		createMasterPoolCmd,
+		createComputePoolCmd,
+	)
+
+	addSpotPriceFlag(
+		createClusterCmd,
+		createComputePoolCmd,
+	)
+
 	addLabelsFlag(
 		createClusterCmd,
 		createComputePoolCmd,
@@ -466,9 +660,36 @@ func init() {
 
 	addAssetsDirFlag(
 		createClusterCmd,
+		createMasterPoolCmd,
+		createComputePoolCmd,
+	)
+
+	addWaitFlags(
+		createClusterCmd,
+		createMasterPoolCmd,
+		createComputePoolCmd,
 	)
 
 	addDNSZoneFlag(
 		createClusterCmd,
 	)
+
+	addDriftPolicyFlag(
+		createClusterCmd,
+	)
+
+	addDNSFlags(
+		createClusterCmd,
+	)
+
+	addKubeletExtraArgsFlag(
+		createClusterCmd,
+		createMasterPoolCmd,
+		createComputePoolCmd,
+	)
+
+	addMasterExtraArgsFlags(
+		createClusterCmd,
+		createMasterPoolCmd,
+	)
 }
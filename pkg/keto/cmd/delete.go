@@ -51,8 +51,17 @@ func deleteClusterCmdFunc(c *cobra.Command, args []string) error {
 		return err
 	}
 
+	retain, err := c.Flags().GetStringSlice("retain")
+	if err != nil {
+		return err
+	}
+
 	cli.logger.Printf("Deleting cluster %q", args)
-	if err := cli.ctrl.DeleteCluster(args...); err != nil {
+	retained, err := cli.ctrl.DeleteCluster(retain, args...)
+	for _, r := range retained {
+		cli.logger.Printf("Retained %s %q", r.Type, r.ID)
+	}
+	if err != nil {
 		return err
 	}
 	cli.logger.Printf("Cluster %q successfully deleted", args)
@@ -148,4 +157,8 @@ func init() {
 		deleteMasterPoolCmd,
 		deleteComputePoolCmd,
 	)
+
+	addRetainFlag(
+		deleteClusterCmd,
+	)
 }
@@ -17,6 +17,7 @@ limitations under the License.
 package cmd
 
 import (
+	"errors"
 	"os"
 
 	"github.com/UKHomeOffice/keto/pkg/keto"
@@ -105,6 +106,49 @@ func getComputePoolCmdFunc(c *cobra.Command, args []string) error {
 	return listComputePools(cli, clusterName, args...)
 }
 
+var getEventsCmd = &cobra.Command{
+	Use:          "events",
+	Aliases:      []string{"ev", "event"},
+	Short:        "Get cluster events",
+	Long:         "Get cluster events in chronological order",
+	SilenceUsage: true,
+	PreRunE: func(c *cobra.Command, args []string) error {
+		return validateGetEventsFlags(c, args)
+	},
+	RunE: func(c *cobra.Command, args []string) error {
+		return getEventsCmdFunc(c, args)
+	},
+}
+
+func validateGetEventsFlags(c *cobra.Command, args []string) error {
+	if !c.Flags().Changed("cluster") {
+		return errors.New("cluster name must be set")
+	}
+	// Only cloud provider native events are available for now.
+	fromCloud, err := c.Flags().GetBool("from-cloud")
+	if err != nil {
+		return err
+	}
+	if !fromCloud {
+		return errors.New("only cloud provider events are supported, use --from-cloud")
+	}
+	return nil
+}
+
+func getEventsCmdFunc(c *cobra.Command, args []string) error {
+	clusterName, err := c.Flags().GetString("cluster")
+	if err != nil {
+		return err
+	}
+
+	cli, err := newCLI(c)
+	if err != nil {
+		return err
+	}
+
+	return listEvents(cli, clusterName)
+}
+
 func listMasterPools(cli *cli, clusterName string, names ...string) error {
 	pools, err := cli.ctrl.GetMasterPools(clusterName, names...)
 	if err != nil {
@@ -129,16 +173,30 @@ func listClusters(cli *cli, names ...string) error {
 	return keto.PrintClusters(keto.GetPrinter(os.Stdout), clusters, true)
 }
 
+func listEvents(cli *cli, clusterName string) error {
+	events, err := cli.ctrl.GetEvents(clusterName)
+	if err != nil {
+		return err
+	}
+	return keto.PrintEvents(keto.GetPrinter(os.Stdout), events, true)
+}
+
 func init() {
 	getCmd.AddCommand(
 		getClusterCmd,
 		getMasterPoolCmd,
 		getComputePoolCmd,
+		getEventsCmd,
 	)
 
 	// Add flags that are relevant to different subcommands.
 	addClusterFlag(
 		getMasterPoolCmd,
 		getComputePoolCmd,
+		getEventsCmd,
+	)
+
+	addFromCloudFlag(
+		getEventsCmd,
 	)
 }
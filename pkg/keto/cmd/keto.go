@@ -22,8 +22,10 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
+	"github.com/UKHomeOffice/keto/pkg/cache"
 	"github.com/UKHomeOffice/keto/pkg/cloudprovider"
 	"github.com/UKHomeOffice/keto/pkg/constants"
 	"github.com/UKHomeOffice/keto/pkg/controller"
@@ -93,7 +95,35 @@ func newCLI(c *cobra.Command) (*cli, error) {
 		return &cli{}, err
 	}
 
-	cloud, err := cloudprovider.InitCloudProvider(cloudName, debugLogger)
+	requestTimeout, err := c.Flags().GetDuration("request-timeout")
+	if err != nil {
+		return &cli{}, err
+	}
+	timeout, err := c.Flags().GetDuration("timeout")
+	if err != nil {
+		return &cli{}, err
+	}
+	cloudConfig := cloudprovider.Config{
+		RequestTimeout:   requestTimeout,
+		OperationTimeout: timeout,
+	}
+
+	noCache, err := c.Flags().GetBool("no-cache")
+	if err != nil {
+		return &cli{}, err
+	}
+	if !noCache {
+		cacheTTL, err := c.Flags().GetDuration("cache-ttl")
+		if err != nil {
+			return &cli{}, err
+		}
+		if d := cacheDir(); d != "" {
+			debugLogger.Printf("using cache directory %q with %s TTL", d, cacheTTL)
+			cloudConfig.Cache = cache.New(d, cacheTTL)
+		}
+	}
+
+	cloud, err := cloudprovider.InitCloudProvider(cloudName, debugLogger, cloudConfig)
 	if err != nil {
 		return &cli{}, err
 	}
@@ -101,9 +131,10 @@ func newCLI(c *cobra.Command) (*cli, error) {
 	ud := userdata.New(debugLogger)
 	ctrl := controller.New(
 		controller.Config{
-			Logger:   debugLogger,
-			Cloud:    cloud,
-			UserData: ud,
+			Logger:         debugLogger,
+			Cloud:          cloud,
+			UserData:       ud,
+			RequestTimeout: requestTimeout,
 		})
 
 	return &cli{
@@ -113,6 +144,16 @@ func newCLI(c *cobra.Command) (*cli, error) {
 	}, nil
 }
 
+// cacheDir returns a directory for caching cloud provider responses. An empty
+// string is returned if the user home directory is unknown.
+func cacheDir() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".keto", "cache")
+}
+
 func init() {
 	// Local flags
 	KetoCmd.Flags().BoolP("help", "h", false, "Help message")
@@ -123,9 +164,16 @@ func init() {
 		"Cloud provider name. Supported providers: "+strings.Join(cloudprovider.CloudProviders(), ", "))
 	// TODO: set default to false once we're happy with the tool.
 	KetoCmd.PersistentFlags().Bool("debug", true, "Enable debug logging")
+	KetoCmd.PersistentFlags().Duration("request-timeout", constants.DefaultRequestTimeout,
+		"Maximum time a single cloud provider or cluster API call may take, zero means no limit")
+	KetoCmd.PersistentFlags().Duration("timeout", constants.DefaultOperationTimeout,
+		"Maximum time to wait for a cloud operation, e.g. a stack creation, to complete, zero means no limit")
+	KetoCmd.PersistentFlags().Bool("no-cache", false, "Do not cache read-only cloud provider queries")
+	KetoCmd.PersistentFlags().Duration("cache-ttl", constants.DefaultCacheTTL, "How long cached cloud provider responses are valid for")
 
 	KetoCmd.AddCommand(
 		getCmd,
+		applyCmd,
 		createCmd,
 		deleteCmd,
 		describeCmd,
@@ -176,6 +224,20 @@ func addDiskSizeFlag(c ...*cobra.Command) {
 	}
 }
 
+// addVolumeTypeFlag adds a volume-type flag
+func addVolumeTypeFlag(c ...*cobra.Command) {
+	for _, i := range c {
+		i.Flags().String("volume-type", "", "Cloud specific node boot disk type, if supported by the cloud")
+	}
+}
+
+// addSpotPriceFlag adds a spot-price flag
+func addSpotPriceFlag(c ...*cobra.Command) {
+	for _, i := range c {
+		i.Flags().String("spot-price", "", "Maximum hourly price of compute pool spot instances, if supported by the cloud")
+	}
+}
+
 // addMachineTypeFlag adds a machine type flag
 func addMachineTypeFlag(c ...*cobra.Command) {
 	for _, i := range c {
@@ -205,6 +267,26 @@ func addLabelsFlag(c ...*cobra.Command) {
 	}
 }
 
+// addKubeletExtraArgsFlag adds a kubelet extra args flag
+func addKubeletExtraArgsFlag(c ...*cobra.Command) {
+	for _, i := range c {
+		i.Flags().StringArray("kubelet-extra-args", []string{},
+			"Extra kubelet flag in a key=value format, can be repeated")
+	}
+}
+
+// addMasterExtraArgsFlags adds extra args flags of master components
+func addMasterExtraArgsFlags(c ...*cobra.Command) {
+	for _, i := range c {
+		i.Flags().StringArray("api-server-extra-args", []string{},
+			"Extra kube-apiserver flag in a key=value format, can be repeated")
+		i.Flags().StringArray("controller-manager-extra-args", []string{},
+			"Extra kube-controller-manager flag in a key=value format, can be repeated")
+		i.Flags().StringArray("scheduler-extra-args", []string{},
+			"Extra kube-scheduler flag in a key=value format, can be repeated")
+	}
+}
+
 // addKubeVersionFlag adds a kubernetes version flag
 func addKubeVersionFlag(c ...*cobra.Command) {
 	for _, i := range c {
@@ -219,9 +301,60 @@ func addAssetsDirFlag(c ...*cobra.Command) {
 	}
 }
 
+// addWaitFlags adds flags for waiting on node pool nodes to become ready
+func addWaitFlags(c ...*cobra.Command) {
+	for _, i := range c {
+		i.Flags().Bool("wait", false, "Wait until nodes register with the cluster API and become ready")
+		i.Flags().Duration("wait-timeout", constants.DefaultNodeReadyTimeout,
+			"Maximum time to wait for nodes to become ready, zero means no limit")
+	}
+}
+
 // addComputePoolsFlag adds a compute pools flag
 func addComputePoolsFlag(c ...*cobra.Command) {
 	for _, i := range c {
 		i.Flags().Int("compute-pools", 1, "Number of compute pools to create")
 	}
 }
+
+// addFromCloudFlag adds a from-cloud flag
+func addFromCloudFlag(c ...*cobra.Command) {
+	for _, i := range c {
+		i.Flags().Bool("from-cloud", false, "Get cloud provider native resources")
+	}
+}
+
+// addDriftPolicyFlag adds a drift policy flag
+func addDriftPolicyFlag(c ...*cobra.Command) {
+	for _, i := range c {
+		i.Flags().String("drift-policy", constants.DefaultDriftPolicy,
+			fmt.Sprintf("Action on out-of-band compute pool changes found by apply: %s|%s", constants.DriftPolicyNotify, constants.DriftPolicyCorrect))
+	}
+}
+
+// addDNSFlags adds flags of the cluster DNS addon
+func addDNSFlags(c ...*cobra.Command) {
+	for _, i := range c {
+		i.Flags().String("dns-provider", "",
+			fmt.Sprintf("Cluster DNS addon: %s|%s (default %q)", constants.DNSProviderKubeDNS, constants.DNSProviderCoreDNS, constants.DefaultDNSProvider))
+		i.Flags().StringSlice("dns-upstream-nameservers", []string{}, "Comma separated list of upstream nameserver IPs")
+		i.Flags().StringArray("dns-stub-domains", []string{},
+			"Stub domain in a domain=nameserver-ip[,nameserver-ip] format, can be repeated")
+		i.Flags().Int("dns-min-replicas", 0,
+			fmt.Sprintf("Autoscale DNS replicas with at least this many replicas (default %d)", constants.DefaultDNSMinReplicas))
+		i.Flags().Int("dns-max-replicas", 0, "Autoscale DNS replicas with at most this many replicas, zero means no limit")
+		i.Flags().Int("dns-cores-per-replica", 0,
+			fmt.Sprintf("Autoscale DNS replicas with a replica per this many cluster cores (default %d)", constants.DefaultDNSCoresPerReplica))
+		i.Flags().Int("dns-nodes-per-replica", 0,
+			fmt.Sprintf("Autoscale DNS replicas with a replica per this many cluster nodes (default %d)", constants.DefaultDNSNodesPerReplica))
+	}
+}
+
+// addRetainFlag adds a retain flag
+func addRetainFlag(c ...*cobra.Command) {
+	for _, i := range c {
+		i.Flags().StringSlice("retain", []string{},
+			fmt.Sprintf("Comma separated list of resources to keep: %s",
+				strings.Join([]string{constants.RetainDNS, constants.RetainVolumes, constants.RetainLB}, ",")))
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"io"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/UKHomeOffice/keto/pkg/keto/util"
 	"github.com/UKHomeOffice/keto/pkg/model"
@@ -37,6 +38,7 @@ const (
 var (
 	clusterColumns  = []string{"NAME", "LABELS"}
 	nodePoolColumns = []string{"NAME", "CLUSTER", "KUBEVERSION", "OSVERSION", "MACHINETYPE", "LABELS"}
+	eventColumns    = []string{"TIME", "SOURCE", "TYPE", "RESOURCE", "STATUS", "MESSAGE"}
 )
 
 // GetPrinter configures a new tabwriter Writer and returns it.
@@ -89,6 +91,29 @@ func PrintComputePool(w *tabwriter.Writer, pools []*model.ComputePool, headers b
 	return w.Flush()
 }
 
+// PrintEvents formats a slice of events into [][]string format with optional
+// headers and calls writeToPrinter to write to w.
+func PrintEvents(w *tabwriter.Writer, events []*model.Event, headers bool) error {
+	data := [][]string{}
+	if headers {
+		data = append(data, eventColumns)
+	}
+	for _, e := range events {
+		data = append(data, []string{formatTime(e.Time), e.Source, e.ResourceType, e.ResourceID, e.Status, e.Message})
+	}
+	fmt.Fprintln(w, formatData(data))
+	return w.Flush()
+}
+
+// formatTime formats unix time t in RFC3339 format in UTC. An unknown time,
+// which is zero, is formatted as an empty string.
+func formatTime(t int64) string {
+	if t == 0 {
+		return ""
+	}
+	return time.Unix(t, 0).UTC().Format(time.RFC3339)
+}
+
 // formatData formats data of slices of string slices ready for tabwriter.
 func formatData(data [][]string) string {
 	rows := []string{}
@@ -0,0 +1,235 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kube provides a minimal Kubernetes API client, which keto uses to
+// check on nodes of the clusters it creates.
+package kube
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/UKHomeOffice/keto/pkg/model"
+)
+
+const (
+	// clientCommonName is the user name keto authenticates as.
+	clientCommonName = "keto"
+	// clientOrganization is the group of the keto user, which is bound to the
+	// cluster-admin role by default.
+	clientOrganization = "system:masters"
+	// clientCertValidity is the lifetime of keto client certificates. They are
+	// only kept in memory and issued for every run.
+	clientCertValidity = time.Hour
+)
+
+var (
+	// ErrInvalidCA is an error to report a kube CA cert or key that cannot be
+	// decoded.
+	ErrInvalidCA = errors.New("invalid kube CA cert or key")
+)
+
+// Node is the observed status of a cluster node.
+type Node struct {
+	Name  string
+	Ready bool
+	// Reason and Message explain why a node is not ready, as reported by
+	// its kubelet.
+	Reason  string
+	Message string
+}
+
+// Client is a Kubernetes API client.
+type Client struct {
+	URL  string
+	http *http.Client
+}
+
+// NewClient returns a new Client of a kube API available at apiURL. Requests
+// are authenticated with a client certificate signed by the kube CA from
+// assets. A zero timeout means no limit.
+func NewClient(apiURL string, a model.Assets, timeout time.Duration) (*Client, error) {
+	caCert, caKey, err := parseCA(a.KubeCACert, a.KubeCAKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := makeClientCert(caCert, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	return &Client{
+		URL: strings.TrimRight(apiURL, "/"),
+		http: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs:      pool,
+					Certificates: []tls.Certificate{cert},
+				},
+			},
+		},
+	}, nil
+}
+
+// GetNodes returns nodes with the given labels, sorted by name.
+func (c *Client) GetNodes(labels model.Labels) ([]Node, error) {
+	nodes := []Node{}
+
+	selectors := []string{}
+	for k, v := range labels {
+		selectors = append(selectors, k+"="+v)
+	}
+	sort.Strings(selectors)
+	u := c.URL + "/api/v1/nodes"
+	if len(selectors) > 0 {
+		u += "?" + url.Values{"labelSelector": {strings.Join(selectors, ",")}}.Encode()
+	}
+
+	resp, err := c.http.Get(u)
+	if err != nil {
+		return nodes, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nodes, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nodes, fmt.Errorf("kube API returned %q: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	var list nodeList
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nodes, fmt.Errorf("failed to decode nodes: %v", err)
+	}
+	for _, n := range list.Items {
+		nodes = append(nodes, n.status())
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes, nil
+}
+
+// nodeList is a subset of the Kubernetes v1.NodeList type.
+type nodeList struct {
+	Items []node `json:"items"`
+}
+
+type node struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Status struct {
+		Conditions []nodeCondition `json:"conditions"`
+	} `json:"status"`
+}
+
+type nodeCondition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// status returns a Node from the Ready condition of n. Nodes that have not
+// reported the condition yet are not ready.
+func (n node) status() Node {
+	s := Node{Name: n.Metadata.Name, Reason: "NodeStatusUnknown", Message: "node has not reported its status yet"}
+	for _, c := range n.Status.Conditions {
+		if c.Type != "Ready" {
+			continue
+		}
+		s.Ready = c.Status == "True"
+		s.Reason = c.Reason
+		s.Message = c.Message
+		if s.Ready {
+			s.Reason, s.Message = "", ""
+		}
+	}
+	return s
+}
+
+// parseCA decodes a PEM encoded CA cert and its RSA key.
+func parseCA(certPEM, keyPEM []byte) (*x509.Certificate, *rsa.PrivateKey, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, ErrInvalidCA
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, ErrInvalidCA
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes); err == nil {
+		return cert, key, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, ErrInvalidCA
+	}
+	key, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, ErrInvalidCA
+	}
+	return cert, key, nil
+}
+
+// makeClientCert issues a short lived admin client certificate signed by
+// a given CA.
+func makeClientCert(caCert *x509.Certificate, caKey *rsa.PrivateKey) (tls.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   clientCommonName,
+			Organization: []string{clientOrganization},
+		},
+		NotBefore:   now.Add(-5 * time.Minute),
+		NotAfter:    now.Add(clientCertValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
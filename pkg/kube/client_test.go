@@ -0,0 +1,118 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kube
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/UKHomeOffice/keto/pkg/model"
+)
+
+func makeTestCA(t *testing.T) model.Assets {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kube-ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return model.Assets{
+		KubeCACert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KubeCAKey:  pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	if _, err := NewClient("https://kube.example.com", model.Assets{}, 0); err != ErrInvalidCA {
+		t.Errorf("got error %v; want %v", err, ErrInvalidCA)
+	}
+
+	c, err := NewClient("https://kube.example.com/", makeTestCA(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.URL != "https://kube.example.com" {
+		t.Errorf("got URL %q", c.URL)
+	}
+	certs := c.http.Transport.(*http.Transport).TLSClientConfig.Certificates
+	if len(certs) != 1 {
+		t.Fatalf("got %d client certificates; want 1", len(certs))
+	}
+	cert, err := x509.ParseCertificate(certs[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != clientCommonName || !reflect.DeepEqual(cert.Subject.Organization, []string{clientOrganization}) {
+		t.Errorf("got unexpected client certificate subject %+v", cert.Subject)
+	}
+}
+
+func TestGetNodes(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/nodes" || r.URL.Query().Get("labelSelector") != "pool-name=compute" {
+			http.Error(w, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"items": [
+{"metadata": {"name": "node-b"}, "status": {"conditions": [
+	{"type": "OutOfDisk", "status": "False"},
+	{"type": "Ready", "status": "False", "reason": "KubeletNotReady", "message": "network not ready"}]}},
+{"metadata": {"name": "node-a"}, "status": {"conditions": [{"type": "Ready", "status": "True", "reason": "KubeletReady"}]}},
+{"metadata": {"name": "node-c"}}
+]}`)
+	}))
+	defer s.Close()
+
+	c := &Client{URL: s.URL, http: http.DefaultClient}
+	nodes, err := c.GetNodes(model.Labels{"pool-name": "compute"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Node{
+		{Name: "node-a", Ready: true},
+		{Name: "node-b", Reason: "KubeletNotReady", Message: "network not ready"},
+		{Name: "node-c", Reason: "NodeStatusUnknown", Message: "node has not reported its status yet"},
+	}
+	if !reflect.DeepEqual(nodes, want) {
+		t.Errorf("got %+v; want %+v", nodes, want)
+	}
+
+	if _, err := c.GetNodes(model.Labels{"pool-name": "master"}); err == nil {
+		t.Error("expected an error on a non 200 response")
+	}
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kubeargs parses and validates extra flags for Kubernetes
+// components.
+package kubeargs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/UKHomeOffice/keto/pkg/model"
+)
+
+// Kubernetes components that extra flags can be set for.
+const (
+	Kubelet           = "kubelet"
+	APIServer         = "kube-apiserver"
+	ControllerManager = "kube-controller-manager"
+	Scheduler         = "kube-scheduler"
+)
+
+// managedFlags are flags that keto sets itself, overriding them would break
+// the cluster.
+var managedFlags = map[string][]string{
+	Kubelet: {
+		"cloud-config",
+		"cloud-provider",
+		"cluster-dns",
+		"cni-bin-dir",
+		"cni-conf-dir",
+		"kubeconfig",
+		"network-plugin",
+		"node-labels",
+		"pod-manifest-path",
+		"register-with-taints",
+		"require-kubeconfig",
+	},
+	APIServer: {
+		"advertise-address",
+		"client-ca-file",
+		"cloud-config",
+		"cloud-provider",
+		"etcd-cafile",
+		"etcd-certfile",
+		"etcd-keyfile",
+		"etcd-servers",
+		"insecure-port",
+		"kubelet-client-certificate",
+		"kubelet-client-key",
+		"secure-port",
+		"service-account-key-file",
+		"tls-cert-file",
+		"tls-private-key-file",
+	},
+	ControllerManager: {
+		"allocate-node-cidrs",
+		"cloud-config",
+		"cloud-provider",
+		"cluster-cidr",
+		"cluster-signing-cert-file",
+		"cluster-signing-key-file",
+		"kubeconfig",
+		"leader-elect",
+		"master",
+		"root-ca-file",
+		"service-account-private-key-file",
+	},
+	Scheduler: {
+		"kubeconfig",
+		"leader-elect",
+		"master",
+	},
+}
+
+// flagVersions is a range of minor kube versions a flag is available in. A
+// zero value means no bound.
+type flagVersions struct {
+	added   int
+	removed int
+}
+
+// versionedFlags are flags, which are only available in some of the 1.x
+// kube versions. Flags not listed here are not checked against kube version.
+var versionedFlags = map[string]map[string]flagVersions{
+	Kubelet: {
+		"api-servers":         {removed: 8},
+		"rotate-certificates": {added: 7},
+	},
+	APIServer: {
+		"audit-policy-file":                       {added: 7},
+		"audit-webhook-config-file":               {added: 7},
+		"experimental-encryption-provider-config": {added: 7},
+		"endpoint-reconciler-type":                {added: 9},
+	},
+	Scheduler: {
+		"policy-configmap": {added: 7},
+	},
+}
+
+// Parse parses a list of flags in key=value format. Keys may have leading
+// dashes, flags without a value are set to "true".
+func Parse(kvs []string) (model.ExtraArgs, error) {
+	args := model.ExtraArgs{}
+	for _, kv := range kvs {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		s := strings.SplitN(strings.TrimLeft(kv, "-"), "=", 2)
+		k, v := s[0], "true"
+		if len(s) == 2 {
+			v = s[1]
+		}
+		if k == "" {
+			return args, fmt.Errorf("invalid flag %q, must be in key=value format", kv)
+		}
+		if strings.ContainsAny(k, " \t\"'") || strings.ContainsAny(v, " \t\"'") {
+			return args, fmt.Errorf("invalid flag %q, whitespace and quotes are not allowed", kv)
+		}
+		if _, ok := args[k]; ok {
+			return args, fmt.Errorf("flag %q is set more than once", k)
+		}
+		args[k] = v
+	}
+	return args, nil
+}
+
+// Render returns flags in a command line format, sorted by flag name.
+func Render(args model.ExtraArgs) string {
+	keys := []string{}
+	for k := range args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	flags := []string{}
+	for _, k := range keys {
+		flags = append(flags, fmt.Sprintf("--%s=%s", k, args[k]))
+	}
+	return strings.Join(flags, " ")
+}
+
+// ParseFlags parses flags rendered by Render.
+func ParseFlags(s string) model.ExtraArgs {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	args, _ := Parse(strings.Fields(s))
+	return args
+}
+
+// ToKubeArgs renders extra flags of all components.
+func ToKubeArgs(a model.ComponentExtraArgs) model.KubeArgs {
+	return model.KubeArgs{
+		KubeletExtraArgs:           Render(a.Kubelet),
+		APIServerExtraArgs:         Render(a.APIServer),
+		ControllerManagerExtraArgs: Render(a.ControllerManager),
+		SchedulerExtraArgs:         Render(a.Scheduler),
+	}
+}
+
+// FromKubeArgs parses extra flags of all components rendered by ToKubeArgs.
+func FromKubeArgs(a model.KubeArgs) model.ComponentExtraArgs {
+	return model.ComponentExtraArgs{
+		Kubelet:           ParseFlags(a.KubeletExtraArgs),
+		APIServer:         ParseFlags(a.APIServerExtraArgs),
+		ControllerManager: ParseFlags(a.ControllerManagerExtraArgs),
+		Scheduler:         ParseFlags(a.SchedulerExtraArgs),
+	}
+}
+
+// Validate checks that extra flags do not override flags managed by keto and
+// that they are available in a given kube version.
+func Validate(a model.ComponentExtraArgs, kubeVersion string) error {
+	if len(a.Kubelet)+len(a.APIServer)+len(a.ControllerManager)+len(a.Scheduler) == 0 {
+		return nil
+	}
+	minor, err := parseMinorVersion(kubeVersion)
+	if err != nil {
+		return err
+	}
+	if err := validateComponent(Kubelet, a.Kubelet, minor); err != nil {
+		return err
+	}
+	if err := validateComponent(APIServer, a.APIServer, minor); err != nil {
+		return err
+	}
+	if err := validateComponent(ControllerManager, a.ControllerManager, minor); err != nil {
+		return err
+	}
+	return validateComponent(Scheduler, a.Scheduler, minor)
+}
+
+func validateComponent(component string, args model.ExtraArgs, minor int) error {
+	keys := []string{}
+	for k := range args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		for _, m := range managedFlags[component] {
+			if k == m {
+				return fmt.Errorf("%s flag %q is managed by keto and cannot be overridden", component, k)
+			}
+		}
+		v, ok := versionedFlags[component][k]
+		if !ok {
+			continue
+		}
+		if v.added != 0 && minor < v.added {
+			return fmt.Errorf("%s flag %q is not available before v1.%d", component, k, v.added)
+		}
+		if v.removed != 0 && minor >= v.removed {
+			return fmt.Errorf("%s flag %q was removed in v1.%d", component, k, v.removed)
+		}
+	}
+	return nil
+}
+
+// parseMinorVersion returns a minor version of a v1.x kube version.
+func parseMinorVersion(v string) (int, error) {
+	s := strings.Split(strings.TrimPrefix(v, "v"), ".")
+	if len(s) < 2 || s[0] != "1" {
+		return 0, fmt.Errorf("unsupported kube version %q", v)
+	}
+	minor, err := strconv.Atoi(s[1])
+	if err != nil {
+		return 0, fmt.Errorf("unsupported kube version %q", v)
+	}
+	return minor, nil
+}
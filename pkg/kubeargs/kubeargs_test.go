@@ -0,0 +1,115 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kubeargs
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/UKHomeOffice/keto/pkg/model"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		kvs     []string
+		want    model.ExtraArgs
+		wantErr bool
+	}{
+		{
+			kvs:  []string{"v=2", "--admission-control=NamespaceLifecycle,LimitRanger", "--profiling", ""},
+			want: model.ExtraArgs{"v": "2", "admission-control": "NamespaceLifecycle,LimitRanger", "profiling": "true"},
+		},
+		{kvs: []string{"=2"}, wantErr: true},
+		{kvs: []string{"v=2", "v=3"}, wantErr: true},
+		{kvs: []string{"feature-gates=a b"}, wantErr: true},
+		{kvs: []string{`v="2"`}, wantErr: true},
+	}
+
+	for i, tt := range tests {
+		got, err := Parse(tt.kvs)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("test %d: got error %v; want error %t", i, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("test %d: got %v; want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	args := model.ExtraArgs{"v": "2", "admission-control": "NamespaceLifecycle,LimitRanger"}
+	s := Render(args)
+	if want := "--admission-control=NamespaceLifecycle,LimitRanger --v=2"; s != want {
+		t.Errorf("got %q; want %q", s, want)
+	}
+	if got := ParseFlags(s); !reflect.DeepEqual(got, args) {
+		t.Errorf("got %v; want %v", got, args)
+	}
+	if s := Render(nil); s != "" {
+		t.Errorf("got %q; want an empty string", s)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		args        model.ComponentExtraArgs
+		kubeVersion string
+		wantErr     bool
+	}{
+		{
+			args:        model.ComponentExtraArgs{APIServer: model.ExtraArgs{"v": "2", "audit-policy-file": "/etc/audit.yaml"}},
+			kubeVersion: "v1.7.0",
+		},
+		{
+			args:        model.ComponentExtraArgs{APIServer: model.ExtraArgs{"etcd-servers": "https://10.0.0.1:2379"}},
+			kubeVersion: "v1.7.0",
+			wantErr:     true,
+		},
+		{
+			args:        model.ComponentExtraArgs{Kubelet: model.ExtraArgs{"cloud-provider": "gce"}},
+			kubeVersion: "v1.7.0",
+			wantErr:     true,
+		},
+		{
+			args:        model.ComponentExtraArgs{APIServer: model.ExtraArgs{"audit-policy-file": "/etc/audit.yaml"}},
+			kubeVersion: "v1.6.4",
+			wantErr:     true,
+		},
+		{
+			args:        model.ComponentExtraArgs{Kubelet: model.ExtraArgs{"api-servers": "https://10.0.0.1"}},
+			kubeVersion: "v1.8.0",
+			wantErr:     true,
+		},
+		{
+			args:        model.ComponentExtraArgs{},
+			kubeVersion: "latest",
+		},
+		{
+			args:        model.ComponentExtraArgs{Scheduler: model.ExtraArgs{"v": "2"}},
+			kubeVersion: "latest",
+			wantErr:     true,
+		},
+	}
+
+	for i, tt := range tests {
+		err := Validate(tt.args, tt.kubeVersion)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("test %d: got error %v; want error %t", i, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package manifest parses multi-document YAML manifests of keto resources.
+// A manifest may define clusters and node pools that reference them by name:
+//
+//	kind: cluster
+//	name: foo
+//	spec:
+//	  dns_zone: example.com
+//	---
+//	kind: masterpool
+//	name: master
+//	cluster: foo
+//	spec:
+//	  machine_type: m4.large
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/UKHomeOffice/keto/pkg/model"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Resource kinds of manifest documents.
+const (
+	KindCluster     = "cluster"
+	KindMasterPool  = "masterpool"
+	KindComputePool = "computepool"
+)
+
+// Manifest is a set of resources defined in a manifest, in the order they
+// were defined.
+type Manifest struct {
+	Clusters     []model.Cluster
+	MasterPools  []model.MasterPool
+	ComputePools []model.ComputePool
+}
+
+// document is a single manifest document.
+type document struct {
+	Kind    string          `json:"kind"`
+	Name    string          `json:"name"`
+	Cluster string          `json:"cluster,omitempty"`
+	Labels  model.Labels    `json:"labels,omitempty"`
+	Spec    json.RawMessage `json:"spec,omitempty"`
+}
+
+// clusterSpec is a spec of a cluster document.
+type clusterSpec struct {
+	DNSZone     string          `json:"dns_zone,omitempty"`
+	Internal    bool            `json:"internal,omitempty"`
+	DriftPolicy string          `json:"drift_policy,omitempty"`
+	DNS         model.DNSConfig `json:"dns,omitempty"`
+}
+
+// Parse parses a multi-document YAML manifest. Every node pool must
+// reference a cluster by name, which is either defined in the same manifest
+// or is expected to exist already.
+func Parse(r io.Reader) (Manifest, error) {
+	m := Manifest{}
+
+	docs, err := splitDocuments(r)
+	if err != nil {
+		return m, err
+	}
+
+	seen := make(map[string]bool)
+	for i, d := range docs {
+		var doc document
+		if err := unmarshalYAML(d, &doc); err != nil {
+			return m, fmt.Errorf("document %d: %v", i+1, err)
+		}
+		doc.Kind = strings.ToLower(doc.Kind)
+		if doc.Name == "" {
+			return m, fmt.Errorf("document %d: name is not set", i+1)
+		}
+
+		key := doc.Kind + "/" + doc.Cluster + "/" + doc.Name
+		if doc.Kind == KindMasterPool {
+			// There is only a single master pool per cluster.
+			key = doc.Kind + "/" + doc.Cluster
+		}
+		if seen[key] {
+			return m, fmt.Errorf("document %d: %s %q is defined more than once", i+1, doc.Kind, doc.Name)
+		}
+		seen[key] = true
+
+		switch doc.Kind {
+		case KindCluster:
+			c, err := doc.cluster()
+			if err != nil {
+				return m, fmt.Errorf("document %d: %v", i+1, err)
+			}
+			m.Clusters = append(m.Clusters, c)
+		case KindMasterPool:
+			p, err := doc.nodePool()
+			if err != nil {
+				return m, fmt.Errorf("document %d: %v", i+1, err)
+			}
+			m.MasterPools = append(m.MasterPools, model.MasterPool{NodePool: p})
+		case KindComputePool:
+			p, err := doc.nodePool()
+			if err != nil {
+				return m, fmt.Errorf("document %d: %v", i+1, err)
+			}
+			m.ComputePools = append(m.ComputePools, model.ComputePool{NodePool: p})
+		default:
+			return m, fmt.Errorf("document %d: unknown kind %q, must be one of %s, %s, %s",
+				i+1, doc.Kind, KindCluster, KindMasterPool, KindComputePool)
+		}
+	}
+	return m, nil
+}
+
+func (d document) cluster() (model.Cluster, error) {
+	c := model.Cluster{}
+	if d.Cluster != "" {
+		return c, fmt.Errorf("cluster %q cannot reference another cluster", d.Name)
+	}
+	spec := clusterSpec{}
+	if len(d.Spec) > 0 {
+		if err := json.Unmarshal(d.Spec, &spec); err != nil {
+			return c, fmt.Errorf("invalid cluster %q spec: %v", d.Name, err)
+		}
+	}
+
+	c.Name = d.Name
+	c.Labels = d.Labels
+	c.DNSZone = spec.DNSZone
+	c.Internal = spec.Internal
+	c.DriftPolicy = spec.DriftPolicy
+	c.DNS = spec.DNS
+	return c, nil
+}
+
+func (d document) nodePool() (model.NodePool, error) {
+	p := model.NodePool{}
+	if d.Cluster == "" {
+		return p, fmt.Errorf("%s %q does not reference a cluster", d.Kind, d.Name)
+	}
+	if len(d.Spec) > 0 {
+		if err := json.Unmarshal(d.Spec, &p.NodePoolSpec); err != nil {
+			return p, fmt.Errorf("invalid %s %q spec: %v", d.Kind, d.Name, err)
+		}
+	}
+	if len(p.UserData) > 0 {
+		return p, fmt.Errorf("%s %q user data is rendered by keto and cannot be set", d.Kind, d.Name)
+	}
+
+	p.Name = d.Name
+	p.ClusterName = d.Cluster
+	p.Labels = d.Labels
+	return p, nil
+}
+
+// splitDocuments splits a YAML stream into documents. Empty documents are
+// skipped.
+func splitDocuments(r io.Reader) ([][]byte, error) {
+	docs := [][]byte{}
+	var doc bytes.Buffer
+	flush := func() {
+		if len(bytes.TrimSpace(doc.Bytes())) > 0 {
+			docs = append(docs, append([]byte{}, doc.Bytes()...))
+		}
+		doc.Reset()
+	}
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if strings.TrimRight(line, " \t") == "---" {
+			flush()
+			continue
+		}
+		doc.WriteString(line)
+		doc.WriteByte('\n')
+	}
+	if err := s.Err(); err != nil {
+		return docs, err
+	}
+	flush()
+	return docs, nil
+}
+
+// unmarshalYAML decodes YAML into v by the means of its JSON struct tags, so
+// that model types can be reused.
+func unmarshalYAML(b []byte, v interface{}) error {
+	var y interface{}
+	if err := yaml.Unmarshal(b, &y); err != nil {
+		return err
+	}
+	b, err := json.Marshal(toJSONValue(y))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// toJSONValue converts YAML maps, which may have non-string keys, to JSON
+// objects.
+func toJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = toJSONValue(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = toJSONValue(e)
+		}
+		return l
+	}
+	return v
+}
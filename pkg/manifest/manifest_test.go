@@ -0,0 +1,112 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manifest
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/UKHomeOffice/keto/pkg/model"
+)
+
+func TestParse(t *testing.T) {
+	const m = `
+kind: cluster
+name: foo
+labels:
+  team: platform
+spec:
+  dns_zone: example.com
+  internal: true
+  dns:
+    upstream_nameservers: [10.0.0.2]
+---
+kind: masterpool
+name: master
+cluster: foo
+spec:
+  machine_type: m4.large
+  networks: [subnet-1, subnet-2]
+  extra_args:
+    apiserver:
+      v: "2"
+---
+# Compute pools may reference clusters defined elsewhere.
+kind: computepool
+name: compute
+cluster: bar
+labels:
+  role: worker
+spec:
+  size: 3
+  disk_size: 50
+---
+`
+	got, err := Parse(strings.NewReader(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Manifest{
+		Clusters: []model.Cluster{{
+			ResourceMeta: model.ResourceMeta{Name: "foo", Labels: model.Labels{"team": "platform"}, Internal: true},
+			DNSZone:      "example.com",
+			DNS:          model.DNSConfig{UpstreamNameservers: []string{"10.0.0.2"}},
+		}},
+		MasterPools: []model.MasterPool{{NodePool: model.NodePool{
+			ResourceMeta: model.ResourceMeta{Name: "master", ClusterName: "foo"},
+			NodePoolSpec: model.NodePoolSpec{
+				MachineType: "m4.large",
+				Networks:    []string{"subnet-1", "subnet-2"},
+				ExtraArgs:   model.ComponentExtraArgs{APIServer: model.ExtraArgs{"v": "2"}},
+			},
+		}}},
+		ComputePools: []model.ComputePool{{NodePool: model.NodePool{
+			ResourceMeta: model.ResourceMeta{Name: "compute", ClusterName: "bar", Labels: model.Labels{"role": "worker"}},
+			NodePoolSpec: model.NodePoolSpec{Size: 3, DiskSize: 50},
+		}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		// Unknown kind.
+		"kind: database\nname: foo\n",
+		// Name is not set.
+		"kind: cluster\n",
+		// Node pool without a cluster.
+		"kind: computepool\nname: compute\n",
+		// Cluster referencing a cluster.
+		"kind: cluster\nname: foo\ncluster: bar\n",
+		// More than one master pool in a cluster.
+		"kind: masterpool\nname: a\ncluster: foo\n---\nkind: masterpool\nname: b\ncluster: foo\n",
+		// User data is set.
+		"kind: computepool\nname: compute\ncluster: foo\nspec:\n  user_data: Zm9v\n",
+		// Invalid spec.
+		"kind: computepool\nname: compute\ncluster: foo\nspec:\n  size: three\n",
+	}
+
+	for i, m := range tests {
+		if _, err := Parse(strings.NewReader(m)); err == nil {
+			t.Errorf("test %d: expected an error", i)
+		}
+	}
+}
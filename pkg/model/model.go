@@ -31,14 +31,48 @@ type Cluster struct {
 	ComputePools []ComputePool
 	DNSZone      string
 	KubeAPIURL   string
+	// DriftPolicy defines what happens when out-of-band changes to cluster
+	// resources are detected, see constants.DriftPolicy*.
+	DriftPolicy string
+	DNS         DNSConfig
 	Status
 }
 
+// DNSConfig is a configuration of the cluster DNS addon.
+type DNSConfig struct {
+	// Provider is the DNS addon running in the cluster, see
+	// constants.DNSProvider*. It determines the configuration format.
+	Provider string `json:"provider,omitempty"`
+	// UpstreamNameservers resolve names outside of the cluster domain instead
+	// of nameservers from node resolv.conf.
+	UpstreamNameservers []string `json:"upstream_nameservers,omitempty"`
+	// StubDomains maps DNS domains to nameservers that resolve them.
+	StubDomains map[string][]string `json:"stub_domains,omitempty"`
+	// Autoscaling scales DNS replicas with the cluster size if set.
+	Autoscaling *DNSAutoscaling `json:"autoscaling,omitempty"`
+}
+
+// DNSAutoscaling represents linear DNS replicas autoscaling parameters. The
+// number of replicas is the greater of cluster cores / CoresPerReplica and
+// cluster nodes / NodesPerReplica, within MinReplicas and MaxReplicas.
+type DNSAutoscaling struct {
+	MinReplicas     int `json:"min_replicas,omitempty"`
+	MaxReplicas     int `json:"max_replicas,omitempty"`
+	CoresPerReplica int `json:"cores_per_replica,omitempty"`
+	NodesPerReplica int `json:"nodes_per_replica,omitempty"`
+}
+
+// IsZero returns true if no DNS addon options are set.
+func (d DNSConfig) IsZero() bool {
+	return len(d.UpstreamNameservers) == 0 && len(d.StubDomains) == 0 && d.Autoscaling == nil
+}
+
 // Labels a map of labels
 type Labels map[string]string
 type Taints map[string]string
 
-// KubeArgs represents the optional extra flags for Kubernetes components
+// KubeArgs represents the optional extra flags for Kubernetes components, as
+// passed to nodes, rendered from ExtraArgs in a command line format.
 type KubeArgs struct {
 	KubeletExtraArgs           string
 	APIServerExtraArgs         string
@@ -46,6 +80,19 @@ type KubeArgs struct {
 	SchedulerExtraArgs         string
 }
 
+// ExtraArgs is a set of extra flags for a Kubernetes component, keyed by flag
+// name without leading dashes.
+type ExtraArgs map[string]string
+
+// ComponentExtraArgs represents extra flags for Kubernetes components.
+// Kubelet flags apply to all node pools, the rest only to master pools.
+type ComponentExtraArgs struct {
+	Kubelet           ExtraArgs `json:"kubelet,omitempty"`
+	APIServer         ExtraArgs `json:"apiserver,omitempty"`
+	ControllerManager ExtraArgs `json:"controller_manager,omitempty"`
+	Scheduler         ExtraArgs `json:"scheduler,omitempty"`
+}
+
 // MasterPool is a representation of a master control plane node pool.
 type MasterPool struct {
 	NodePool
@@ -73,6 +120,13 @@ type NodePoolSpec struct {
 	Size          int      `json:"size,omitempty"`
 	Networks      []string `json:"networks,omitempty"`
 	UserData      []byte   `json:"user_data,omitempty"`
+	// VolumeType is a cloud specific node boot disk type.
+	VolumeType string `json:"volume_type,omitempty"`
+	// SpotPrice is a maximum hourly price to bid for spot instances. Nodes
+	// run on on-demand instances if it is not set.
+	SpotPrice string `json:"spot_price,omitempty"`
+
+	ExtraArgs ComponentExtraArgs `json:"extra_args,omitempty"`
 }
 
 // ResourceMeta is a resource metadata.
@@ -91,6 +145,23 @@ type Status struct {
 	State    string `json:"state,omitempty"`
 }
 
+// Resource is a reference to a single cloud provider resource.
+type Resource struct {
+	Type string `json:"type,omitempty"`
+	ID   string `json:"id,omitempty"`
+}
+
+// Event is a cloud provider native activity record, e.g. a stack event or a
+// scaling activity, related to a cluster.
+type Event struct {
+	Time         int64  `json:"time,omitempty"`
+	Source       string `json:"source,omitempty"`
+	ResourceType string `json:"resource_type,omitempty"`
+	ResourceID   string `json:"resource_id,omitempty"`
+	Status       string `json:"status,omitempty"`
+	Message      string `json:"message,omitempty"`
+}
+
 // NodeData contains cloud Node related data.
 type NodeData struct {
 	KubeAPIURL  string
@@ -0,0 +1,374 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package userdata
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/UKHomeOffice/keto/pkg/constants"
+	"github.com/UKHomeOffice/keto/pkg/model"
+)
+
+// addonsDir is where addon manifests are written to on masters. Manifests in
+// the addons directory are applied by the addon manager, which masters run
+// once there are addons, and reconciled back if changed in the cluster.
+const addonsDir = "/etc/kubernetes/addons"
+
+// dnsAddonsManifestPath is where DNS addon manifests are written to on
+// masters.
+const dnsAddonsManifestPath = addonsDir + "/dns.yaml"
+
+// renderDNSAddons renders DNS addon manifests of a given DNS config. CoreDNS
+// is deployed in full, as masters only run kube-dns otherwise. For kube-dns an
+// empty string is returned if the config has no options set, in which case the
+// addon defaults are left alone.
+func renderDNSAddons(dns model.DNSConfig) (string, error) {
+	const dnsTemplate = `{{- if eq .Provider "coredns" }}
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: coredns
+  namespace: kube-system
+  labels:
+    addonmanager.kubernetes.io/mode: Reconcile
+---
+apiVersion: rbac.authorization.k8s.io/v1beta1
+kind: ClusterRole
+metadata:
+  name: system:coredns
+  labels:
+    addonmanager.kubernetes.io/mode: Reconcile
+rules:
+- apiGroups: [""]
+  resources: ["endpoints", "services", "pods", "namespaces"]
+  verbs: ["list", "watch"]
+---
+apiVersion: rbac.authorization.k8s.io/v1beta1
+kind: ClusterRoleBinding
+metadata:
+  name: system:coredns
+  labels:
+    addonmanager.kubernetes.io/mode: Reconcile
+subjects:
+- kind: ServiceAccount
+  name: coredns
+  namespace: kube-system
+roleRef:
+  kind: ClusterRole
+  name: system:coredns
+  apiGroup: rbac.authorization.k8s.io
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: coredns
+  namespace: kube-system
+  labels:
+    addonmanager.kubernetes.io/mode: Reconcile
+data:
+  Corefile: |
+    .:53 {
+        errors
+        health
+        kubernetes cluster.local in-addr.arpa ip6.arpa {
+            pods insecure
+            upstream
+            fallthrough in-addr.arpa ip6.arpa
+        }
+        prometheus :9153
+        proxy . {{ if .UpstreamNameservers }}{{ join .UpstreamNameservers " " }}{{ else }}/etc/resolv.conf{{ end }}
+        cache 30
+    }
+{{- range .StubDomains }}
+    {{ .Domain }}:53 {
+        errors
+        cache 30
+        proxy . {{ join .Nameservers " " }}
+    }
+{{- end }}
+---
+# CoreDNS pods are labelled as kube-dns ones, so that they serve the cluster
+# DNS service that keto-k8 creates.
+apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: coredns
+  namespace: kube-system
+  labels:
+    k8s-app: coredns
+    addonmanager.kubernetes.io/mode: Reconcile
+spec:
+  selector:
+    matchLabels:
+      k8s-app: kube-dns
+      dns-provider: coredns
+  template:
+    metadata:
+      labels:
+        k8s-app: kube-dns
+        dns-provider: coredns
+    spec:
+      serviceAccountName: coredns
+      tolerations:
+      - key: CriticalAddonsOnly
+        operator: Exists
+      - key: node-role.kubernetes.io/master
+        effect: NoSchedule
+      containers:
+      - name: coredns
+        image: {{ .CoreDNSImage }}
+        args: ["-conf", "/etc/coredns/Corefile"]
+        volumeMounts:
+        - name: config-volume
+          mountPath: /etc/coredns
+        ports:
+        - containerPort: 53
+          name: dns
+          protocol: UDP
+        - containerPort: 53
+          name: dns-tcp
+          protocol: TCP
+        - containerPort: 9153
+          name: metrics
+          protocol: TCP
+        livenessProbe:
+          httpGet:
+            path: /health
+            port: 8080
+          initialDelaySeconds: 60
+          timeoutSeconds: 5
+          failureThreshold: 5
+        resources:
+          limits:
+            memory: 170Mi
+          requests:
+            cpu: 100m
+            memory: 70Mi
+      dnsPolicy: Default
+      volumes:
+      - name: config-volume
+        configMap:
+          name: coredns
+          items:
+          - key: Corefile
+            path: Corefile
+{{- else if .Resolvers }}
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: kube-dns
+  namespace: kube-system
+  labels:
+    addonmanager.kubernetes.io/mode: Reconcile
+data:
+{{- with .UpstreamNameserversJSON }}
+  upstreamNameservers: |
+    {{ . }}
+{{- end }}
+{{- with .StubDomainsJSON }}
+  stubDomains: |
+    {{ . }}
+{{- end }}
+{{- end }}
+{{- with .Autoscaling }}
+---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: dns-autoscaler
+  namespace: kube-system
+  labels:
+    addonmanager.kubernetes.io/mode: Reconcile
+---
+apiVersion: rbac.authorization.k8s.io/v1beta1
+kind: ClusterRole
+metadata:
+  name: system:dns-autoscaler
+  labels:
+    addonmanager.kubernetes.io/mode: Reconcile
+rules:
+- apiGroups: [""]
+  resources: ["nodes"]
+  verbs: ["list"]
+- apiGroups: [""]
+  resources: ["replicationcontrollers/scale"]
+  verbs: ["get", "update"]
+- apiGroups: ["extensions"]
+  resources: ["deployments/scale", "replicasets/scale"]
+  verbs: ["get", "update"]
+- apiGroups: [""]
+  resources: ["configmaps"]
+  verbs: ["get", "create"]
+---
+apiVersion: rbac.authorization.k8s.io/v1beta1
+kind: ClusterRoleBinding
+metadata:
+  name: system:dns-autoscaler
+  labels:
+    addonmanager.kubernetes.io/mode: Reconcile
+subjects:
+- kind: ServiceAccount
+  name: dns-autoscaler
+  namespace: kube-system
+roleRef:
+  kind: ClusterRole
+  name: system:dns-autoscaler
+  apiGroup: rbac.authorization.k8s.io
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: dns-autoscaler
+  namespace: kube-system
+  labels:
+    addonmanager.kubernetes.io/mode: Reconcile
+data:
+  linear: |
+    {{ .Params }}
+---
+apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: dns-autoscaler
+  namespace: kube-system
+  labels:
+    k8s-app: dns-autoscaler
+    addonmanager.kubernetes.io/mode: Reconcile
+spec:
+  template:
+    metadata:
+      labels:
+        k8s-app: dns-autoscaler
+    spec:
+      serviceAccountName: dns-autoscaler
+      containers:
+      - name: autoscaler
+        image: {{ .Image }}
+        resources:
+          requests:
+            cpu: 20m
+            memory: 10Mi
+        command:
+        - /cluster-proportional-autoscaler
+        - --namespace=kube-system
+        - --configmap=dns-autoscaler
+        - --target=Deployment/{{ .Target }}
+        - --logtostderr=true
+        - --v=2
+{{- end }}
+`
+
+	provider := dns.Provider
+	if provider == "" {
+		provider = constants.DefaultDNSProvider
+	}
+	if provider != constants.DNSProviderCoreDNS && dns.IsZero() {
+		return "", nil
+	}
+
+	type stubDomain struct {
+		Domain      string
+		Nameservers []string
+	}
+	type autoscaling struct {
+		Params string
+		Image  string
+		Target string
+	}
+	data := struct {
+		Provider                string
+		CoreDNSImage            string
+		Resolvers               bool
+		UpstreamNameservers     []string
+		UpstreamNameserversJSON string
+		StubDomains             []stubDomain
+		StubDomainsJSON         string
+		Autoscaling             *autoscaling
+	}{
+		Provider:            provider,
+		CoreDNSImage:        constants.DefaultCoreDNSImage,
+		Resolvers:           len(dns.UpstreamNameservers)+len(dns.StubDomains) > 0,
+		UpstreamNameservers: dns.UpstreamNameservers,
+	}
+
+	if len(dns.UpstreamNameservers) > 0 {
+		b, err := json.Marshal(dns.UpstreamNameservers)
+		if err != nil {
+			return "", err
+		}
+		data.UpstreamNameserversJSON = string(b)
+	}
+	if len(dns.StubDomains) > 0 {
+		// Map keys are sorted when encoded to JSON.
+		b, err := json.Marshal(dns.StubDomains)
+		if err != nil {
+			return "", err
+		}
+		data.StubDomainsJSON = string(b)
+
+		domains := []string{}
+		for d := range dns.StubDomains {
+			domains = append(domains, d)
+		}
+		sort.Strings(domains)
+		for _, d := range domains {
+			data.StubDomains = append(data.StubDomains, stubDomain{Domain: d, Nameservers: dns.StubDomains[d]})
+		}
+	}
+	if a := dns.Autoscaling; a != nil {
+		params := struct {
+			CoresPerReplica           int  `json:"coresPerReplica,omitempty"`
+			NodesPerReplica           int  `json:"nodesPerReplica,omitempty"`
+			Min                       int  `json:"min,omitempty"`
+			Max                       int  `json:"max,omitempty"`
+			PreventSinglePointFailure bool `json:"preventSinglePointFailure"`
+		}{
+			CoresPerReplica:           a.CoresPerReplica,
+			NodesPerReplica:           a.NodesPerReplica,
+			Min:                       a.MinReplicas,
+			Max:                       a.MaxReplicas,
+			PreventSinglePointFailure: true,
+		}
+		b, err := json.Marshal(params)
+		if err != nil {
+			return "", err
+		}
+		data.Autoscaling = &autoscaling{
+			Params: string(b),
+			Image:  constants.DefaultDNSAutoscalerImage,
+			Target: provider,
+		}
+	}
+
+	funcs := template.FuncMap{"join": strings.Join}
+	t := template.Must(template.New("dns-addons").Funcs(funcs).Parse(dnsTemplate))
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(b.String(), "\n"), nil
+}
+
+// indent indents every line of s by n spaces.
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.Replace(strings.TrimRight(s, "\n"), "\n", "\n"+pad, -1)
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package userdata
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// MasterEnvPath is where masters outside of AWS get their node ID and IP
+// from, as NODE_ID, NODE_IP and NODE_LISTEN_IP environment variables. Cloud
+// providers add it to the user data of each master with MasterEnvFile.
+const MasterEnvPath = "/etc/keto/master.env"
+
+// writeFilesKey is the cloud-config key that files are added to.
+var writeFilesKey = []byte("\nwrite_files:\n")
+
+// File is a file written by cloud-config.
+type File struct {
+	Path    string
+	Content []byte
+	// Permissions default to 0600.
+	Permissions string
+}
+
+// AddWriteFiles adds files to the write_files section of a cloud-config.
+// Files are added as the first items of the section, so that it does not
+// matter where in the cloud-config the section is.
+func AddWriteFiles(userData []byte, files []File) ([]byte, error) {
+	i := bytes.Index(userData, writeFilesKey)
+	if i == -1 {
+		return userData, errors.New("cloud-config has no write_files section")
+	}
+	i += len(writeFilesKey)
+
+	var b bytes.Buffer
+	b.Write(userData[:i])
+	for _, f := range files {
+		perm := f.Permissions
+		if perm == "" {
+			perm = "0600"
+		}
+		fmt.Fprintf(&b, "- path: %s\n", f.Path)
+		fmt.Fprintf(&b, "  permissions: %q\n", perm)
+		b.WriteString("  owner: root\n")
+		b.WriteString("  encoding: b64\n")
+		fmt.Fprintf(&b, "  content: %s\n", base64.StdEncoding.EncodeToString(f.Content))
+	}
+	b.Write(userData[i:])
+	return b.Bytes(), nil
+}
+
+// MasterEnvFile returns a MasterEnvPath file of a master with a given node ID
+// and persistent IP, which etcd advertises and listens on.
+func MasterEnvFile(id, ip string) File {
+	return File{
+		Path:    MasterEnvPath,
+		Content: []byte(fmt.Sprintf("NODE_ID=%s\nNODE_IP=%s\nNODE_LISTEN_IP=%s\n", id, ip, ip)),
+	}
+}
@@ -18,15 +18,17 @@ package userdata
 
 import (
 	"bytes"
+	"fmt"
 	"os"
 	"text/template"
 
 	"github.com/UKHomeOffice/keto/pkg/constants"
+	"github.com/UKHomeOffice/keto/pkg/model"
 )
 
 // UserDater is an abstract interface for UserData, mainly for testing.
 type UserDater interface {
-	RenderMasterCloudConfig(string, string, string, map[string]string) ([]byte, error)
+	RenderMasterCloudConfig(string, string, string, map[string]string, model.DNSConfig) ([]byte, error)
 	RenderComputeCloudConfig(string, string, string) ([]byte, error)
 }
 
@@ -48,12 +50,68 @@ func New(logger logger) *UserData {
 	return &UserData{Logger: logger}
 }
 
+// masterBootstrap is how masters of a cloud get their node ID, IP and assets.
+type masterBootstrap struct {
+	// Smilodon attaches an ENI and an EBS volume tagged with the node ID,
+	// which provide the node ID and IP and are mounted at /data. Otherwise
+	// they come from MasterEnvPath and /data is on the boot disk.
+	Smilodon bool
+	// AnchorIP is set if the node IP is not bound to an interface, so that
+	// etcd listens on the droplet anchor IP instead.
+	AnchorIP bool
+}
+
+// nodeVolumes are docker volumes of all keto-k8 containers, keyed by cloud
+// provider name. They give keto-k8 the host paths that the cloud provider
+// reads node data and assets from.
+var nodeVolumes = map[string][]string{
+	"digitalocean": {"/etc/keto:/etc/keto:ro"},
+	"libvirt":      {"/media/configdrive:/media/configdrive:ro"},
+	// Node data and assets are read from guestinfo with vmware-rpctool of
+	// the host.
+	"vsphere": {"/usr:/host/usr:ro"},
+}
+
+// KetoK8ImageEnv is an environment variable that overrides the keto-k8 image
+// of nodes.
+const KetoK8ImageEnv = "KETO_K8_IMAGE_URI"
+
+// defaultKetoK8ImageProviders are the cloud providers that the default keto-k8
+// image supports. Nodes of other providers need KetoK8ImageEnv set to a newer
+// image.
+var defaultKetoK8ImageProviders = map[string]bool{
+	"aws": true,
+}
+
+// KetoK8Image returns the keto-k8 image of nodes of a given cloud provider.
+func KetoK8Image(cloudProviderName string) (string, error) {
+	if uri := os.Getenv(KetoK8ImageEnv); uri != "" {
+		return uri, nil
+	}
+	if !defaultKetoK8ImageProviders[cloudProviderName] {
+		return "", fmt.Errorf("keto-k8 image %s does not support the %s cloud provider, set %s to an image that does",
+			constants.DefaultKetoK8Image, cloudProviderName, KetoK8ImageEnv)
+	}
+	return constants.DefaultKetoK8Image, nil
+}
+
+// masterBootstraps are keyed by cloud provider name. These are the provider
+// package ProviderName constants, which cannot be imported here as providers
+// import this package.
+var masterBootstraps = map[string]masterBootstrap{
+	"aws":          {Smilodon: true},
+	"digitalocean": {AnchorIP: true},
+	"libvirt":      {},
+	"vsphere":      {},
+}
+
 // RenderMasterCloudConfig renders a master cloud-config.
 func (u UserData) RenderMasterCloudConfig(
 	cloudProviderName string,
 	clusterName string,
 	kubeVersion string,
 	masterPersistentNodeIDIP map[string]string,
+	dns model.DNSConfig,
 ) ([]byte, error) {
 
 	const masterTemplate = `#cloud-config
@@ -73,6 +131,7 @@ coreos:
   - name: update-engine.service
     command: stop
     enable: false
+{{- if .Smilodon }}
   - name: smilodon.service
     command: start
     enable: true
@@ -93,6 +152,18 @@ coreos:
       Restart=always
       RestartSec=10
       TimeoutStartSec=300
+{{- end }}
+{{- if .AnchorIP }}
+  - name: anchor-ip.service
+    content: |
+      [Unit]
+      Description=Save the anchor IP that the floating IP is routed to
+      [Service]
+      Type=oneshot
+      RemainAfterExit=true
+      ExecStartPre=/usr/bin/mkdir -p /run/keto
+      ExecStart=/usr/bin/bash -c 'until ip=$(curl -sf http://169.254.169.254/metadata/v1/interfaces/public/0/anchor_ipv4/address); do sleep 5; done; echo NODE_LISTEN_IP=$${ip} > /run/keto/anchor-ip.env'
+{{- end }}
   # This is a dirty workaround hack until this has been fixed: https://github.com/systemd/systemd/issues/1784
   - name: networkd-restart.service
     command: start
@@ -121,9 +192,23 @@ coreos:
     drop-ins:
     - name: 10-etcd-member.conf
       content: |
+{{- if .AnchorIP }}
+        [Unit]
+        Requires=anchor-ip.service
+        After=anchor-ip.service
+{{- end }}
         [Service]
         EnvironmentFile=/etc/etcd.env
+{{- if .Smilodon }}
         EnvironmentFile=/run/smilodon/environment
+{{- else }}
+        EnvironmentFile={{ .MasterEnvPath }}
+{{- end }}
+{{- if .AnchorIP }}
+        # Floating IPs are not bound to an interface, etcd listens on the
+        # anchor IP instead.
+        EnvironmentFile=/run/keto/anchor-ip.env
+{{- end }}
         Environment=ETCD_CLIENT_CERT_AUTH=true
         Environment=ETCD_INITIAL_CLUSTER_STATE=new
         Environment=ETCD_IMAGE_TAG=v3.1.5
@@ -131,18 +216,28 @@ coreos:
         Environment=ETCD_DATA_DIR=/data/etcd
 
         # Save the CA files from the cloudprovider
+{{- if .Smilodon }}
         ExecStartPre=/bin/grep ' /data ' /proc/mounts
         ExecStartPre=/usr/bin/docker run \
+{{- else }}
+        # /data is on the boot disk. Access to the assets is short lived, so
+        # they are only saved on first boot.
+        ExecStartPre=/usr/bin/mkdir -p /data/ca
+        ExecStartPre=/usr/bin/bash -c '[[ -f /data/ca/kube/ca.key ]] || exec /usr/bin/docker run \
+{{- end }}
           --rm \
           --net host \
           -v /data/ca:/data/ca \
+{{- range .NodeVolumes }}
+          -v {{ . }} \
+{{- end }}
           -e ETCD_CA_FILE \
           {{ .KetoK8Image }} \
           save-assets \
           --cloud-provider={{ .CloudProviderName }} \
           --etcd-ca-key /data/ca/etcd/ca.key \
           --kube-ca-cert=/data/ca/kube/ca.crt \
-          --kube-ca-key=/data/ca/kube/ca.key
+          --kube-ca-key=/data/ca/kube/ca.key{{ if not .Smilodon }}'{{ end }}
 
         # Create the ETCD certs from the ETCD CA
         ExecStartPre=/bin/mkdir -p /run/etcd/certs
@@ -173,8 +268,8 @@ coreos:
         ExecStart=/usr/lib/coreos/etcd-wrapper \
           --advertise-client-urls=https://${NODE_IP}:2379 \
           --initial-advertise-peer-urls=https://${NODE_IP}:2380 \
-          --listen-client-urls=https://${NODE_IP}:2379,https://localhost:2379 \
-          --listen-peer-urls=https://${NODE_IP}:2380 \
+          --listen-client-urls=https://{{ .ListenIP }}:2379,https://localhost:2379 \
+          --listen-peer-urls=https://{{ .ListenIP }}:2380 \
           --name=Node${NODE_ID}
   - name: docker.service
     enable: true
@@ -208,6 +303,9 @@ coreos:
         -v /etc/kubernetes/:/etc/kubernetes/ \
         -v /var/run/dbus/:/var/run/dbus/ \
         -v /etc/systemd/system/:/etc/systemd/system/ \
+{{- range .NodeVolumes }}
+        -v {{ . }} \
+{{- end }}
         -e ETCD_INITIAL_CLUSTER \
         -e ETCD_ADVERTISE_CLIENT_URLS \
         -e ETCD_CA_FILE \
@@ -224,6 +322,48 @@ coreos:
       TimeoutStartSec=infinity
       RestartSec=20
       Restart=always
+{{- if .DNSAddons }}
+  - name: kube-addon-manager.service
+    command: start
+    enable: true
+    content: |
+      [Unit]
+      Description=Kubernetes Addon Manager
+      Documentation=https://github.com/kubernetes/kubernetes/tree/master/cluster/addons/addon-manager
+
+      [Service]
+      # The admin kubeconfig is written by keto-k8 once the master is set up.
+      ExecStartPre=/usr/bin/bash -c 'until [[ -f /etc/kubernetes/admin.conf ]]; do sleep 10; done'
+      ExecStartPre=-/usr/bin/docker rm -f kube-addon-manager
+      ExecStart=/usr/bin/docker run \
+        --rm \
+        --net host \
+        --name kube-addon-manager \
+        -v {{ .AddonsDir }}:{{ .AddonsDir }}:ro \
+        -v /etc/kubernetes/admin.conf:/etc/kubernetes/admin.conf:ro \
+        -e KUBECONFIG=/etc/kubernetes/admin.conf \
+        {{ .AddonManagerImage }}
+      TimeoutStartSec=infinity
+      RestartSec=20
+      Restart=always
+{{- end }}
+{{- if .ReplaceKubeDNS }}
+  - name: kube-dns-scale-down.service
+    command: start
+    enable: true
+    content: |
+      [Unit]
+      Description=Scale down kube-dns replaced by CoreDNS
+      Requires=kube-addon-manager.service
+      After=kube-addon-manager.service
+
+      [Service]
+      Type=oneshot
+      # keto-k8 deploys kube-dns, wait for it and scale it down with kubectl
+      # of the addon manager.
+      ExecStart=/usr/bin/bash -c 'until /usr/bin/docker exec kube-addon-manager kubectl -n kube-system scale deployment kube-dns --replicas=0; do sleep 10; done'
+      TimeoutStartSec=infinity
+{{- end }}
 
 write_files:
 - path: /etc/etcd.env
@@ -271,25 +411,66 @@ write_files:
   owner: root
   content: |
     vm.max_map_count=262144
+{{- with .DNSAddons }}
+- path: {{ $.DNSAddonsPath }}
+  permissions: 0644
+  owner: root
+  content: |
+{{ indent 4 . }}
+{{- end }}
 `
 
+	ketoK8Image, err := KetoK8Image(cloudProviderName)
+	if err != nil {
+		return nil, err
+	}
+	dnsAddons, err := renderDNSAddons(dns)
+	if err != nil {
+		return nil, err
+	}
+
+	bootstrap := masterBootstraps[cloudProviderName]
+	listenIP := "${NODE_LISTEN_IP}"
+	if bootstrap.Smilodon {
+		listenIP = "${NODE_IP}"
+	}
+
 	data := struct {
+		masterBootstrap
 		CloudProviderName        string
 		ClusterName              string
 		KubeVersion              string
 		KetoK8Image              string
 		MasterPersistentNodeIDIP map[string]string
 		NetworkProvider          string
+		AddonManagerImage        string
+		AddonsDir                string
+		DNSAddons                string
+		DNSAddonsPath            string
+		ReplaceKubeDNS           bool
+		MasterEnvPath            string
+		ListenIP                 string
+		NodeVolumes              []string
 	}{
+		masterBootstrap:          bootstrap,
 		CloudProviderName:        cloudProviderName,
 		ClusterName:              clusterName,
 		KubeVersion:              kubeVersion,
-		KetoK8Image:              constants.DefaultKetoK8Image,
+		KetoK8Image:              ketoK8Image,
 		MasterPersistentNodeIDIP: masterPersistentNodeIDIP,
 		NetworkProvider:          constants.DefaultNetworkProvider,
+		AddonManagerImage:        constants.DefaultAddonManagerImage,
+		AddonsDir:                addonsDir,
+		DNSAddons:                dnsAddons,
+		DNSAddonsPath:            dnsAddonsManifestPath,
+		ReplaceKubeDNS:           dns.Provider == constants.DNSProviderCoreDNS,
+		MasterEnvPath:            MasterEnvPath,
+		ListenIP:                 listenIP,
+		NodeVolumes:              nodeVolumes[cloudProviderName],
 	}
 
-	t := template.Must(template.New("master-cloud-config").Parse(masterTemplate))
+	funcs := template.FuncMap{"indent": indent}
+	t := template.Must(template.New("master-cloud-config").Funcs(funcs).Parse(masterTemplate))
 	var b bytes.Buffer
 	if err := t.Execute(&b, data); err != nil {
 		return b.Bytes(), err
@@ -335,6 +516,9 @@ coreos:
         -v /etc/kubernetes/:/etc/kubernetes/ \
         -v /var/run/dbus/:/var/run/dbus/ \
         -v /etc/systemd/system/:/etc/systemd/system/ \
+{{- range .NodeVolumes }}
+        -v {{ . }} \
+{{- end }}
         {{ .KetoK8Image }} \
         setup-compute \
         --cloud-provider={{ .CloudProviderName }}
@@ -392,10 +576,9 @@ write_files:
     vm.max_map_count=262144
 `
 
-	// TODO: remove this. This is only for testing until we find a better and safer way.
-	ketoK8ImageURI := constants.DefaultKetoK8Image
-	if uri := os.Getenv("KETO_K8_IMAGE_URI"); uri != "" {
-		ketoK8ImageURI = uri
+	ketoK8Image, err := KetoK8Image(cloudProviderName)
+	if err != nil {
+		return nil, err
 	}
 
 	data := struct {
@@ -403,11 +586,13 @@ write_files:
 		KubeVersion       string
 		CloudProviderName string
 		KetoK8Image       string
+		NodeVolumes       []string
 	}{
 		ClusterName:       clusterName,
 		KubeVersion:       kubeVersion,
 		CloudProviderName: cloudProviderName,
-		KetoK8Image:       ketoK8ImageURI,
+		KetoK8Image:       ketoK8Image,
+		NodeVolumes:       nodeVolumes[cloudProviderName],
 	}
 
 	t := template.Must(template.New("compute-cloud-config").Parse(computeTemplate))
@@ -21,20 +21,174 @@ package userdata
 import (
 	"log"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
 
+	"github.com/UKHomeOffice/keto/pkg/constants"
+	"github.com/UKHomeOffice/keto/pkg/model"
 	"github.com/UKHomeOffice/keto/testutil"
 )
 
-const clusterName = "foo"
+const (
+	clusterName     = "foo"
+	testKetoK8Image = "quay.io/ukhomeofficedigital/keto-k8:test"
+)
 
 func TestRenderMasterCloudConfig(t *testing.T) {
 	u := New(log.New(os.Stderr, "", log.LstdFlags))
-	s, err := u.RenderMasterCloudConfig("aws", clusterName, "v1.7.0", map[string]string{"0": "10.0.0.1"})
+	s, err := u.RenderMasterCloudConfig("aws", clusterName, "v1.7.0", map[string]string{"0": "10.0.0.1"}, model.DNSConfig{})
 	if err != nil {
 		t.Error(err)
 	}
 	testutil.CheckTemplate(t, string(s), clusterName)
+	if strings.Contains(string(s), dnsAddonsManifestPath) {
+		t.Errorf("DNS addons should not be rendered without DNS options")
+	}
+	if strings.Contains(string(s), "kube-addon-manager") {
+		t.Errorf("addon manager should not run without addons")
+	}
+}
+
+func TestRenderMasterCloudConfigDNS(t *testing.T) {
+	u := New(log.New(os.Stderr, "", log.LstdFlags))
+	dns := model.DNSConfig{
+		Provider:            "kube-dns",
+		UpstreamNameservers: []string{"8.8.8.8", "8.8.4.4"},
+		StubDomains:         map[string][]string{"b.local": {"10.0.0.3"}, "a.local": {"10.0.0.2"}},
+		Autoscaling:         &model.DNSAutoscaling{MinReplicas: 2, CoresPerReplica: 256},
+	}
+	s, err := u.RenderMasterCloudConfig("aws", clusterName, "v1.7.0", map[string]string{"0": "10.0.0.1"}, dns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckTemplate(t, string(s), "- path: "+dnsAddonsManifestPath)
+	// Addon manifests are only applied if the addon manager runs and sees
+	// them.
+	testutil.CheckTemplate(t, string(s), "  - name: kube-addon-manager.service\n    command: start\n    enable: true")
+	testutil.CheckTemplate(t, string(s), "-v "+filepath.Dir(dnsAddonsManifestPath)+":"+filepath.Dir(dnsAddonsManifestPath)+":ro")
+	testutil.CheckTemplate(t, string(s), `    data:
+      upstreamNameservers: |
+        ["8.8.8.8","8.8.4.4"]
+      stubDomains: |
+        {"a.local":["10.0.0.2"],"b.local":["10.0.0.3"]}
+`)
+	testutil.CheckTemplate(t, string(s), `{"coresPerReplica":256,"min":2,"preventSinglePointFailure":true}`)
+	testutil.CheckTemplate(t, string(s), "--target=Deployment/kube-dns")
+
+	dns.Autoscaling = nil
+	s, err = u.RenderMasterCloudConfig("aws", clusterName, "v1.7.0", map[string]string{"0": "10.0.0.1"}, dns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(s), "dns-autoscaler") {
+		t.Errorf("DNS autoscaler should not be rendered without autoscaling options")
+	}
+	if strings.Contains(string(s), "kube-dns-scale-down") {
+		t.Errorf("kube-dns should only be scaled down if CoreDNS replaces it")
+	}
+}
+
+func TestRenderMasterCloudConfigCoreDNS(t *testing.T) {
+	u := New(log.New(os.Stderr, "", log.LstdFlags))
+	dns := model.DNSConfig{Provider: "coredns"}
+	s, err := u.RenderMasterCloudConfig("aws", clusterName, "v1.7.0", map[string]string{"0": "10.0.0.1"}, dns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// CoreDNS is deployed even without DNS options and replaces kube-dns.
+	testutil.CheckTemplate(t, string(s), "- path: "+dnsAddonsManifestPath)
+	testutil.CheckTemplate(t, string(s), "image: "+constants.DefaultCoreDNSImage)
+	testutil.CheckTemplate(t, string(s), "proxy . /etc/resolv.conf")
+	testutil.CheckTemplate(t, string(s), "  - name: kube-dns-scale-down.service\n    command: start\n    enable: true")
+	testutil.CheckTemplate(t, string(s), "kubectl -n kube-system scale deployment kube-dns --replicas=0")
+
+	dns.UpstreamNameservers = []string{"8.8.8.8", "8.8.4.4"}
+	dns.StubDomains = map[string][]string{"b.local": {"10.0.0.3"}, "a.local": {"10.0.0.2"}}
+	dns.Autoscaling = &model.DNSAutoscaling{MinReplicas: 2}
+	s, err = u.RenderMasterCloudConfig("aws", clusterName, "v1.7.0", map[string]string{"0": "10.0.0.1"}, dns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckTemplate(t, string(s), "proxy . 8.8.8.8 8.8.4.4")
+	testutil.CheckTemplate(t, string(s), `        a.local:53 {
+            errors
+            cache 30
+            proxy . 10.0.0.2
+        }
+        b.local:53 {`)
+	testutil.CheckTemplate(t, string(s), "--target=Deployment/coredns")
+	if strings.Contains(string(s), "upstreamNameservers") {
+		t.Errorf("kube-dns config should not be rendered for CoreDNS")
+	}
+}
+
+func TestRenderMasterCloudConfigBootstrap(t *testing.T) {
+	u := New(log.New(os.Stderr, "", log.LstdFlags))
+	s, err := u.RenderMasterCloudConfig("aws", clusterName, "v1.7.0", map[string]string{"0": "10.0.0.1"}, model.DNSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckTemplate(t, string(s), "EnvironmentFile=/run/smilodon/environment")
+	testutil.CheckTemplate(t, string(s), "--listen-peer-urls=https://${NODE_IP}:2380")
+
+	defer os.Unsetenv(KetoK8ImageEnv)
+	os.Setenv(KetoK8ImageEnv, testKetoK8Image)
+	for _, provider := range []string{"vsphere", "digitalocean", "libvirt"} {
+		s, err := u.RenderMasterCloudConfig(provider, clusterName, "v1.7.0", map[string]string{"0": "10.0.0.1"}, model.DNSConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, aws := range []string{"smilodon", "' /data ' /proc/mounts"} {
+			if strings.Contains(string(s), aws) {
+				t.Errorf("%s master cloud-config should not use %q", provider, aws)
+			}
+		}
+		testutil.CheckTemplate(t, string(s), "EnvironmentFile="+MasterEnvPath)
+		testutil.CheckTemplate(t, string(s), "--listen-peer-urls=https://${NODE_LISTEN_IP}:2380")
+		testutil.CheckTemplate(t, string(s), "ExecStartPre=/usr/bin/bash -c '[[ -f /data/ca/kube/ca.key ]] || exec /usr/bin/docker run")
+		testutil.CheckTemplate(t, string(s), "--kube-ca-key=/data/ca/kube/ca.key'\n")
+	}
+
+	s, err = u.RenderMasterCloudConfig("digitalocean", clusterName, "v1.7.0", map[string]string{"0": "10.0.0.1"}, model.DNSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckTemplate(t, string(s), "Requires=anchor-ip.service")
+	testutil.CheckTemplate(t, string(s), "-v /etc/keto:/etc/keto:ro")
+}
+
+func TestAddWriteFiles(t *testing.T) {
+	userData := []byte("#cloud-config\ncoreos:\n  units: []\nwrite_files:\n- path: /etc/foo\n  content: foo\n")
+	files := []File{
+		{Path: "/etc/keto/node-data.json", Content: []byte("{}")},
+		{Path: "/etc/bar", Content: []byte("bar"), Permissions: "0644"},
+	}
+
+	got, err := AddWriteFiles(userData, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "#cloud-config\ncoreos:\n  units: []\nwrite_files:\n" +
+		"- path: /etc/keto/node-data.json\n" +
+		"  permissions: \"0600\"\n" +
+		"  owner: root\n" +
+		"  encoding: b64\n" +
+		"  content: e30=\n" +
+		"- path: /etc/bar\n" +
+		"  permissions: \"0644\"\n" +
+		"  owner: root\n" +
+		"  encoding: b64\n" +
+		"  content: YmFy\n" +
+		"- path: /etc/foo\n  content: foo\n"
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if _, err := AddWriteFiles([]byte("#cloud-config\n"), files); err == nil {
+		t.Error("expected an error for a cloud-config without write_files")
+	}
 }
 
 func TestRenderComputeCloudConfig(t *testing.T) {
@@ -45,3 +199,61 @@ func TestRenderComputeCloudConfig(t *testing.T) {
 	}
 	testutil.CheckTemplate(t, string(s), clusterName)
 }
+
+func TestRenderCloudConfigNodeVolumes(t *testing.T) {
+	defer os.Unsetenv(KetoK8ImageEnv)
+	os.Setenv(KetoK8ImageEnv, testKetoK8Image)
+
+	u := New(log.New(os.Stderr, "", log.LstdFlags))
+	tests := []struct {
+		provider string
+		volume   string
+	}{
+		{"digitalocean", "-v /etc/keto:/etc/keto:ro"},
+		{"libvirt", "-v /media/configdrive:/media/configdrive:ro"},
+		{"vsphere", "-v /usr:/host/usr:ro"},
+	}
+	for _, tc := range tests {
+		master, err := u.RenderMasterCloudConfig(tc.provider, clusterName, "v1.7.0", map[string]string{"0": "10.0.0.1"}, model.DNSConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		compute, err := u.RenderComputeCloudConfig(tc.provider, clusterName, "v1.7.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		runs := map[string]string{
+			"save-assets":   ketoK8Run(string(master), "save-assets"),
+			"master":        ketoK8Run(string(master), "master"),
+			"setup-compute": ketoK8Run(string(compute), "setup-compute"),
+		}
+		for cmd, run := range runs {
+			if !strings.Contains(run, tc.volume) {
+				t.Errorf("%s keto-k8 %s has no volume %q:\n%s", tc.provider, cmd, tc.volume, run)
+			}
+		}
+	}
+}
+
+// ketoK8Run returns the docker run command of a keto-k8 command in a
+// cloud-config, up to the keto-k8 command.
+func ketoK8Run(cloudConfig, cmd string) string {
+	image := regexp.QuoteMeta(testKetoK8Image)
+	re := regexp.MustCompile(`docker run \\\n(?:.*\\\n)*?\s*` + image + ` \\\n\s*` + cmd + ` \\`)
+	return re.FindString(cloudConfig)
+}
+
+func TestKetoK8Image(t *testing.T) {
+	if image, err := KetoK8Image("aws"); err != nil || image != constants.DefaultKetoK8Image {
+		t.Errorf("got aws image %q, error %v; want %q", image, err, constants.DefaultKetoK8Image)
+	}
+	if _, err := KetoK8Image("vsphere"); err == nil {
+		t.Error("expected an error, the default image does not support vsphere")
+	}
+
+	defer os.Unsetenv(KetoK8ImageEnv)
+	os.Setenv(KetoK8ImageEnv, testKetoK8Image)
+	if image, err := KetoK8Image("vsphere"); err != nil || image != testKetoK8Image {
+		t.Errorf("got vsphere image %q, error %v; want %q", image, err, testKetoK8Image)
+	}
+}